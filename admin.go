@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close frame reasons for connections dropped through the admin API.
+const (
+	adminDisconnectReason = "disconnected_by_admin"
+	adminRoomClosedReason = "room_closed"
+)
+
+// adminHandler serves the admin API. Every request must carry token as a
+// bearer token.
+//
+//	GET    /admin/rooms                        list rooms and their members
+//	GET    /admin/rooms/{id}                   room details, cache and pending requests
+//	DELETE /admin/rooms/{id}                   close a room and disconnect its members
+//	POST   /admin/devices/{id}/disconnect      disconnect a device's connections
+//	GET    /admin/revocations                  list revoked tokens and devices
+//	PUT    /admin/revocations/tokens/{jti}     revoke a token by its jti claim
+//	PUT    /admin/revocations/devices/{id}     revoke all tokens of a device
+//	DELETE /admin/revocations/{kind}/{id}      lift a revocation
+func (m *Manager) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/rooms", m.adminListRooms)
+	mux.HandleFunc("GET /admin/rooms/{id}", m.adminGetRoom)
+	mux.HandleFunc("DELETE /admin/rooms/{id}", m.adminCloseRoom)
+	mux.HandleFunc("POST /admin/devices/{id}/disconnect", m.adminDisconnectDevice)
+	mux.HandleFunc("GET /admin/revocations", m.adminListRevocations)
+	mux.HandleFunc("PUT /admin/revocations/{kind}/{id}", m.adminRevoke)
+	mux.HandleFunc("DELETE /admin/revocations/{kind}/{id}", m.adminRestore)
+	return requireBearer(token, mux)
+}
+
+func requireBearer(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminMember struct {
+	DeviceID     string `json:"device_id"`
+	DeviceType   string `json:"device_type"`
+	ConnectionID string `json:"connection_id,omitempty"`
+	Node         string `json:"node,omitempty"` // set for devices on other instances
+}
+
+type adminRoom struct {
+	ID         string        `json:"id"`
+	MacID      string        `json:"mac_id"`
+	Active     bool          `json:"active"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Clients    []adminMember `json:"clients"`
+	Remote     []adminMember `json:"remote"`
+	Authorized []string      `json:"authorized"`
+	CacheKeys  []string      `json:"cache_keys"`
+}
+
+type adminCacheEntry struct {
+	Data      json.RawMessage `json:"data"`
+	Version   uint64          `json:"version"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+type adminRoomDetail struct {
+	adminRoom
+	Cache           map[string]adminCacheEntry `json:"cache"`
+	PendingRequests []string                   `json:"pending_requests"`
+}
+
+// adminView describes the room for the admin API.
+func (r *Room) adminView() adminRoom {
+	r.mu.RLock()
+	view := adminRoom{
+		ID:         r.id,
+		MacID:      r.macID,
+		Active:     r.isActive,
+		CreatedAt:  r.createdAt,
+		Clients:    make([]adminMember, 0, len(r.clients)),
+		Remote:     make([]adminMember, 0, len(r.remote)),
+		Authorized: make([]string, 0, len(r.authorized)),
+	}
+	for _, c := range r.clients {
+		view.Clients = append(view.Clients, adminMember{
+			DeviceID:     c.deviceID,
+			DeviceType:   c.deviceType,
+			ConnectionID: c.connID,
+		})
+	}
+	for deviceID, peer := range r.remote {
+		if peer.fresh() {
+			view.Remote = append(view.Remote, adminMember{DeviceID: deviceID, DeviceType: peer.deviceType, Node: peer.node})
+		}
+	}
+	for deviceID := range r.authorized {
+		view.Authorized = append(view.Authorized, deviceID)
+	}
+	r.mu.RUnlock()
+
+	view.CacheKeys = make([]string, 0, len(cachedEvents))
+	for key := range r.cache.Snapshot() {
+		view.CacheKeys = append(view.CacheKeys, key)
+	}
+
+	sort.Slice(view.Clients, func(i, j int) bool { return view.Clients[i].DeviceID < view.Clients[j].DeviceID })
+	sort.Slice(view.Remote, func(i, j int) bool { return view.Remote[i].DeviceID < view.Remote[j].DeviceID })
+	sort.Strings(view.Authorized)
+	sort.Strings(view.CacheKeys)
+	return view
+}
+
+// pendingRequestIDs returns the IDs of requests waiting for a response.
+func (r *Room) pendingRequestIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.pending))
+	for id := range r.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// localRoom returns a room held by this instance, active or dormant.
+func (m *Manager) localRoom(roomID string) (*Room, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[roomID]
+	return room, ok
+}
+
+func (m *Manager) adminListRooms(w http.ResponseWriter, _ *http.Request) {
+	m.mu.RLock()
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	m.mu.RUnlock()
+
+	views := make([]adminRoom, 0, len(rooms))
+	for _, room := range rooms {
+		views = append(views, room.adminView())
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].CreatedAt.Before(views[j].CreatedAt) })
+	writeJSON(w, http.StatusOK, map[string]any{"rooms": views})
+}
+
+func (m *Manager) adminGetRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.localRoom(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+
+	detail := adminRoomDetail{
+		adminRoom:       room.adminView(),
+		Cache:           make(map[string]adminCacheEntry),
+		PendingRequests: room.pendingRequestIDs(),
+	}
+	for key, entry := range room.cache.Snapshot() {
+		detail.Cache[key] = adminCacheEntry{
+			Data:      entry.Data,
+			Version:   entry.Version,
+			UpdatedAt: entry.UpdatedAt,
+			ExpiresAt: entry.UpdatedAt.Add(entry.TTL),
+		}
+	}
+	writeJSON(w, http.StatusOK, detail)
+}
+
+func (m *Manager) adminCloseRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+	room, ok := m.localRoom(roomID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+
+	// Let other instances drop their members too.
+	m.cluster.publish(clusterMessage{Kind: clusterMsgClose, RoomID: roomID})
+	disconnected := m.closeRoom(room)
+	m.pairing.revokeRoom(roomID)
+	if err := m.store.DeleteRoom(roomID); err != nil {
+		slog.Error("Failed to delete room from store", "room_id", roomID, "error", err)
+	}
+
+	slog.Info("Room closed by admin", "room_id", roomID, "disconnected", disconnected)
+	writeJSON(w, http.StatusOK, map[string]any{"room_id": roomID, "disconnected": disconnected})
+}
+
+// closeRoom removes room from this instance and disconnects its local
+// members. It returns the number of connections closed.
+func (m *Manager) closeRoom(room *Room) int {
+	m.mu.Lock()
+	if m.rooms[room.id] == room {
+		delete(m.rooms, room.id)
+	}
+	m.mu.Unlock()
+	m.cluster.detach(room.id)
+	room.stopTelemetry()
+
+	room.mu.Lock()
+	clients := make([]*Client, 0, len(room.clients))
+	for deviceID, c := range room.clients {
+		clients = append(clients, c)
+		delete(room.clients, deviceID)
+	}
+	for reqID, req := range room.pending {
+		close(req.ch)
+		delete(room.pending, reqID)
+	}
+	room.isActive = false
+	room.mu.Unlock()
+
+	for _, c := range clients {
+		c.mu.Lock()
+		c.room = nil
+		c.mu.Unlock()
+		m.cluster.withdraw(room.id, c.deviceID, c.deviceType)
+		c.closeWithReason(websocket.CloseGoingAway, adminRoomClosedReason)
+	}
+	return len(clients)
+}
+
+func (m *Manager) adminDisconnectDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	clients := m.sessions.connected(deviceID)
+	if len(clients) == 0 {
+		writeJSONError(w, http.StatusNotFound, "device not connected to this instance")
+		return
+	}
+
+	for _, c := range clients {
+		c.logger().Info("Disconnecting device by admin request")
+		c.closeWithReason(websocket.ClosePolicyViolation, adminDisconnectReason)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"device_id": deviceID, "disconnected": len(clients)})
+}
+
+// revocationKinds maps the path segments of the revocation endpoints to
+// revocation kinds.
+var revocationKinds = map[string]string{
+	"tokens":  revokeToken,
+	"devices": revokeDevice,
+}
+
+func (m *Manager) adminListRevocations(w http.ResponseWriter, _ *http.Request) {
+	entries, err := m.revocations.list()
+	if err != nil {
+		slog.Error("Failed to list revocations", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list revocations")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tokens":  entries[revokeToken],
+		"devices": entries[revokeDevice],
+	})
+}
+
+// adminRevoke adds a token or device to the revocation list and closes the
+// connections using it on every instance. A token revocation may carry the
+// token's expiry as {"expires_at": ...} so the entry is pruned once the
+// token could no longer be used anyway.
+func (m *Manager) adminRevoke(w http.ResponseWriter, r *http.Request) {
+	kind, ok := revocationKinds[r.PathValue("kind")]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown revocation kind")
+		return
+	}
+	value := r.PathValue("id")
+
+	var body struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+	}
+	if kind == revokeDevice {
+		body.ExpiresAt = time.Time{}
+	}
+
+	if err := m.revocations.revoke(kind, value, body.ExpiresAt); err != nil {
+		slog.Error("Failed to revoke", "kind", kind, "value", value, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke")
+		return
+	}
+	slog.Info("Revoked by admin", "kind", kind, "value", value)
+	writeJSON(w, http.StatusOK, map[string]any{"kind": kind, "id": value, "revoked": true})
+}
+
+func (m *Manager) adminRestore(w http.ResponseWriter, r *http.Request) {
+	kind, ok := revocationKinds[r.PathValue("kind")]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown revocation kind")
+		return
+	}
+	value := r.PathValue("id")
+
+	removed, err := m.revocations.restore(kind, value)
+	if err != nil {
+		slog.Error("Failed to lift revocation", "kind", kind, "value", value, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to lift revocation")
+		return
+	}
+	if !removed {
+		writeJSONError(w, http.StatusNotFound, "not revoked")
+		return
+	}
+	slog.Info("Revocation lifted by admin", "kind", kind, "value", value)
+	writeJSON(w, http.StatusOK, map[string]any{"kind": kind, "id": value, "revoked": false})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"echo/protocol"
+)
+
+// Directions of an event, given as x-direction in the AsyncAPI document.
+const (
+	directionClientToServer = "client_to_server"
+	directionServerToClient = "server_to_client"
+	directionMacToWatch     = "mac_to_watch"
+	directionWatchToMac     = "watch_to_mac"
+	directionPeerToPeer     = "peer_to_peer" // from either device to the other
+)
+
+// specEvent describes an event that is not dispatched through the handler
+// registry.
+type specEvent struct {
+	Type      string
+	Direction string
+	Summary   string
+	Payload   any // a protocol payload type
+	Replies   []string
+}
+
+// specEvents are the events the server sends on its own, and auth, which is
+// read before the connection reaches the registry.
+var specEvents = []specEvent{
+	{Type: EventAuth, Direction: directionClientToServer, Summary: "Authenticates a connection opened without a token", Payload: protocol.Auth{}, Replies: []string{EventConnect}},
+	{Type: EventConnect, Direction: directionServerToClient, Summary: "Sent once the connection is authenticated", Payload: protocol.Connect{}},
+	{Type: EventWelcome, Direction: directionServerToClient, Summary: "Answers hello with what was agreed and the server's limits", Payload: protocol.Welcome{}},
+	{Type: EventResumed, Direction: directionServerToClient, Summary: "Answers resume after replaying missed events", Payload: protocol.Resumed{}},
+	{Type: EventTokenExpiring, Direction: directionServerToClient, Summary: "Warns that the token expires soon; send refresh_token", Payload: protocol.TokenExpiring{}},
+	{Type: EventTokenRefreshed, Direction: directionServerToClient, Summary: "Answers refresh_token", Payload: protocol.TokenRefreshed{}},
+	{Type: EventEventsDropped, Direction: directionServerToClient, Summary: "Reports events lost to backpressure", Payload: protocol.EventsDropped{}},
+	{Type: EventRoomJoined, Direction: directionServerToClient, Summary: "Tells a device it is in a room", Payload: protocol.RoomJoined{}},
+	{Type: EventPairingCode, Direction: directionServerToClient, Summary: "Answers pairing_request with a code for the watch", Payload: protocol.PairingCode{}},
+	{Type: EventPairingPending, Direction: directionServerToClient, Summary: "Tells the watch that the Mac has to approve it", Payload: protocol.PairingPending{}},
+	{Type: EventPairingApproval, Direction: directionServerToClient, Summary: "Asks the Mac to approve a watch; answer with pairing_decision", Payload: protocol.PairingApproval{}},
+	{Type: EventSyncResult, Direction: directionServerToClient, Summary: "Answers sync with a patch or snapshot per cache key", Payload: protocol.SyncResult{}},
+	{Type: EventPeerConnected, Direction: directionServerToClient, Summary: "Announces a device that joined the room", Payload: protocol.PeerEvent{}},
+	{Type: EventPeerDisconnected, Direction: directionServerToClient, Summary: "Announces a device that left the room", Payload: protocol.PeerEvent{}},
+	{Type: EventStatusUpdate, Direction: directionServerToClient, Summary: "Describes the room, periodically and when it changes", Payload: protocol.StatusUpdate{}},
+	{Type: EventError, Direction: directionServerToClient, Summary: "Reports an event that failed, with its request_id", Payload: protocol.ErrorPayload{}},
+}
+
+// Names of the RoomPolicy values in the document.
+var roomPolicyNames = map[RoomPolicy]string{
+	RoomOptional: "optional",
+	RoomRequired: "required",
+	RoomIgnore:   "ignored",
+}
+
+// direction tells where an event handled by h travels.
+func (h *EventHandler) direction() string {
+	switch {
+	case !h.Relay:
+		return directionClientToServer
+	case slices.Equal(h.DeviceTypes, []string{DeviceTypeMac}):
+		return directionMacToWatch
+	case slices.Equal(h.DeviceTypes, []string{DeviceTypeWatch}):
+		return directionWatchToMac
+	}
+	return directionPeerToPeer
+}
+
+// errorCodes lists the codes the registry may reject an event handled by h
+// with, before the handler runs.
+func (h *EventHandler) errorCodes() []string {
+	codes := []string{ErrCodeValidation, ErrCodeRateLimited}
+	if len(h.DeviceTypes) > 0 {
+		codes = append(codes, ErrCodeInvalidDeviceType)
+	}
+	if h.Room == RoomRequired {
+		codes = append(codes, ErrCodeNotInRoom)
+	}
+	return codes
+}
+
+// asyncAPI returns an AsyncAPI 3.0 document describing every event, from
+// the server's point of view: it receives the events devices send and
+// sends the events they receive. Inbound payloads are described by the
+// schemas the registry validates against, the others by their protocol
+// types.
+func (m *Manager) asyncAPI() map[string]any {
+	channel := map[string]any{"$ref": "#/channels/ws"}
+	ref := func(eventType string) map[string]any {
+		return map[string]any{"$ref": "#/channels/ws/messages/" + eventType}
+	}
+	refs := func(eventTypes []string) []any {
+		out := make([]any, 0, len(eventTypes))
+		for _, t := range eventTypes {
+			out = append(out, ref(t))
+		}
+		return out
+	}
+
+	messages := make(map[string]any)
+	channelMessages := make(map[string]any)
+	operations := make(map[string]any)
+	// Types that take part in a request/response. Errors answer any event
+	// sent with a request_id.
+	correlated := map[string]bool{EventError: true}
+
+	addMessage := func(eventType, summary, direction string, payload map[string]any) {
+		messages[eventType] = map[string]any{
+			"name":        eventType,
+			"summary":     summary,
+			"x-direction": direction,
+			"payload": map[string]any{
+				"allOf": []any{
+					map[string]any{"$ref": "#/components/schemas/Event"},
+					map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"type":    map[string]any{"const": eventType},
+							"payload": payload,
+						},
+					},
+				},
+			},
+		}
+		channelMessages[eventType] = map[string]any{"$ref": "#/components/messages/" + eventType}
+	}
+	addOperation := func(action, eventType, summary string, replies []string) map[string]any {
+		op := map[string]any{
+			"action":   action,
+			"channel":  channel,
+			"summary":  summary,
+			"messages": []any{ref(eventType)},
+		}
+		if len(replies) > 0 {
+			op["reply"] = map[string]any{"channel": channel, "messages": refs(replies)}
+			correlated[eventType] = true
+			for _, r := range replies {
+				correlated[r] = true
+			}
+		}
+		operations[action+"_"+eventType] = op
+		return op
+	}
+
+	for _, h := range m.handlers.all() {
+		addMessage(h.Type, h.Summary, h.direction(), h.Schema.jsonSchema())
+		op := addOperation("receive", h.Type, h.Summary, h.Replies)
+		op["x-room"] = roomPolicyNames[h.Room]
+		op["x-errors"] = h.errorCodes()
+		if len(h.DeviceTypes) > 0 {
+			op["x-device-types"] = h.DeviceTypes
+		}
+		if h.Relay {
+			addOperation("send", h.Type, "Relays "+h.Type+" to the other devices of the room", nil)
+		}
+	}
+	for _, ev := range specEvents {
+		payload := jsonSchema(reflect.TypeOf(ev.Payload))
+		if ev.Type == EventError {
+			payload["properties"].(map[string]any)["code"] = map[string]any{"type": "string", "enum": protocol.ErrorCodes}
+		}
+		addMessage(ev.Type, ev.Summary, ev.Direction, payload)
+		action := "send"
+		if ev.Direction == directionClientToServer {
+			action = "receive"
+		}
+		addOperation(action, ev.Type, ev.Summary, ev.Replies)
+	}
+	for eventType := range correlated {
+		if msg, ok := messages[eventType].(map[string]any); ok {
+			msg["correlationId"] = map[string]any{"$ref": "#/components/correlationIds/requestId"}
+		}
+	}
+
+	return map[string]any{
+		"asyncapi": "3.0.0",
+		"info": map[string]any{
+			"title":   "echo",
+			"version": strconv.Itoa(protocolVersion),
+			"description": "Events exchanged between Macs, watches and the echo server over a WebSocket. " +
+				"Every message is an Event envelope whose payload depends on its type. " +
+				"x-direction tells whether an event is handled by the server or relayed between the devices of a room.",
+			"x-min-protocol-version": minProtocolVersion,
+		},
+		"defaultContentType": "application/json",
+		"channels": map[string]any{
+			"ws": map[string]any{
+				"address":  "/ws",
+				"title":    "Device connection",
+				"messages": channelMessages,
+			},
+		},
+		"operations": operations,
+		"components": map[string]any{
+			"messages": messages,
+			"schemas": map[string]any{
+				"Event": jsonSchema(reflect.TypeOf(Event{})),
+			},
+			"correlationIds": map[string]any{
+				"requestId": map[string]any{
+					"description": "Replies and errors carry the request_id of the event they answer",
+					"location":    "$message.payload#/request_id",
+				},
+			},
+		},
+	}
+}
+
+// serveAsyncAPI serves the document returned by asyncAPI.
+func (m *Manager) serveAsyncAPI(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, m.asyncAPI())
+}
+
+// jsonSchema describes s as a JSON Schema, with its size limit as
+// x-max-size.
+func (s *PayloadSchema) jsonSchema() map[string]any {
+	root := FieldSchema{Type: s.Type, Fields: s.Fields}
+	if root.Type == "" {
+		root.Type = FieldObject
+	}
+	schema := root.jsonSchema()
+	schema["x-max-size"] = cmp.Or(s.MaxSize, maxPayloadSize)
+	return schema
+}
+
+// jsonSchema describes f as a JSON Schema. MaxLength counts bytes where
+// JSON Schema counts characters, which only differ for non-ASCII strings.
+func (f *FieldSchema) jsonSchema() map[string]any {
+	schema := make(map[string]any)
+	if f.Type != FieldAny {
+		schema["type"] = string(f.Type)
+	}
+	if f.Min != nil {
+		schema["minimum"] = *f.Min
+	}
+	if f.Max != nil {
+		schema["maximum"] = *f.Max
+	}
+	if f.MaxLength > 0 {
+		schema["maxLength"] = f.MaxLength
+	}
+	if len(f.Enum) > 0 {
+		schema["enum"] = f.Enum
+	}
+	if f.MaxItems > 0 {
+		if f.Type == FieldArray {
+			schema["maxItems"] = f.MaxItems
+		} else {
+			schema["maxProperties"] = f.MaxItems
+		}
+	}
+	if f.Items != nil {
+		schema["items"] = f.Items.jsonSchema()
+	}
+	if len(f.Fields) > 0 {
+		props := make(map[string]any, len(f.Fields))
+		var required []string
+		for _, field := range f.Fields {
+			props[field.Name] = field.jsonSchema()
+			if field.Required {
+				required = append(required, field.Name)
+			}
+		}
+		schema["properties"] = props
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+	}
+	if f.Values != nil {
+		schema["additionalProperties"] = f.Values.jsonSchema()
+	}
+	return schema
+}
+
+// jsonSchema describes t, a protocol type, as a JSON Schema from its json
+// tags. Fields that are omitempty or pointers are optional.
+func jsonSchema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]any)
+		var required []string
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
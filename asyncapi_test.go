@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"echo/protocol"
+)
+
+var updateSpec = flag.Bool("update", false, "rewrite asyncapi.json from the registered handlers")
+
+// specPath is the checked-in copy of the document served at /asyncapi.json,
+// for client developers who build against it.
+const specPath = "asyncapi.json"
+
+// unusedEvents are declared in the protocol package but neither handled
+// nor sent by the server.
+var unusedEvents = []string{
+	EventDisconnect,
+	EventLeaveRoom,
+	EventAction,
+	EventMediaActionRequest,
+	EventMediaActionResult,
+}
+
+// inboundPayloads maps the event types of the registry to their protocol
+// payload types. A nil type marks a payload the server does not interpret.
+var inboundPayloads = map[string]any{
+	EventHello:           protocol.Hello{},
+	EventRoomStatus:      nil,
+	EventCreateRoom:      protocol.CreateRoom{},
+	EventJoinRoom:        protocol.JoinRoom{},
+	EventDeviceInfo:      protocol.DeviceInfo{},
+	EventBatteryUpdate:   protocol.BatteryStatus{},
+	EventStorageUpdate:   protocol.StorageStatus{},
+	EventDownloadsUpdate: protocol.DownloadsList{},
+	EventActionRequest:   protocol.Action{},
+	EventMediaAction:     protocol.MediaAction{},
+	EventActionResult:    nil,
+	EventRequest:         protocol.Request{},
+	EventResponse:        nil,
+	EventPairingRequest:  protocol.PairingRequest{},
+	EventPairingRedeem:   protocol.PairingRedeem{},
+	EventPairingDecision: protocol.PairingDecision{},
+	EventSync:            protocol.Sync{},
+	EventAck:             protocol.Ack{},
+	EventResume:          protocol.Resume{},
+	EventRefreshToken:    protocol.RefreshToken{},
+}
+
+func specManager() *Manager {
+	m := &Manager{handlers: NewHandlerRegistry()}
+	m.registerHandlers()
+	return m
+}
+
+// generatedSpec returns the document as served, decoded into plain JSON
+// values.
+func generatedSpec(t *testing.T) ([]byte, map[string]any) {
+	t.Helper()
+	b, err := json.MarshalIndent(specManager().asyncAPI(), "", "  ")
+	if err != nil {
+		t.Fatalf("marshal spec: %v", err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("unmarshal spec: %v", err)
+	}
+	return append(b, '\n'), doc
+}
+
+// protocolConstants returns the constants in file of the protocol package
+// whose names start with prefix, by name.
+func protocolConstants(t *testing.T, file, prefix string) map[string]string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "protocol/"+file, nil, 0)
+	if err != nil {
+		t.Fatalf("parse %s: %v", file, err)
+	}
+	values := make(map[string]string)
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, name := range vs.Names {
+				lit, ok := vs.Values[i].(*ast.BasicLit)
+				if !strings.HasPrefix(name.Name, prefix) || !ok || lit.Kind != token.STRING {
+					continue
+				}
+				values[name.Name], _ = strconv.Unquote(lit.Value)
+			}
+		}
+	}
+	return values
+}
+
+func TestAsyncAPIUpToDate(t *testing.T) {
+	got, _ := generatedSpec(t)
+	if *updateSpec {
+		if err := os.WriteFile(specPath, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s is out of date with the registered handlers; run go test -run TestAsyncAPIUpToDate -update", specPath)
+	}
+}
+
+func TestAsyncAPICoversProtocol(t *testing.T) {
+	_, doc := generatedSpec(t)
+	messages := doc["components"].(map[string]any)["messages"].(map[string]any)
+
+	for _, eventType := range protocolConstants(t, "event.go", "Event") {
+		_, specified := messages[eventType]
+		unused := false
+		for _, u := range unusedEvents {
+			unused = unused || u == eventType
+		}
+		switch {
+		case specified && unused:
+			t.Errorf("%s is listed as unused but is in the spec", eventType)
+		case !specified && !unused:
+			t.Errorf("%s is missing from the spec", eventType)
+		}
+	}
+
+	errMsg := messages[EventError].(map[string]any)
+	payload := errMsg["payload"].(map[string]any)["allOf"].([]any)[1].(map[string]any)["properties"].(map[string]any)["payload"]
+	codes := payload.(map[string]any)["properties"].(map[string]any)["code"].(map[string]any)["enum"].([]any)
+	for _, code := range protocolConstants(t, "errors.go", "ErrCode") {
+		found := false
+		for _, c := range codes {
+			found = found || c == code
+		}
+		if !found {
+			t.Errorf("error code %s is missing from the spec", code)
+		}
+	}
+
+	registered := make(map[string]bool)
+	for _, h := range specManager().handlers.all() {
+		registered[h.Type] = true
+		if h.Summary == "" {
+			t.Errorf("handler for %s has no summary", h.Type)
+		}
+	}
+	for _, ev := range specEvents {
+		if registered[ev.Type] {
+			t.Errorf("%s is in specEvents but also has a handler", ev.Type)
+		}
+	}
+}
+
+// TestAsyncAPIReferences checks that every $ref in the document, including
+// the replies of handlers, resolves.
+func TestAsyncAPIReferences(t *testing.T) {
+	_, doc := generatedSpec(t)
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				var target any = doc
+				for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					obj, _ := target.(map[string]any)
+					target = obj[part]
+				}
+				if target == nil {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+}
+
+// TestAsyncAPIPayloadTypes checks that the schemas handlers validate
+// against agree with the protocol payload types clients encode, in both
+// directions and down to nested objects.
+func TestAsyncAPIPayloadTypes(t *testing.T) {
+	for _, h := range specManager().handlers.all() {
+		payload, ok := inboundPayloads[h.Type]
+		if !ok {
+			t.Errorf("%s has no entry in inboundPayloads", h.Type)
+			continue
+		}
+		if payload == nil {
+			continue
+		}
+		if h.Schema.Type == FieldAny || len(h.Schema.Fields) == 0 {
+			t.Errorf("%s is decoded into %T but its schema declares no fields", h.Type, payload)
+			continue
+		}
+		comparePayloadFields(t, h.Type, h.Schema.Fields, reflect.TypeOf(payload))
+	}
+}
+
+// fieldKinds are the Go kinds a protocol field may have for each FieldType.
+var fieldKinds = map[FieldType][]reflect.Kind{
+	FieldString:  {reflect.String},
+	FieldNumber:  {reflect.Float64, reflect.Float32},
+	FieldInteger: {reflect.Int, reflect.Int64, reflect.Uint64},
+	FieldBoolean: {reflect.Bool},
+	FieldObject:  {reflect.Map, reflect.Struct},
+	FieldArray:   {reflect.Slice},
+}
+
+// comparePayloadFields reports the fields of schema that typ, a struct,
+// lacks or types differently, and the fields typ always encodes that
+// schema lacks.
+func comparePayloadFields(t *testing.T, path string, schema []FieldSchema, typ reflect.Type) {
+	t.Helper()
+	fields := make(map[string]reflect.StructField)
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		fields[name] = f
+		declared := slices.ContainsFunc(schema, func(fs FieldSchema) bool { return fs.Name == name })
+		if !declared && !strings.Contains(opts, "omitempty") {
+			t.Errorf("%s: %s.%s is always encoded but %s is missing from the schema", path, typ, f.Name, name)
+		}
+	}
+	for _, fs := range schema {
+		f, ok := fields[fs.Name]
+		if !ok {
+			t.Errorf("%s: schema field %s is missing from %s", path, fs.Name, typ)
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if fs.Type != FieldAny && !slices.Contains(fieldKinds[fs.Type], ft.Kind()) {
+			t.Errorf("%s: schema field %s is %s but %s.%s is %s", path, fs.Name, fs.Type, typ, f.Name, f.Type)
+			continue
+		}
+		if fs.Required && strings.Contains(f.Tag.Get("json"), "omitempty") {
+			t.Errorf("%s: schema field %s is required but %s.%s is omitempty", path, fs.Name, typ, f.Name)
+		}
+		fieldPath := path + "." + fs.Name
+		switch {
+		case ft.Kind() == reflect.Struct:
+			comparePayloadFields(t, fieldPath, fs.Fields, ft)
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+			if fs.Items == nil || fs.Items.Type != FieldObject {
+				t.Errorf("%s: items of schema field %s must be objects like %s", path, fs.Name, ft.Elem())
+				continue
+			}
+			comparePayloadFields(t, fieldPath+"[]", fs.Items.Fields, ft.Elem())
+		}
+	}
+}
+
+// TestAsyncAPIReplies checks the replies each handler declares against the
+// events it sends back with the request's request_id. Those are read from
+// the sources: Event literals with a RequestID passed to send on the
+// handler's client, in the handler or in the functions it hands the client
+// to. Errors answer any request and are not declared.
+func TestAsyncAPIReplies(t *testing.T) {
+	funcs := packageFuncs(t)
+	constants := protocolConstants(t, "event.go", "Event")
+
+	for _, h := range specManager().handlers.all() {
+		name := runtime.FuncForPC(reflect.ValueOf(h.Handle).Pointer()).Name()
+		name = strings.TrimSuffix(name[strings.LastIndex(name, ".")+1:], "-fm")
+		decls := funcs[name]
+		if len(decls) != 1 {
+			t.Errorf("%s: found %d declarations of its handler %s", h.Type, len(decls), name)
+			continue
+		}
+
+		// Handlers take the event and then the client.
+		params := paramNames(decls[0])
+		sent := make(map[string]bool)
+		collectReplies(funcs, decls[0], params[len(params)-1], sent, make(map[*ast.FuncDecl]bool))
+		var replies []string
+		for ident := range sent {
+			if value := constants[ident]; value != EventError {
+				replies = append(replies, value)
+			}
+		}
+		slices.Sort(replies)
+		declared := slices.Sorted(slices.Values(h.Replies))
+		if !slices.Equal(replies, declared) {
+			t.Errorf("%s declares replies %v but %s sends %v", h.Type, declared, name, replies)
+		}
+	}
+}
+
+// packageFuncs parses the non-test sources of the package and returns its
+// functions and methods by name.
+func packageFuncs(t *testing.T) map[string][]*ast.FuncDecl {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := make(map[string][]*ast.FuncDecl)
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", file, err)
+		}
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Body != nil {
+				funcs[fn.Name.Name] = append(funcs[fn.Name.Name], fn)
+			}
+		}
+	}
+	return funcs
+}
+
+// paramNames returns the names of fn's receiver, if any, followed by its
+// parameters.
+func paramNames(fn *ast.FuncDecl) []string {
+	var names []string
+	for _, list := range []*ast.FieldList{fn.Recv, fn.Type.Params} {
+		if list == nil {
+			continue
+		}
+		for _, field := range list.List {
+			for _, name := range field.Names {
+				names = append(names, name.Name)
+			}
+			if len(field.Names) == 0 {
+				names = append(names, "_")
+			}
+		}
+	}
+	return names
+}
+
+// collectReplies adds to sent the names of the event constants that fn
+// sends with a request_id to the client named client, following the calls
+// that pass the client on.
+func collectReplies(funcs map[string][]*ast.FuncDecl, fn *ast.FuncDecl, client string, sent map[string]bool, seen map[*ast.FuncDecl]bool) {
+	if seen[fn] {
+		return
+	}
+	seen[fn] = true
+
+	isClient := func(expr ast.Expr) bool {
+		ident, ok := expr.(*ast.Ident)
+		return ok && ident.Name == client
+	}
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		var callee string
+		var args []ast.Expr // the receiver, if any, then the arguments
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			callee, args = fun.Name, append([]ast.Expr{nil}, call.Args...)
+		case *ast.SelectorExpr:
+			callee, args = fun.Sel.Name, append([]ast.Expr{fun.X}, call.Args...)
+		default:
+			return true
+		}
+
+		if callee == "send" && isClient(args[0]) {
+			ast.Inspect(call, func(n ast.Node) bool {
+				if ident, ok := replyType(n); ok {
+					sent[ident] = true
+				}
+				return true
+			})
+			return true
+		}
+		for i, arg := range args {
+			if arg == nil || !isClient(arg) {
+				continue
+			}
+			for _, decl := range funcs[callee] {
+				// Functions without a receiver take the arguments from
+				// position 0.
+				names := paramNames(decl)
+				if decl.Recv == nil {
+					names = append([]string{""}, names...)
+				}
+				if i < len(names) && names[i] != "_" && names[i] != "" {
+					collectReplies(funcs, decl, names[i], sent, seen)
+				}
+			}
+		}
+		return true
+	})
+}
+
+// replyType returns the name of the Type constant of an Event literal that
+// sets RequestID.
+func replyType(n ast.Node) (string, bool) {
+	lit, ok := n.(*ast.CompositeLit)
+	if !ok {
+		return "", false
+	}
+	if ident, ok := lit.Type.(*ast.Ident); !ok || ident.Name != "Event" {
+		return "", false
+	}
+	var eventType string
+	var correlated bool
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := kv.Key.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		switch key.Name {
+		case "Type":
+			if value, ok := kv.Value.(*ast.Ident); ok {
+				eventType = value.Name
+			}
+		case "RequestID":
+			correlated = true
+		}
+	}
+	return eventType, correlated && eventType != ""
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"echo/protocol"
+)
+
+// Backplane keys of the revocation list, shared by all instances.
+const (
+	revokedTokensKey  = "echo:revoked:tokens"  // jti -> revocation
+	revokedDevicesKey = "echo:revoked:devices" // deviceID -> revocation
+	revocationChannel = "echo:revocations"
+)
+
+// Revocation kinds, as used in the admin API.
+const (
+	revokeToken  = "token"
+	revokeDevice = "device"
+)
+
+// Close frame reasons for connections whose token is no longer valid.
+const (
+	tokenExpiredReason = "token_expired"
+	tokenRevokedReason = "token_revoked"
+)
+
+// revocation is an entry of the revocation list.
+type revocation struct {
+	RevokedAt time.Time `json:"revoked_at"`
+	// ExpiresAt is when a revoked token would have expired anyway; the
+	// entry is pruned after that. Nil for devices, which stay revoked
+	// until restored.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// revocationNotice is published when an entry is added so every instance
+// drops the affected connections.
+type revocationNotice struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// RevocationList holds revoked token IDs (jti) and device IDs on the
+// backplane so a revocation applies to every instance.
+type RevocationList struct {
+	bp    Backplane
+	unsub func()
+}
+
+// NewRevocationList returns the list on bp. onRevoke is called on every
+// instance when an entry is added.
+func NewRevocationList(bp Backplane, onRevoke func(kind, value string)) (*RevocationList, error) {
+	unsub, err := bp.Subscribe(revocationChannel, func(data []byte) {
+		var n revocationNotice
+		if err := json.Unmarshal(data, &n); err != nil {
+			slog.Warn("Dropping malformed revocation notice", "error", err)
+			return
+		}
+		onRevoke(n.Kind, n.Value)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("subscribe to revocations: %w", err)
+	}
+	return &RevocationList{bp: bp, unsub: unsub}, nil
+}
+
+func (rl *RevocationList) Close() {
+	rl.unsub()
+}
+
+func revocationKey(kind string) (string, error) {
+	switch kind {
+	case revokeToken:
+		return revokedTokensKey, nil
+	case revokeDevice:
+		return revokedDevicesKey, nil
+	default:
+		return "", fmt.Errorf("unknown revocation kind: %s", kind)
+	}
+}
+
+// revoke adds value to the list and notifies all instances.
+func (rl *RevocationList) revoke(kind, value string, expiresAt time.Time) error {
+	key, err := revocationKey(kind)
+	if err != nil {
+		return err
+	}
+	entry := revocation{RevokedAt: time.Now()}
+	if !expiresAt.IsZero() {
+		entry.ExpiresAt = &expiresAt
+	}
+	data, _ := json.Marshal(entry)
+	if err := rl.bp.HSet(key, value, string(data)); err != nil {
+		return err
+	}
+	notice, _ := json.Marshal(revocationNotice{Kind: kind, Value: value})
+	return rl.bp.Publish(revocationChannel, notice)
+}
+
+// restore removes value from the list and reports whether it was there.
+func (rl *RevocationList) restore(kind, value string) (bool, error) {
+	key, err := revocationKey(kind)
+	if err != nil {
+		return false, err
+	}
+	return rl.bp.HDel(key, value)
+}
+
+// revoked reports whether the token jti or the device is revoked.
+func (rl *RevocationList) revoked(jti, deviceID string) (bool, error) {
+	if jti != "" {
+		if _, ok, err := rl.bp.HGet(revokedTokensKey, jti); err != nil || ok {
+			return ok, err
+		}
+	}
+	_, ok, err := rl.bp.HGet(revokedDevicesKey, deviceID)
+	return ok, err
+}
+
+// list returns the entries of both kinds, pruning tokens that have expired.
+func (rl *RevocationList) list() (map[string]map[string]revocation, error) {
+	now := time.Now()
+	result := make(map[string]map[string]revocation)
+	for _, kind := range []string{revokeToken, revokeDevice} {
+		key, _ := revocationKey(kind)
+		raw, err := rl.bp.HGetAll(key)
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string]revocation, len(raw))
+		for value, data := range raw {
+			var r revocation
+			if json.Unmarshal([]byte(data), &r) != nil {
+				continue
+			}
+			if r.ExpiresAt != nil && now.After(*r.ExpiresAt) {
+				_, _ = rl.bp.HDel(key, value)
+				continue
+			}
+			entries[value] = r
+		}
+		result[kind] = entries
+	}
+	return result, nil
+}
+
+// tokenInfo is the part of a validated JWT the server keeps enforcing for
+// the lifetime of a connection.
+type tokenInfo struct {
+	id        string    // jti claim, empty if absent
+	expiresAt time.Time // exp claim, zero if absent
+}
+
+func tokenInfoFromClaims(claims map[string]interface{}) tokenInfo {
+	var info tokenInfo
+	info.id, _ = claims["jti"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		info.expiresAt = time.Unix(int64(exp), 0)
+	}
+	return info
+}
+
+// setToken starts enforcing token on c: a token_expiring event is sent
+// tokenExpiryWarning before it expires and the connection is closed once
+// it has.
+func (c *Client) setToken(token tokenInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+	c.tokenWarned = false
+	if c.tokenTimer != nil {
+		c.tokenTimer.Stop()
+		c.tokenTimer = nil
+	}
+	if token.expiresAt.IsZero() {
+		return
+	}
+	c.tokenTimer = time.AfterFunc(time.Until(token.expiresAt.Add(-tokenExpiryWarning)), c.checkToken)
+}
+
+// checkToken runs when the token is about to expire and again when it has.
+func (c *Client) checkToken() {
+	c.mu.Lock()
+	expiresAt := c.token.expiresAt
+	remaining := time.Until(expiresAt)
+	if remaining <= 0 {
+		c.tokenTimer = nil
+		c.mu.Unlock()
+		c.logger().Info("Closing connection with expired token")
+		c.closeWithReason(websocket.ClosePolicyViolation, tokenExpiredReason)
+		return
+	}
+	warn := !c.tokenWarned
+	c.tokenWarned = true
+	c.tokenTimer = time.AfterFunc(remaining, c.checkToken)
+	c.mu.Unlock()
+
+	if warn {
+		c.send(Event{Type: EventTokenExpiring, Timestamp: time.Now(), Payload: protocol.EncodePayload(protocol.TokenExpiring{
+			ExpiresAt:   expiresAt,
+			ExpiresInMs: remaining.Milliseconds(),
+		})})
+	}
+}
+
+// stopToken stops enforcing the token once the connection is gone.
+func (c *Client) stopToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokenTimer != nil {
+		c.tokenTimer.Stop()
+		c.tokenTimer = nil
+	}
+}
+
+// handleRefreshToken replaces the token of the connection with a newer one
+// for the same device, extending the session without reconnecting.
+func (m *Manager) handleRefreshToken(ev Event, c *Client) error {
+	var payload protocol.RefreshToken
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	id, authErr := m.authenticate(payload.Token)
+	if authErr != nil {
+		switch authErr.reason {
+		case "":
+			return authErr
+		case jwtReasonRevoked:
+			jwtFailures.WithLabelValues(authErr.reason).Inc()
+			return newRouteError(ErrCodeTokenRevoked, "token has been revoked")
+		default:
+			jwtFailures.WithLabelValues(authErr.reason).Inc()
+			return newRouteError(ErrCodeInvalidToken, "invalid token")
+		}
+	}
+	if id.deviceID != c.deviceID || id.deviceType != c.deviceType {
+		jwtFailures.WithLabelValues(jwtReasonClaims).Inc()
+		return newRouteError(ErrCodeInvalidToken, "token was issued for a different device")
+	}
+
+	token := id.token
+	c.setToken(token)
+	c.logger().Info("Token refreshed", "expires_at", token.expiresAt)
+
+	c.send(Event{
+		Type:      EventTokenRefreshed,
+		RequestID: ev.RequestID,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.TokenRefreshed{ExpiresAt: token.expiresAt}),
+	})
+	return nil
+}
+
+// enforceRevocation closes the connections on this instance that use a
+// revoked token or belong to a revoked device.
+func (m *Manager) enforceRevocation(kind, value string) {
+	for _, c := range m.sessions.all() {
+		c.mu.RLock()
+		match := (kind == revokeToken && c.token.id == value) ||
+			(kind == revokeDevice && c.deviceID == value)
+		c.mu.RUnlock()
+		if match {
+			c.logger().Info("Closing connection with revoked credentials", "kind", kind)
+			c.closeWithReason(websocket.ClosePolicyViolation, tokenRevokedReason)
+		}
+	}
+}
+
+// Ways a client can present its token, as counted in authTransports.
+const (
+	authTransportHeader      = "header"
+	authTransportSubprotocol = "subprotocol"
+	authTransportMessage     = "message"
+	authTransportQuery       = "query" // deprecated, leaks into access logs
+)
+
+// authSubprotocolPrefix marks the token among the offered subprotocols,
+// e.g. "Sec-WebSocket-Protocol: echo.json, echo.auth.<jwt>". It is never
+// selected, so browser clients must also offer a codec subprotocol.
+const authSubprotocolPrefix = "echo.auth."
+
+// identity is the authenticated device behind a connection.
+type identity struct {
+	deviceID   string
+	deviceType string
+	token      tokenInfo
+}
+
+// authError rejects a token. message is sent to the client and reason
+// labels jwtFailures; it is empty when the failure was not the token's
+// fault. err, if set, is the underlying cause for the logs.
+type authError struct {
+	status  int
+	message string
+	reason  string
+	err     error
+}
+
+func (e *authError) Error() string {
+	if e.err != nil {
+		return e.message + ": " + e.err.Error()
+	}
+	return e.message
+}
+
+// closeReason is the close frame reason for a connection that failed to
+// authenticate with its first message.
+func (e *authError) closeReason() string {
+	switch e.status {
+	case 0:
+		return e.message
+	case http.StatusInternalServerError:
+		return "internal_error"
+	default:
+		return "unauthorized"
+	}
+}
+
+// tokenFromRequest returns the token sent with the upgrade request and how
+// it was sent, or an empty token if the client will authenticate with its
+// first message.
+func tokenFromRequest(r *http.Request) (token, transport string) {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return bearer, authTransportHeader
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if bearer, ok := strings.CutPrefix(protocol, authSubprotocolPrefix); ok {
+			return bearer, authTransportSubprotocol
+		}
+	}
+	if query := r.URL.Query().Get("token"); query != "" {
+		return query, authTransportQuery
+	}
+	return "", ""
+}
+
+// authenticate validates token and returns the device it was issued to.
+func (m *Manager) authenticate(token string) (identity, *authError) {
+	claims, err := validateJWT(token)
+	if err != nil {
+		return identity{}, &authError{http.StatusUnauthorized, "Unauthorized", jwtFailureReason(err), err}
+	}
+
+	deviceID, ok := claims["device_id"].(string)
+	if !ok || deviceID == "" {
+		return identity{}, &authError{http.StatusBadRequest, "Missing or invalid device_id in token", jwtReasonClaims, nil}
+	}
+	deviceType, ok := claims["device_type"].(string)
+	if !ok || (deviceType != DeviceTypeMac && deviceType != DeviceTypeWatch) {
+		return identity{}, &authError{http.StatusBadRequest, "Invalid device_type in token", jwtReasonClaims, nil}
+	}
+
+	id := identity{deviceID: deviceID, deviceType: deviceType, token: tokenInfoFromClaims(claims)}
+	revoked, err := m.revocations.revoked(id.token.id, deviceID)
+	if err != nil {
+		return identity{}, &authError{http.StatusInternalServerError, "Internal server error", "", fmt.Errorf("check revocation: %w", err)}
+	}
+	if revoked {
+		return identity{}, &authError{http.StatusUnauthorized, "Unauthorized", jwtReasonRevoked, errors.New("token revoked")}
+	}
+	return id, nil
+}
+
+// authenticateFirstMessage waits up to authTimeout for an auth event
+// carrying the token on a connection opened without one.
+func (m *Manager) authenticateFirstMessage(conn *websocket.Conn) (identity, *authError) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	conn.SetReadLimit(authMaxMessageSize)
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		return identity{}, &authError{message: "auth_timeout", reason: jwtReasonMissing, err: err}
+	}
+
+	// Text frames are always JSON; binary frames use the codec of the
+	// handshake.
+	codec := codecs[EncodingJSON]
+	if frameType == websocket.BinaryMessage {
+		codec = codecForSubprotocol(conn.Subprotocol())
+	}
+	ev, err := codec.Decode(data)
+	if err != nil || ev.Type != EventAuth {
+		return identity{}, &authError{message: "auth_required", reason: jwtReasonMissing}
+	}
+	var payload protocol.Auth
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil || payload.Token == "" {
+		return identity{}, &authError{message: "auth_required", reason: jwtReasonMissing}
+	}
+
+	return m.authenticate(payload.Token)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backplane connects server instances so clients of the same room can talk
+// to each other regardless of which instance they landed on. It offers
+// fan-out messaging and a small amount of shared state in Redis-like hashes.
+type Backplane interface {
+	Publish(channel string, data []byte) error
+	// Subscribe delivers messages published on channel to handler, in order,
+	// until the returned function is called.
+	Subscribe(channel string, handler func(data []byte)) (unsubscribe func(), err error)
+
+	HSet(key, field, value string) error
+	HGet(key, field string) (string, bool, error)
+	// HDel removes field and reports whether it existed. Only one caller can
+	// observe true for a given field, which makes it usable as a claim.
+	HDel(key, field string) (bool, error)
+	HGetAll(key string) (map[string]string, error)
+	// HIncrBy adds n to the integer in field, which starts at 0, and returns
+	// the result. Increments from all instances are applied atomically.
+	HIncrBy(key, field string, n int64) (int64, error)
+
+	Close() error
+}
+
+// openBackplane returns a Redis backplane when url is set and an in-process
+// backplane otherwise.
+func openBackplane(url string) (Backplane, error) {
+	if url == "" {
+		return NewMemoryBackplane(), nil
+	}
+	return NewRedisBackplane(url)
+}
+
+// MemoryBackplane is an in-process Backplane. Managers sharing one instance
+// behave like separate server instances behind a shared Redis, which makes
+// it useful for tests as well as single-instance deployments.
+type MemoryBackplane struct {
+	mu     sync.RWMutex
+	subs   map[string]map[int]*memorySubscription
+	nextID int
+	closed bool
+
+	hashMu sync.RWMutex
+	hashes map[string]map[string]string
+}
+
+// memorySubscription queues messages for its handler without bound, so
+// Publish never waits for a slow handler, much like Redis buffering
+// messages for a subscriber connection.
+type memorySubscription struct {
+	mu      sync.Mutex
+	pending [][]byte
+	ready   chan struct{}
+	done    chan struct{}
+}
+
+func (s *memorySubscription) deliver(data []byte) {
+	s.mu.Lock()
+	s.pending = append(s.pending, append([]byte(nil), data...))
+	s.mu.Unlock()
+	notify(s.ready)
+}
+
+func (s *memorySubscription) run(handler func(data []byte)) {
+	for {
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		batch := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+
+		for _, msg := range batch {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			handler(msg)
+		}
+	}
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		subs:   make(map[string]map[int]*memorySubscription),
+		hashes: make(map[string]map[string]string),
+	}
+}
+
+func (b *MemoryBackplane) Publish(channel string, data []byte) error {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return errBackplaneClosed
+	}
+	subs := make([]*memorySubscription, 0, len(b.subs[channel]))
+	for _, sub := range b.subs[channel] {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		sub.deliver(data)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(channel string, handler func(data []byte)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errBackplaneClosed
+	}
+
+	sub := &memorySubscription{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	id := b.nextID
+	b.nextID++
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[int]*memorySubscription)
+	}
+	b.subs[channel][id] = sub
+
+	go sub.run(handler)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// Close has already stopped every subscription.
+			if _, ok := b.subs[channel][id]; !ok {
+				return
+			}
+			delete(b.subs[channel], id)
+			if len(b.subs[channel]) == 0 {
+				delete(b.subs, channel)
+			}
+			close(sub.done)
+		})
+	}, nil
+}
+
+func (b *MemoryBackplane) HSet(key, field, value string) error {
+	b.hashMu.Lock()
+	defer b.hashMu.Unlock()
+	if b.hashes[key] == nil {
+		b.hashes[key] = make(map[string]string)
+	}
+	b.hashes[key][field] = value
+	return nil
+}
+
+func (b *MemoryBackplane) HGet(key, field string) (string, bool, error) {
+	b.hashMu.RLock()
+	defer b.hashMu.RUnlock()
+	value, ok := b.hashes[key][field]
+	return value, ok, nil
+}
+
+func (b *MemoryBackplane) HDel(key, field string) (bool, error) {
+	b.hashMu.Lock()
+	defer b.hashMu.Unlock()
+	if _, ok := b.hashes[key][field]; !ok {
+		return false, nil
+	}
+	delete(b.hashes[key], field)
+	if len(b.hashes[key]) == 0 {
+		delete(b.hashes, key)
+	}
+	return true, nil
+}
+
+func (b *MemoryBackplane) HGetAll(key string) (map[string]string, error) {
+	b.hashMu.RLock()
+	defer b.hashMu.RUnlock()
+	result := make(map[string]string, len(b.hashes[key]))
+	for field, value := range b.hashes[key] {
+		result[field] = value
+	}
+	return result, nil
+}
+
+func (b *MemoryBackplane) HIncrBy(key, field string, n int64) (int64, error) {
+	b.hashMu.Lock()
+	defer b.hashMu.Unlock()
+	var value int64
+	if raw, ok := b.hashes[key][field]; ok {
+		var err error
+		if value, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return 0, fmt.Errorf("hash value is not an integer: %w", err)
+		}
+	}
+	value += n
+	if b.hashes[key] == nil {
+		b.hashes[key] = make(map[string]string)
+	}
+	b.hashes[key][field] = strconv.FormatInt(value, 10)
+	return value, nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, subs := range b.subs {
+		for _, sub := range subs {
+			close(sub.done)
+		}
+	}
+	b.subs = nil
+	return nil
+}
+
+var errBackplaneClosed = errors.New("backplane closed")
+
+// RedisBackplane implements Backplane on top of Redis pub/sub and hashes.
+// All channel subscriptions share a single pub/sub connection.
+type RedisBackplane struct {
+	rdb    *redis.Client
+	pubsub *redis.PubSub
+
+	mu       sync.RWMutex
+	handlers map[string]map[int]func([]byte)
+	nextID   int
+	// subscribed is closed once Redis confirms the subscription to a
+	// channel; messages published before that are not delivered.
+	subscribed map[string]chan struct{}
+}
+
+func NewRedisBackplane(url string) (*RedisBackplane, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+
+	rdb := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+
+	b := &RedisBackplane{
+		rdb:        rdb,
+		pubsub:     rdb.Subscribe(context.Background()),
+		handlers:   make(map[string]map[int]func([]byte)),
+		subscribed: make(map[string]chan struct{}),
+	}
+	go b.dispatch()
+	return b, nil
+}
+
+func (b *RedisBackplane) dispatch() {
+	for received := range b.pubsub.ChannelWithSubscriptions() {
+		msg, ok := received.(*redis.Message)
+		if !ok {
+			if sub, ok := received.(*redis.Subscription); ok && sub.Kind == "subscribe" {
+				b.confirm(sub.Channel)
+			}
+			continue
+		}
+
+		b.mu.RLock()
+		handlers := make([]func([]byte), 0, len(b.handlers[msg.Channel]))
+		for _, h := range b.handlers[msg.Channel] {
+			handlers = append(handlers, h)
+		}
+		b.mu.RUnlock()
+
+		for _, h := range handlers {
+			h([]byte(msg.Payload))
+		}
+	}
+}
+
+// confirm marks the subscription to channel as active. Redis confirms it
+// again after go-redis reconnects.
+func (b *RedisBackplane) confirm(channel string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch, ok := b.subscribed[channel]; ok {
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+func (b *RedisBackplane) Publish(channel string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	return b.rdb.Publish(ctx, channel, data).Err()
+}
+
+func (b *RedisBackplane) Subscribe(channel string, handler func(data []byte)) (func(), error) {
+	b.mu.Lock()
+	first := len(b.handlers[channel]) == 0
+	if first {
+		b.handlers[channel] = make(map[int]func([]byte))
+		b.subscribed[channel] = make(chan struct{})
+	}
+	id := b.nextID
+	b.nextID++
+	b.handlers[channel][id] = handler
+	subscribed := b.subscribed[channel]
+	b.mu.Unlock()
+
+	// Wait for the subscription to take effect, so that messages published
+	// once Subscribe returns are delivered.
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	var err error
+	if first {
+		err = b.pubsub.Subscribe(ctx, channel)
+	}
+	if err == nil {
+		select {
+		case <-subscribed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		b.mu.Lock()
+		delete(b.handlers[channel], id)
+		if len(b.handlers[channel]) == 0 {
+			delete(b.handlers, channel)
+			delete(b.subscribed, channel)
+		}
+		b.mu.Unlock()
+		return nil, fmt.Errorf("subscribe %s: %w", channel, err)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.handlers[channel], id)
+			last := len(b.handlers[channel]) == 0
+			if last {
+				delete(b.handlers, channel)
+				delete(b.subscribed, channel)
+			}
+			b.mu.Unlock()
+
+			if last {
+				ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+				defer cancel()
+				if err := b.pubsub.Unsubscribe(ctx, channel); err != nil {
+					slog.Warn("Failed to unsubscribe", "channel", channel, "error", err)
+				}
+			}
+		})
+	}, nil
+}
+
+func (b *RedisBackplane) HSet(key, field, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	return b.rdb.HSet(ctx, key, field, value).Err()
+}
+
+func (b *RedisBackplane) HGet(key, field string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	value, err := b.rdb.HGet(ctx, key, field).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (b *RedisBackplane) HDel(key, field string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	n, err := b.rdb.HDel(ctx, key, field).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (b *RedisBackplane) HGetAll(key string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	return b.rdb.HGetAll(ctx, key).Result()
+}
+
+func (b *RedisBackplane) HIncrBy(key, field string, n int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backplaneTimeout)
+	defer cancel()
+	return b.rdb.HIncrBy(ctx, key, field, n).Result()
+}
+
+func (b *RedisBackplane) Close() error {
+	_ = b.pubsub.Close()
+	return b.rdb.Close()
+}
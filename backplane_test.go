@@ -0,0 +1,160 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisBackplane connects a RedisBackplane to the stand-in mr.
+func newTestRedisBackplane(t *testing.T, mr *miniredis.Miniredis) *RedisBackplane {
+	t.Helper()
+	bp, err := NewRedisBackplane("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bp.Close() })
+	return bp
+}
+
+// testBackplane checks the Backplane contract. publisher and subscriber
+// may be one backplane or two views of the same store.
+func testBackplane(t *testing.T, publisher, subscriber Backplane) {
+	t.Run("publish and subscribe", func(t *testing.T) {
+		received := make(chan string, 16)
+		unsubscribe, err := subscriber.Subscribe("test:channel", func(data []byte) {
+			received <- string(data)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"1", "2", "3"}
+		for _, msg := range want {
+			if err := publisher.Publish("test:channel", []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got []string
+		for range want {
+			select {
+			case msg := <-received:
+				got = append(got, msg)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("received %v, want %v", got, want)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("received %v, want %v", got, want)
+		}
+
+		unsubscribe()
+		if err := publisher.Publish("test:channel", []byte("late")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			t.Errorf("received %q after unsubscribing", msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("hashes", func(t *testing.T) {
+		if err := publisher.HSet("test:hash", "a", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if value, ok, err := subscriber.HGet("test:hash", "a"); err != nil || !ok || value != "1" {
+			t.Errorf("HGet = %q, %v, %v; want 1, true", value, ok, err)
+		}
+		if _, ok, err := subscriber.HGet("test:hash", "missing"); err != nil || ok {
+			t.Errorf("HGet of a missing field = %v, %v; want false", ok, err)
+		}
+		if all, err := subscriber.HGetAll("test:hash"); err != nil || len(all) != 1 || all["a"] != "1" {
+			t.Errorf("HGetAll = %v, %v; want map[a:1]", all, err)
+		}
+		if deleted, err := subscriber.HDel("test:hash", "a"); err != nil || !deleted {
+			t.Errorf("first HDel = %v, %v; want true", deleted, err)
+		}
+		if deleted, err := publisher.HDel("test:hash", "a"); err != nil || deleted {
+			t.Errorf("second HDel = %v, %v; want false", deleted, err)
+		}
+	})
+
+	t.Run("increments", func(t *testing.T) {
+		for i, bp := range []Backplane{publisher, subscriber, publisher} {
+			n, err := bp.HIncrBy("test:counters", "hits", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(2 * (i + 1)); n != want {
+				t.Errorf("HIncrBy = %d, want %d", n, want)
+			}
+		}
+		if value, _, _ := subscriber.HGet("test:counters", "hits"); value != strconv.Itoa(6) {
+			t.Errorf("counter stored as %q, want 6", value)
+		}
+		if err := publisher.HSet("test:counters", "text", "x"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := subscriber.HIncrBy("test:counters", "text", 1); err == nil {
+			t.Error("HIncrBy of a non-integer field succeeded")
+		}
+	})
+}
+
+func TestMemoryBackplane(t *testing.T) {
+	bp := NewMemoryBackplane()
+	defer bp.Close()
+	testBackplane(t, bp, bp)
+}
+
+func TestRedisBackplane(t *testing.T) {
+	mr := miniredis.RunT(t)
+	testBackplane(t, newTestRedisBackplane(t, mr), newTestRedisBackplane(t, mr))
+}
+
+func TestMemoryBackplanePublishDoesNotWait(t *testing.T) {
+	bp := NewMemoryBackplane()
+	defer bp.Close()
+
+	release := make(chan struct{})
+	received := make(chan int, 1024)
+	unsubscribe, err := bp.Subscribe("test:slow", func(data []byte) {
+		<-release
+		n, _ := strconv.Atoi(string(data))
+		received <- n
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	// The handler is stuck on the first message; publishing more than any
+	// fixed buffer holds must still return.
+	published := make(chan struct{})
+	go func() {
+		for i := range 1000 {
+			bp.Publish("test:slow", []byte(strconv.Itoa(i)))
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish waited for a slow subscriber")
+	}
+
+	close(release)
+	for want := range 1000 {
+		select {
+		case n := <-received:
+			if n != want {
+				t.Fatalf("received %d, want %d", n, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %d not delivered", want)
+		}
+	}
+}
@@ -4,12 +4,41 @@ import (
 	"encoding/json"
 	"sync"
 	"time"
+
+	"echo/protocol"
 )
 
+// cachedEvents maps data sync event types to the cache key and TTL their
+// latest payload is stored under.
+var cachedEvents = map[string]struct {
+	key string
+	ttl time.Duration
+}{
+	EventDeviceInfo:      {"device_info", deviceInfoTTL},
+	EventBatteryUpdate:   {"battery", batteryTTL},
+	EventStorageUpdate:   {"storage", cacheTTL},
+	EventDownloadsUpdate: {"downloads", downloadsTTL},
+}
+
+// CacheEntry is the latest value of a cache key. Version increases by one
+// on every change; history holds the JSON Patch that produced each of the
+// most recent versions so clients can catch up without a full snapshot.
 type CacheEntry struct {
 	Data      json.RawMessage
+	Version   uint64
 	UpdatedAt time.Time
 	TTL       time.Duration
+
+	history []cacheRevision // oldest first, at most cacheHistoryLimit
+}
+
+type cacheRevision struct {
+	version uint64
+	patch   []patchOp // turns version-1 into version
+}
+
+func (e *CacheEntry) expired() bool {
+	return time.Since(e.UpdatedAt) > e.TTL
 }
 
 type RoomCache struct {
@@ -23,29 +52,121 @@ func NewRoomCache() *RoomCache {
 	}
 }
 
-func (rc *RoomCache) Set(key string, data json.RawMessage, ttl time.Duration) {
+// Snapshot returns copies of the unexpired entries, without their history.
+func (rc *RoomCache) Snapshot() map[string]CacheEntry {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	entries := make(map[string]CacheEntry, len(rc.entries))
+	for key, entry := range rc.entries {
+		if entry.expired() {
+			continue
+		}
+		entries[key] = CacheEntry{
+			Data:      entry.Data,
+			Version:   entry.Version,
+			UpdatedAt: entry.UpdatedAt,
+			TTL:       entry.TTL,
+		}
+	}
+	return entries
+}
+
+// Set stores data as the next version of key and returns that version.
+func (rc *RoomCache) Set(key string, data json.RawMessage, ttl time.Duration) uint64 {
+	return rc.SetVersion(key, data, ttl, 0)
+}
+
+// SetVersion stores data under an explicit version, as assigned by the
+// instance the update originated on, so versions agree across instances.
+// A zero version means the next one. The history is dropped whenever a
+// version is skipped, since the patches in between are unknown here.
+func (rc *RoomCache) SetVersion(key string, data json.RawMessage, ttl time.Duration, version uint64) uint64 {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
-	rc.entries[key] = &CacheEntry{
-		Data:      data,
-		UpdatedAt: time.Now(),
-		TTL:       ttl,
+
+	entry, exists := rc.entries[key]
+	if !exists {
+		entry = &CacheEntry{}
+		rc.entries[key] = entry
+	}
+	if version == 0 {
+		version = entry.Version + 1
+	} else if version <= entry.Version {
+		// Already have this or a newer version.
+		return entry.Version
 	}
+
+	contiguous := version == entry.Version+1 && entry.Data != nil && !entry.expired()
+	var patch []patchOp
+	var err error
+	if contiguous {
+		patch, err = createJSONPatch(entry.Data, data)
+	}
+	if !contiguous || err != nil {
+		entry.history = nil
+	} else {
+		if len(entry.history) >= cacheHistoryLimit {
+			entry.history = entry.history[1:]
+		}
+		entry.history = append(entry.history, cacheRevision{version: version, patch: patch})
+	}
+
+	entry.Data = data
+	entry.Version = version
+	entry.UpdatedAt = time.Now()
+	entry.TTL = ttl
+	return version
 }
 
 func (rc *RoomCache) Get(key string) (json.RawMessage, bool) {
+	data, _, ok := rc.GetVersion(key)
+	return data, ok
+}
+
+// GetVersion returns the unexpired value of key and its version.
+func (rc *RoomCache) GetVersion(key string) (json.RawMessage, uint64, bool) {
 	rc.mu.RLock()
 	defer rc.mu.RUnlock()
 	entry, exists := rc.entries[key]
-	if !exists {
-		return nil, false
+	if !exists || entry.Data == nil || entry.expired() {
+		return nil, 0, false
+	}
+	return entry.Data, entry.Version, true
+}
+
+// CacheDelta brings a client from the version it has to the current one,
+// either as a JSON Patch or, once the history has been compacted past the
+// client's version, as a full snapshot.
+type CacheDelta = protocol.CacheDelta
+
+// Since returns what a client holding version since of key is missing.
+// ok is false when there is nothing to send: the key is unknown or expired,
+// or the client is already up to date.
+func (rc *RoomCache) Since(key string, since uint64) (CacheDelta, bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	entry, exists := rc.entries[key]
+	if !exists || entry.Data == nil || entry.expired() || since == entry.Version {
+		return CacheDelta{}, false
+	}
+
+	snapshot := CacheDelta{Version: entry.Version, Snapshot: entry.Data}
+	if since == 0 || since > entry.Version || len(entry.history) == 0 || entry.history[0].version > since+1 {
+		return snapshot, true
+	}
+
+	var ops []patchOp
+	for _, rev := range entry.history {
+		if rev.version > since {
+			ops = append(ops, rev.patch...)
+		}
 	}
-	
-	// Check if expired
-	if time.Since(entry.UpdatedAt) > entry.TTL {
-		delete(rc.entries, key)
-		return nil, false
+	delta := CacheDelta{Version: entry.Version, Patch: ops}
+	// Long histories can outgrow the value itself.
+	if b, err := json.Marshal(ops); err != nil || len(b) >= len(entry.Data) {
+		return snapshot, true
 	}
-	
-	return entry.Data, true
+	return delta, true
 }
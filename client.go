@@ -1,14 +1,18 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+
+	"echo/protocol"
 )
 
 const (
@@ -27,13 +31,39 @@ type ClientList map[*Client]bool
 type Client struct {
 	conn       *websocket.Conn
 	manager    *Manager
-	egress     chan Event
+	egress     *egressQueue
 	deviceID   string
 	deviceType string // "mac" or "watch"
+	connID     string // identifies this connection in logs and the admin API
 	room       *Room
-	closeOnce  sync.Once
-	mu         sync.RWMutex
-	done       chan struct{}
+	lastRoom   *Room           // most recent room joined, kept after leaving
+	protocol   int             // negotiated protocol version, 0 until known
+	features   map[string]bool // negotiated optional features
+	// codec encodes outgoing events. pendingCodec replaces it once the
+	// welcome announcing it has been written.
+	codec        Codec
+	pendingCodec Codec
+	log          *slog.Logger // carries connection_id, device_id and device_type
+	closeOnce    sync.Once
+	mu           sync.RWMutex
+	done         chan struct{}
+
+	// compress is set when permessage-deflate was negotiated; messages
+	// shorter than compressMinSize are still sent uncompressed.
+	compress        bool
+	compressMinSize int
+
+	// token is the JWT the connection was authorized with, replaced on
+	// refresh_token. tokenTimer warns before it expires and closes the
+	// connection once it has.
+	token       tokenInfo
+	tokenTimer  *time.Timer
+	tokenWarned bool
+
+	// sendMu orders sequence numbering with pushes to egress and guards
+	// session, which changes when the client resumes an earlier session.
+	sendMu  sync.Mutex
+	session *Session
 }
 
 func NewClient(conn *websocket.Conn, m *Manager) *Client {
@@ -46,10 +76,15 @@ func NewClient(conn *websocket.Conn, m *Manager) *Client {
 	})
 
 	return &Client{
-		conn:    conn,
-		manager: m,
-		egress:  make(chan Event, 64), // Larger buffer for better performance
-		done:    make(chan struct{}),
+		conn:     conn,
+		manager:  m,
+		egress:   newEgressQueue(egressCapacity),
+		features: make(map[string]bool),
+		codec:    codecs[EncodingJSON],
+		log:      slog.Default(),
+		done:     make(chan struct{}),
+
+		compressMinSize: compressionMinSize,
 	}
 }
 
@@ -57,45 +92,91 @@ func (c *Client) readMessages() {
 	defer func() {
 		// Recover from any panics
 		if r := recover(); r != nil {
-			log.Printf("PANIC recovered in readMessages for device %s: %v", c.deviceID, r)
+			c.logger().Error("Panic recovered in readMessages", "panic", r)
 		}
 		c.manager.removeClient(c)
+		c.stopToken()
 		c.closeConn()
+		c.currentSession().release(c)
+		connectedClients.WithLabelValues(c.deviceType).Dec()
 	}()
 
 	for {
-		_, payload, err := c.conn.ReadMessage()
+		frameType, payload, err := c.conn.ReadMessage()
 		if err != nil {
 			// Check for close errors
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				// Normal closure - client closed gracefully
-				log.Printf("Device %s (%s) disconnected normally", c.deviceID, c.deviceType)
+				c.logger().Info("Device disconnected normally")
 			} else if websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
 				// Abnormal closure (1006) - connection closed without proper handshake
 				// This is common when client crashes, network issues, or client closes abruptly
 				// Don't log as error, just as info
-				log.Printf("Device %s (%s) disconnected abnormally (connection closed without handshake)", c.deviceID, c.deviceType)
+				c.logger().Info("Device disconnected abnormally (connection closed without handshake)")
 			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				// Other unexpected close errors
-				log.Printf("WebSocket error for device %s (%s): %v", c.deviceID, c.deviceType, err)
+				c.logger().Warn("WebSocket error", "error", err)
 			} else {
 				// Other read errors (timeout, etc.)
-				log.Printf("Device %s (%s) disconnected: %v", c.deviceID, c.deviceType, err)
+				c.logger().Info("Device disconnected", "error", err)
 			}
 			break
 		}
 
-		var event Event
-		if err := json.Unmarshal(payload, &event); err != nil {
-			log.Printf("Error unmarshaling event from %s: %v", c.deviceID, err)
-			c.sendError("", "invalid_json", "Failed to parse event JSON")
+		// Text frames are always JSON; binary frames use the negotiated codec.
+		codec := codecs[EncodingJSON]
+		if frameType == websocket.BinaryMessage {
+			codec = c.binaryCodec()
+			if codec == nil {
+				c.sendError("", ErrCodeInvalidMessage, "Binary frames require a negotiated binary encoding")
+				continue
+			}
+		}
+		event, err := codec.Decode(payload)
+		if err != nil {
+			c.logger().Warn("Error decoding event", "encoding", codec.Name(), "error", err)
+			if codec.Name() == EncodingJSON {
+				c.sendError("", ErrCodeInvalidJSON, "Failed to parse event JSON")
+			} else {
+				c.sendError("", ErrCodeInvalidMessage, "Failed to decode "+codec.Name()+" event")
+			}
 			continue
 		}
 
 		event.Timestamp = time.Now()
-		if err := c.manager.routeEvent(event, c); err != nil {
-			log.Printf("Error routing event %s from %s: %v", event.Type, c.deviceID, err)
-			c.sendError(event.RequestID, "routing_error", err.Error())
+		c.logger().Debug("Event received", eventAttrs(event)...)
+		eventType := c.manager.eventTypeLabel(event.Type)
+		eventsTotal.WithLabelValues(eventType, directionIn).Inc()
+
+		if ok, retryAfter, disconnect := c.manager.limiter.allowEvent(c.deviceID, eventType); !ok {
+			c.rejectRateLimited(event, retryAfter, disconnect)
+			if disconnect {
+				break
+			}
+			continue
+		}
+
+		var span trace.Span
+		if traced(event) {
+			var ctx context.Context
+			ctx, span = startEventSpan(context.Background(), "receive", event, c, trace.SpanKindServer)
+			event = withTrace(ctx, event)
+		}
+		err = c.manager.routeEvent(event, c)
+		if span != nil {
+			endSpan(span, err)
+		}
+		if err != nil {
+			c.logger().Warn("Error routing event", append(eventAttrs(event), "error", err)...)
+			code := ErrCodeRouting
+			var fields []FieldError
+			var routeErr *RouteError
+			if errors.As(err, &routeErr) {
+				code = routeErr.Code
+				fields = routeErr.Fields
+			}
+			routingErrors.WithLabelValues(code).Inc()
+			c.sendErrorFields(event.RequestID, code, err.Error(), fields)
 		}
 	}
 }
@@ -104,7 +185,7 @@ func (c *Client) writeMessages() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC recovered in writeMessages for device %s: %v", c.deviceID, r)
+			c.logger().Error("Panic recovered in writeMessages", "panic", r)
 		}
 		ticker.Stop()
 		c.closeConn()
@@ -112,43 +193,11 @@ func (c *Client) writeMessages() {
 
 	for {
 		select {
-		case message, ok := <-c.egress:
+		case <-c.egress.ready:
 			if c.conn == nil {
 				return
 			}
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// Channel closed, send close message
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			if err := c.conn.WriteJSON(message); err != nil {
-				// Suppress expected errors when client disconnects
-				if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) ||
-					websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					return
-				}
-				// Check for network errors
-				if netErr, ok := err.(*net.OpError); ok {
-					if netErr.Err != nil {
-						errStr := netErr.Err.Error()
-						if strings.Contains(errStr, "broken pipe") ||
-							strings.Contains(errStr, "connection reset") ||
-							strings.Contains(errStr, "use of closed network connection") {
-							return
-						}
-					}
-				}
-				// Check error string
-				errStr := err.Error()
-				if strings.Contains(errStr, "broken pipe") ||
-					strings.Contains(errStr, "connection reset") ||
-					strings.Contains(errStr, "use of closed network connection") {
-					return
-				}
-				// Log unexpected errors
-				log.Printf("Error writing message to %s (%s): %v", c.deviceID, c.deviceType, err)
+			if !c.writeQueued() {
 				return
 			}
 
@@ -190,7 +239,7 @@ func (c *Client) writeMessages() {
 					return
 				}
 				// Log unexpected errors
-				log.Printf("Error sending ping to %s (%s): %v", c.deviceID, c.deviceType, err)
+				c.logger().Warn("Error sending ping", "error", err)
 				return
 			}
 
@@ -200,33 +249,215 @@ func (c *Client) writeMessages() {
 	}
 }
 
+// writeQueued writes events until the egress queue is empty. It reports
+// false once the connection can no longer be written to.
+func (c *Client) writeQueued() bool {
+	for {
+		select {
+		case <-c.done:
+			return false
+		default:
+		}
+
+		message, ok := c.egress.pop()
+		if !ok {
+			return true
+		}
+		if message.Type == EventEventsDropped && !c.hasFeature(FeatureDropReports) {
+			// The client cannot be told, so the gap is logged for it instead.
+			var report protocol.EventsDropped
+			if err := message.Decode(&report); err == nil {
+				c.logger().Warn("Events dropped for client without drop reports", "dropped", report.Dropped, "total", report.Total)
+			}
+			continue
+		}
+
+		codec := c.currentCodec()
+		data, err := codec.Encode(message)
+		if err != nil {
+			c.logger().Error("Error encoding event", append(eventAttrs(message), "encoding", codec.Name(), "error", err)...)
+			continue
+		}
+		if message.Type == EventWelcome {
+			// Everything after the welcome uses the encoding it announced.
+			c.applyPendingCodec()
+		}
+
+		if c.compress {
+			compressed := len(data) >= c.compressionThreshold()
+			c.conn.EnableWriteCompression(compressed)
+			recordCompression(message.Type, data, compressed)
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.conn.WriteMessage(codec.FrameType(), data); err != nil {
+			// Suppress expected errors when client disconnects
+			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) ||
+				websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				return false
+			}
+			// Check for network errors
+			if netErr, ok := err.(*net.OpError); ok {
+				if netErr.Err != nil {
+					errStr := netErr.Err.Error()
+					if strings.Contains(errStr, "broken pipe") ||
+						strings.Contains(errStr, "connection reset") ||
+						strings.Contains(errStr, "use of closed network connection") {
+						return false
+					}
+				}
+			}
+			// Check error string
+			errStr := err.Error()
+			if strings.Contains(errStr, "broken pipe") ||
+				strings.Contains(errStr, "connection reset") ||
+				strings.Contains(errStr, "use of closed network connection") {
+				return false
+			}
+			// Log unexpected errors
+			c.logger().Warn("Error writing message", append(eventAttrs(message), "error", err)...)
+			return false
+		}
+		c.logger().Debug("Event sent", eventAttrs(message)...)
+		eventsTotal.WithLabelValues(message.Type, directionOut).Inc()
+	}
+}
+
 func (c *Client) send(ev Event) {
-	// Check if client is already closed
-	select {
-	case <-c.done:
+	if c.sendSequenced(ev) {
 		return
-	default:
 	}
 
+	// The connection is closed or its session was resumed elsewhere. Hand
+	// the event to the room so it reaches the device's new connection or
+	// waits in its outbox until the device rejoins.
+	c.mu.RLock()
+	room := c.lastRoom
+	c.mu.RUnlock()
+	if room != nil && room.localClient(c.deviceID) != c {
+		room.deliverTo(c.deviceID, ev)
+	}
+}
+
+// sendSequenced numbers ev in the client's session and queues it. It
+// reports false if the client can no longer send on this connection.
+func (c *Client) sendSequenced(ev Event) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
 	select {
-	case c.egress <- ev:
+	case <-c.done:
+		return false
 	default:
-		log.Printf("Egress channel full for %s (%s), dropping message: %s", c.deviceID, c.deviceType, ev.Type)
 	}
+
+	ev, ok := c.session.next(c, ev)
+	if !ok {
+		return false
+	}
+	c.enqueue(ev)
+	return true
+}
+
+// enqueue hands ev to the egress queue and applies the outcome of its
+// backpressure policy. Dropped events stay in the session buffer, so a
+// resume can still recover them.
+func (c *Client) enqueue(ev Event) {
+	switch c.egress.push(ev) {
+	case pushDropped:
+		c.logger().Warn("Egress queue full, dropped message", eventAttrs(ev)...)
+	case pushDisconnect:
+		c.logger().Warn("Egress queue full, disconnecting slow consumer", eventAttrs(ev)...)
+		// Closing writes a close frame; keep that off the send path.
+		go c.closeConn()
+	}
+}
+
+func (c *Client) currentSession() *Session {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.session
+}
+
+// adoptSession moves s onto this connection and queues the events after
+// lastSeen with their original sequence numbers. It returns the connection
+// that owned s and whether the replay is complete.
+func (c *Client) adoptSession(s *Session, lastSeen uint64) (old *Client, missed []Event, complete bool) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	old = s.takeOver(c)
+	c.session = s
+	missed, complete = s.since(lastSeen)
+	for _, ev := range missed {
+		c.enqueue(ev)
+	}
+	return old, missed, complete
 }
 
 func (c *Client) sendError(requestID, code, message string) {
-	payload := map[string]string{"code": code, "message": message}
-	b, _ := json.Marshal(payload)
+	c.sendErrorFields(requestID, code, message, nil)
+}
+
+// sendErrorFields sends an error listing the payload fields that caused it.
+func (c *Client) sendErrorFields(requestID, code, message string, fields []FieldError) {
 	c.send(Event{
 		Type:      EventError,
 		RequestID: requestID,
 		Timestamp: time.Now(),
-		Payload:   b,
+		Payload:   protocol.EncodePayload(protocol.ErrorPayload{Code: code, Message: message, Errors: fields}),
 	})
 }
 
+func (c *Client) currentCodec() Codec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.codec
+}
+
+// binaryCodec returns the codec for binary frames from the client, which
+// may switch encodings as soon as it has sent hello.
+func (c *Client) binaryCodec() Codec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, codec := range []Codec{c.pendingCodec, c.codec} {
+		if codec != nil && codec.FrameType() == websocket.BinaryMessage {
+			return codec
+		}
+	}
+	return nil
+}
+
+func (c *Client) applyPendingCodec() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pendingCodec != nil {
+		c.codec = c.pendingCodec
+		c.pendingCodec = nil
+	}
+}
+
+// compressionThreshold returns the smallest message size sent compressed.
+func (c *Client) compressionThreshold() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.compressMinSize
+}
+
+// hasFeature reports whether the client negotiated an optional feature.
+func (c *Client) hasFeature(feature string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.features[feature]
+}
+
 func (c *Client) closeConn() {
+	c.closeWithReason(websocket.CloseNormalClosure, "")
+}
+
+// closeWithReason closes the connection, telling the client why in the
+// close frame.
+func (c *Client) closeWithReason(code int, reason string) {
 	c.closeOnce.Do(func() {
 		// Close done first so goroutines can stop promptly.
 		select {
@@ -236,16 +467,17 @@ func (c *Client) closeConn() {
 			close(c.done)
 		}
 
-		// Safely close connection.
+		// Safely close connection. WriteControl may run concurrently with
+		// the write loop, unlike WriteMessage.
 		if c.conn != nil {
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			_ = c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, reason),
+				time.Now().Add(writeWait))
 			_ = c.conn.Close()
 		}
 
-		// Close egress after the connection is closed; write loop will exit.
-		// `closeOnce` guarantees this runs only once.
-		close(c.egress)
+		// Discard anything still queued; the write loop exits on done.
+		c.egress.close()
 	})
 }
 
@@ -262,7 +494,7 @@ func (c *Client) startStatusPinger() {
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("PANIC recovered in startStatusPinger for device %s: %v", c.deviceID, r)
+				c.logger().Error("Panic recovered in startStatusPinger", "panic", r)
 			}
 			ticker.Stop()
 		}()
@@ -280,23 +512,14 @@ func (c *Client) startStatusPinger() {
 
 				if inRoom && room != nil {
 					roomID = room.id
-					if peer := room.getPeer(DeviceTypeWatch); peer != nil {
-						watchConnected = true
-					}
-				}
-
-				payload := map[string]any{"in_room": inRoom, "watch_connected": watchConnected}
-				b, err := json.Marshal(payload)
-				if err != nil {
-					log.Printf("Error marshaling status update for %s: %v", c.deviceID, err)
-					continue
+					watchConnected = room.hasPeer(DeviceTypeWatch)
 				}
 
 				c.send(Event{
 					Type:      EventStatusUpdate,
 					RoomID:    roomID,
 					Timestamp: time.Now(),
-					Payload:   b,
+					Payload:   protocol.EncodePayload(protocol.StatusUpdate{InRoom: inRoom, WatchConnected: watchConnected}),
 				})
 
 			case <-c.done:
@@ -0,0 +1,512 @@
+// Package client connects Go programs, such as integration tools and bots,
+// to the echo server. It correlates requests with their replies, decodes
+// events for typed subscriptions and reconnects with backoff, rejoining
+// the room it was in.
+//
+//	c, err := client.Connect(ctx, "wss://echo.example.com/ws", token, nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	client.Subscribe(c, protocol.EventStatusUpdate, func(_ protocol.Event, s protocol.StatusUpdate) {
+//		log.Println("watch connected:", s.WatchConnected)
+//	})
+//	roomID, err := c.CreateRoom(ctx)
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"echo/protocol"
+)
+
+const (
+	defaultRequestTimeout = 30 * time.Second
+	defaultMinBackoff     = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	writeTimeout          = 10 * time.Second
+)
+
+var (
+	// ErrClosed is returned once Close has been called or the client gave
+	// up reconnecting.
+	ErrClosed = errors.New("client: closed")
+	// ErrDisconnected is returned by calls whose reply was lost to a
+	// dropped connection. The client reconnects on its own; the call may
+	// be retried.
+	ErrDisconnected = errors.New("client: disconnected before the reply arrived")
+	// ErrUnauthorized is returned when the server rejects the token. The
+	// client does not reconnect with a token the server refused.
+	ErrUnauthorized = errors.New("client: token rejected")
+)
+
+// Options tune a Client. Zero values select the defaults.
+type Options struct {
+	// Dialer opens the WebSocket; websocket.DefaultDialer by default.
+	Dialer *websocket.Dialer
+	// RequestTimeout bounds calls whose context has no deadline; 30s by
+	// default.
+	RequestTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts,
+	// which doubles after every failure; 500ms and 30s by default.
+	MinBackoff, MaxBackoff time.Duration
+	// OnReconnect is called once the client has reconnected and tried to
+	// rejoin its room.
+	OnReconnect func()
+	// Logger receives reconnects and undecodable events; slog.Default() by
+	// default.
+	Logger *slog.Logger
+}
+
+// Client is a connection to the echo server for one device. Its methods
+// are safe for concurrent use.
+type Client struct {
+	url    string
+	token  string
+	opts   Options
+	ctx    context.Context // done once the client is closed
+	cancel context.CancelCauseFunc
+
+	writeMu sync.Mutex // gorilla/websocket allows one writer at a time
+
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	roomID   string // room to rejoin after a reconnect
+	role     string
+	pending  map[string]chan protocol.Event // by request_id
+	subs     map[string]map[uint64]func(protocol.Event)
+	idPrefix string
+	nextID   uint64 // of requests
+	nextSub  uint64 // of subscriptions
+}
+
+// Connect opens a connection to the server at url, such as
+// "wss://echo.example.com/ws", authenticated with token, and negotiates
+// the protocol. opts may be nil.
+func Connect(ctx context.Context, url, token string, opts *Options) (*Client, error) {
+	c := &Client{
+		url:     url,
+		token:   token,
+		pending: make(map[string]chan protocol.Event),
+		subs:    make(map[string]map[uint64]func(protocol.Event)),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Dialer == nil {
+		c.opts.Dialer = websocket.DefaultDialer
+	}
+	if c.opts.RequestTimeout <= 0 {
+		c.opts.RequestTimeout = defaultRequestTimeout
+	}
+	if c.opts.MinBackoff <= 0 {
+		c.opts.MinBackoff = defaultMinBackoff
+	}
+	if c.opts.MaxBackoff < c.opts.MinBackoff {
+		c.opts.MaxBackoff = max(defaultMaxBackoff, c.opts.MinBackoff)
+	}
+	if c.opts.Logger == nil {
+		c.opts.Logger = slog.Default()
+	}
+
+	// Request IDs are relayed to the other device, whose own requests must
+	// not be mistaken for replies to ours.
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("client: generate request id prefix: %w", err)
+	}
+	c.idPrefix = hex.EncodeToString(b)
+
+	c.ctx, c.cancel = context.WithCancelCause(context.Background())
+	conn, err := c.dial(ctx)
+	if err != nil {
+		c.cancel(err)
+		return nil, err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	go c.run(conn)
+	return c, nil
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Client) Close() error {
+	c.stop(ErrClosed)
+	return nil
+}
+
+// Done is closed once the client is closed, by Close or because it could
+// not reconnect; Err then tells why.
+func (c *Client) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Err returns ErrClosed after Close, ErrUnauthorized if the server refused
+// the token on reconnect, and nil while the client is running.
+func (c *Client) Err() error {
+	return context.Cause(c.ctx)
+}
+
+// RoomID returns the room the client is in, or "" before it joined one.
+func (c *Client) RoomID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.roomID
+}
+
+func (c *Client) stop(cause error) {
+	c.cancel(cause)
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.writeMu.Lock()
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+		c.writeMu.Unlock()
+		conn.Close()
+	}
+}
+
+// dial opens a connection and exchanges hello and welcome on it before
+// the read loop takes it over. Events that arrive first are delivered to
+// subscribers.
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	header := http.Header{"Authorization": {"Bearer " + c.token}}
+	conn, resp, err := c.opts.Dialer.DialContext(ctx, c.url, header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, fmt.Errorf("%w: HTTP %d", ErrUnauthorized, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("client: dial %s: %w", c.url, err)
+	}
+
+	hello, err := protocol.NewEvent(protocol.EventHello, protocol.Hello{
+		ProtocolVersion: protocol.Version,
+		Encodings:       []string{"json"},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hello.RequestID = c.newRequestID()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.opts.RequestTimeout)
+	}
+	if err := c.write(conn, hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(deadline)
+	for {
+		ev, err := readEvent(conn)
+		if errors.Is(err, errUndecodable) {
+			c.opts.Logger.Warn("Ignoring event from echo server", "error", err)
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("client: negotiate protocol: %w", err)
+		}
+		if ev.RequestID != hello.RequestID {
+			c.deliver(ev)
+			continue
+		}
+		if ev.Type == protocol.EventError {
+			conn.Close()
+			return nil, replyError(ev)
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// errUndecodable is returned by readEvent for a frame that is not an
+// event; the connection remains usable.
+var errUndecodable = errors.New("undecodable event")
+
+func readEvent(conn *websocket.Conn) (protocol.Event, error) {
+	var ev protocol.Event
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return ev, err
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return ev, fmt.Errorf("%w: %v", errUndecodable, err)
+	}
+	return ev, nil
+}
+
+func (c *Client) write(conn *websocket.Conn, ev protocol.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("client: encode %s: %w", ev.Type, err)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("client: send %s: %w", ev.Type, err)
+	}
+	return nil
+}
+
+func (c *Client) newRequestID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return c.idPrefix + "-" + strconv.FormatUint(c.nextID, 10)
+}
+
+// run reads events until the client is closed, reconnecting whenever the
+// connection drops.
+func (c *Client) run(conn *websocket.Conn) {
+	for {
+		for {
+			ev, err := readEvent(conn)
+			if errors.Is(err, errUndecodable) {
+				c.opts.Logger.Warn("Ignoring event from echo server", "error", err)
+				continue
+			}
+			if err != nil {
+				if c.ctx.Err() == nil {
+					c.opts.Logger.Warn("Disconnected from echo server", "error", err)
+				}
+				break
+			}
+			c.deliver(ev)
+		}
+		conn.Close()
+		c.failPending()
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+		go c.rejoin(conn)
+	}
+}
+
+// reconnect dials until it succeeds, the client is closed or the server
+// refuses the token.
+func (c *Client) reconnect() *websocket.Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		// Waiting between half and all of backoff spreads out devices
+		// reconnecting after a server restart.
+		delay := backoff/2 + mathrand.N(backoff/2+1)
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+
+		conn, err := c.dial(c.ctx)
+		if err == nil {
+			c.mu.Lock()
+			c.conn = conn
+			c.mu.Unlock()
+			if c.ctx.Err() != nil {
+				// Closed while dialing.
+				conn.Close()
+				return nil
+			}
+			return conn
+		}
+		if errors.Is(err, ErrUnauthorized) {
+			c.opts.Logger.Error("Echo server refused the token, not reconnecting", "error", err)
+			c.stop(err)
+			return nil
+		}
+		c.opts.Logger.Warn("Reconnect failed", "error", err, "retry_in", backoff)
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+// rejoin puts the client back in its room after reconnecting on conn. A
+// watch may get there before the Mac has reactivated the room, so failures
+// are retried with backoff until the room is joined, the device turns out
+// not to be allowed in, or conn is replaced.
+func (c *Client) rejoin(conn *websocket.Conn) {
+	c.mu.Lock()
+	roomID, role := c.roomID, c.role
+	c.mu.Unlock()
+
+	backoff := c.opts.MinBackoff
+	for roomID != "" {
+		var err error
+		if role == protocol.RoleHost {
+			_, err = c.createRoom(c.ctx, roomID)
+		} else {
+			_, err = c.JoinRoom(c.ctx, roomID)
+		}
+		if err == nil {
+			break
+		}
+		var refused protocol.ErrorPayload
+		if errors.As(err, &refused) && (refused.Code == protocol.ErrCodeNotAuthorized || refused.Code == protocol.ErrCodeInvalidDeviceType) {
+			c.opts.Logger.Warn("Not allowed back in room", "room_id", roomID, "error", err)
+			c.mu.Lock()
+			c.roomID, c.role = "", ""
+			c.mu.Unlock()
+			break
+		}
+		c.opts.Logger.Warn("Failed to rejoin room", "room_id", roomID, "error", err, "retry_in", backoff)
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		c.mu.Lock()
+		replaced := c.conn != conn
+		c.mu.Unlock()
+		if replaced {
+			return // the next connection rejoins
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+
+	c.opts.Logger.Info("Reconnected to echo server", "room_id", roomID)
+	if c.opts.OnReconnect != nil {
+		c.opts.OnReconnect()
+	}
+}
+
+// deliver hands ev to the call waiting for it, if any, and to the
+// subscribers of its type.
+func (c *Client) deliver(ev protocol.Event) {
+	if ev.Type == protocol.EventRoomJoined {
+		var joined protocol.RoomJoined
+		if err := ev.Decode(&joined); err == nil {
+			c.mu.Lock()
+			c.roomID, c.role = ev.RoomID, joined.Role
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.Lock()
+	if ch, ok := c.pending[ev.RequestID]; ok && ev.RequestID != "" {
+		delete(c.pending, ev.RequestID)
+		ch <- ev
+	}
+	subs := make([]func(protocol.Event), 0, len(c.subs[ev.Type]))
+	for _, fn := range c.subs[ev.Type] {
+		subs = append(subs, fn)
+	}
+	c.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+}
+
+// failPending fails the calls waiting on a connection that dropped.
+func (c *Client) failPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// Send sends an event of type eventType without waiting for a reply, such
+// as a battery_update from a Mac.
+func (c *Client) Send(eventType string, payload any) error {
+	ev, err := protocol.NewEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+	return c.send(ev)
+}
+
+// Reply answers req, a request or action_request relayed from the other
+// device, with an event of type eventType carrying its request_id.
+func (c *Client) Reply(req protocol.Event, eventType string, payload any) error {
+	ev, err := protocol.NewEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+	ev.RequestID = req.RequestID
+	return c.send(ev)
+}
+
+func (c *Client) send(ev protocol.Event) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	return c.write(conn, ev)
+}
+
+// call sends an event and waits for the event with its request_id, which
+// must be of type reply. An error event is returned as a
+// protocol.ErrorPayload.
+func (c *Client) call(ctx context.Context, eventType string, payload any, reply string) (protocol.Event, error) {
+	ev, err := protocol.NewEvent(eventType, payload)
+	if err != nil {
+		return protocol.Event{}, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.RequestTimeout)
+		defer cancel()
+	}
+
+	ev.RequestID = c.newRequestID()
+	ch := make(chan protocol.Event, 1)
+	c.mu.Lock()
+	c.pending[ev.RequestID] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, ev.RequestID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.send(ev); err != nil {
+		return protocol.Event{}, err
+	}
+	select {
+	case resp, ok := <-ch:
+		switch {
+		case !ok:
+			return protocol.Event{}, ErrDisconnected
+		case resp.Type == protocol.EventError:
+			return resp, replyError(resp)
+		case resp.Type != reply:
+			return resp, fmt.Errorf("client: %s answered with %s, want %s", eventType, resp.Type, reply)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return protocol.Event{}, fmt.Errorf("client: %s: %w", eventType, ctx.Err())
+	case <-c.ctx.Done():
+		return protocol.Event{}, ErrClosed
+	}
+}
+
+// replyError returns the protocol.ErrorPayload of an error event.
+func replyError(ev protocol.Event) error {
+	var payload protocol.ErrorPayload
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("client: undecodable error event: %w", err)
+	}
+	return payload
+}
@@ -0,0 +1,417 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"echo/protocol"
+)
+
+const testToken = "secret"
+
+// fakeServer speaks enough of the echo protocol to exercise the client: it
+// answers hello, create_room, join_room and requests for get_battery, never
+// answers other requests, and echoes battery_update back to its sender.
+type fakeServer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	conns    []*websocket.Conn
+	received []protocol.Event
+	rooms    map[string]bool
+	nextRoom int
+	revoked  bool // the token is refused from now on
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	fs := &fakeServer{t: t, rooms: make(map[string]bool)}
+	fs.srv = httptest.NewServer(http.HandlerFunc(fs.serve))
+	t.Cleanup(fs.srv.Close)
+	return fs
+}
+
+func (fs *fakeServer) url() string {
+	return "ws" + strings.TrimPrefix(fs.srv.URL, "http")
+}
+
+func (fs *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	revoked := fs.revoked
+	fs.mu.Unlock()
+	if revoked || r.Header.Get("Authorization") != "Bearer "+testToken {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	fs.mu.Lock()
+	fs.conns = append(fs.conns, conn)
+	fs.mu.Unlock()
+	defer conn.Close()
+
+	for {
+		var ev protocol.Event
+		if err := conn.ReadJSON(&ev); err != nil {
+			return
+		}
+		fs.mu.Lock()
+		fs.received = append(fs.received, ev)
+		fs.mu.Unlock()
+
+		if reply, ok := fs.answer(ev); ok {
+			reply.RequestID = ev.RequestID
+			if err := conn.WriteJSON(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (fs *fakeServer) answer(ev protocol.Event) (protocol.Event, bool) {
+	switch ev.Type {
+	case protocol.EventHello:
+		return fs.event(protocol.EventWelcome, "", protocol.Welcome{ProtocolVersion: 2, Encoding: "json"}), true
+
+	case protocol.EventCreateRoom:
+		var req protocol.CreateRoom
+		_ = ev.Decode(&req)
+		fs.mu.Lock()
+		if req.RoomID == "" {
+			fs.nextRoom++
+			req.RoomID = "room-" + strconv.Itoa(fs.nextRoom)
+		}
+		fs.rooms[req.RoomID] = true
+		fs.mu.Unlock()
+		return fs.event(protocol.EventRoomJoined, req.RoomID, protocol.RoomJoined{Status: "created", Role: protocol.RoleHost}), true
+
+	case protocol.EventJoinRoom:
+		var req protocol.JoinRoom
+		_ = ev.Decode(&req)
+		fs.mu.Lock()
+		exists := fs.rooms[req.RoomID]
+		fs.mu.Unlock()
+		if !exists {
+			return fs.event(protocol.EventError, "", protocol.NewError(protocol.ErrCodeNotAuthorized, "not paired")), true
+		}
+		return fs.event(protocol.EventRoomJoined, req.RoomID, protocol.RoomJoined{Status: "joined", Role: protocol.RoleClient}), true
+
+	case protocol.EventRequest:
+		var req protocol.Request
+		_ = ev.Decode(&req)
+		if req.Action == "get_battery" {
+			return fs.event(protocol.EventResponse, "", protocol.BatteryStatus{Percent: 80}), true
+		}
+
+	case protocol.EventBatteryUpdate:
+		return ev, true
+	}
+	return protocol.Event{}, false
+}
+
+func (fs *fakeServer) event(eventType, roomID string, payload any) protocol.Event {
+	ev, err := protocol.NewEvent(eventType, payload)
+	if err != nil {
+		fs.t.Errorf("fake server: %v", err)
+	}
+	ev.RoomID = roomID
+	return ev
+}
+
+// drop closes every connection without a close frame, as a network failure
+// would.
+func (fs *fakeServer) drop() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, conn := range fs.conns {
+		conn.NetConn().Close()
+	}
+	fs.conns = nil
+}
+
+// count returns how many events of type eventType the server received.
+func (fs *fakeServer) count(eventType string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := 0
+	for _, ev := range fs.received {
+		if ev.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+func (fs *fakeServer) last(eventType string) protocol.Event {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for i := len(fs.received) - 1; i >= 0; i-- {
+		if fs.received[i].Type == eventType {
+			return fs.received[i]
+		}
+	}
+	return protocol.Event{}
+}
+
+func testOptions() *Options {
+	return &Options{
+		RequestTimeout: time.Second,
+		MinBackoff:     10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func connect(t *testing.T, fs *fakeServer, opts *Options) *Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Connect(ctx, fs.url(), testToken, opts)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConnect(t *testing.T) {
+	fs := newFakeServer(t)
+	c := connect(t, fs, testOptions())
+
+	hello := fs.last(protocol.EventHello)
+	var payload protocol.Hello
+	if err := hello.Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ProtocolVersion != protocol.Version || hello.RequestID == "" {
+		t.Errorf("hello = %+v with request_id %q", payload, hello.RequestID)
+	}
+	if c.Err() != nil || c.RoomID() != "" {
+		t.Errorf("new client has Err %v and room %q", c.Err(), c.RoomID())
+	}
+
+	c.Close()
+	<-c.Done()
+	if !errors.Is(c.Err(), ErrClosed) {
+		t.Errorf("Err after Close = %v", c.Err())
+	}
+	if err := c.Send(protocol.EventBatteryUpdate, protocol.BatteryStatus{Percent: 1}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Send after Close = %v", err)
+	}
+}
+
+func TestConnectUnauthorized(t *testing.T) {
+	fs := newFakeServer(t)
+	_, err := Connect(context.Background(), fs.url(), "wrong", testOptions())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Connect with a bad token = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestRooms(t *testing.T) {
+	fs := newFakeServer(t)
+	ctx := context.Background()
+
+	mac := connect(t, fs, testOptions())
+	roomID, err := mac.CreateRoom(ctx)
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	if roomID == "" || mac.RoomID() != roomID {
+		t.Errorf("CreateRoom = %q, RoomID = %q", roomID, mac.RoomID())
+	}
+
+	watch := connect(t, fs, testOptions())
+	joined, err := watch.JoinRoom(ctx, roomID)
+	if err != nil {
+		t.Fatalf("JoinRoom: %v", err)
+	}
+	if joined.Role != protocol.RoleClient || watch.RoomID() != roomID {
+		t.Errorf("JoinRoom = %+v, RoomID = %q", joined, watch.RoomID())
+	}
+
+	_, err = watch.JoinRoom(ctx, "unknown")
+	var refused protocol.ErrorPayload
+	if !errors.As(err, &refused) || refused.Code != protocol.ErrCodeNotAuthorized {
+		t.Errorf("JoinRoom of an unknown room = %v, want %s", err, protocol.ErrCodeNotAuthorized)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	fs := newFakeServer(t)
+	c := connect(t, fs, testOptions())
+
+	payload, err := c.Request(context.Background(), "get_battery")
+	if err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	var battery protocol.BatteryStatus
+	if err := (protocol.Event{Payload: payload}).Decode(&battery); err != nil || battery.Percent != 80 {
+		t.Errorf("Request = %s (%v)", payload, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Request(ctx, "unanswered"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unanswered Request = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request took %v to time out", elapsed)
+	}
+
+	// Without a deadline on the context, Options.RequestTimeout applies.
+	opts := testOptions()
+	opts.RequestTimeout = 50 * time.Millisecond
+	c = connect(t, fs, opts)
+	if _, err := c.Request(context.Background(), "unanswered"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unanswered Request = %v, want a deadline error", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	fs := newFakeServer(t)
+	c := connect(t, fs, testOptions())
+
+	got := make(chan protocol.BatteryStatus, 1)
+	unsubscribe := Subscribe(c, protocol.EventBatteryUpdate, func(_ protocol.Event, b protocol.BatteryStatus) {
+		got <- b
+	})
+	if err := c.Send(protocol.EventBatteryUpdate, protocol.BatteryStatus{Percent: 42, IsCharging: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-got:
+		if b.Percent != 42 || !b.IsCharging {
+			t.Errorf("subscriber got %+v", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber was not called")
+	}
+
+	unsubscribe()
+	if err := c.Send(protocol.EventBatteryUpdate, protocol.BatteryStatus{Percent: 43}); err != nil {
+		t.Fatal(err)
+	}
+	// A request answered after the echo shows the echo was delivered.
+	if _, err := c.Request(context.Background(), "get_battery"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-got:
+		t.Errorf("unsubscribed callback got %+v", b)
+	default:
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	fs := newFakeServer(t)
+	ctx := context.Background()
+
+	reconnected := make(chan struct{}, 4)
+	opts := testOptions()
+	opts.OnReconnect = func() { reconnected <- struct{}{} }
+	mac := connect(t, fs, opts)
+	roomID, err := mac.CreateRoom(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watchOpts := testOptions()
+	watchReconnected := make(chan struct{}, 4)
+	watchOpts.OnReconnect = func() { watchReconnected <- struct{}{} }
+	watch := connect(t, fs, watchOpts)
+	if _, err := watch.JoinRoom(ctx, roomID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A call waiting when the connection drops fails instead of hanging.
+	pending := make(chan error, 1)
+	go func() {
+		_, err := watch.Request(ctx, "unanswered")
+		pending <- err
+	}()
+	waitFor(t, func() bool { return fs.count(protocol.EventRequest) == 1 })
+
+	hellos, creates, joins := fs.count(protocol.EventHello), fs.count(protocol.EventCreateRoom), fs.count(protocol.EventJoinRoom)
+	fs.drop()
+
+	select {
+	case err := <-pending:
+		if !errors.Is(err, ErrDisconnected) {
+			t.Errorf("pending Request = %v, want ErrDisconnected", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending Request did not fail")
+	}
+	for _, ch := range []chan struct{}{reconnected, watchReconnected} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not reconnect")
+		}
+	}
+
+	if got := fs.count(protocol.EventHello); got != hellos+2 {
+		t.Errorf("%d hellos after reconnecting, want %d", got, hellos+2)
+	}
+	if got := fs.count(protocol.EventCreateRoom); got != creates+1 {
+		t.Errorf("%d create_room after reconnecting, want %d", got, creates+1)
+	}
+	var rejoin protocol.CreateRoom
+	if err := fs.last(protocol.EventCreateRoom).Decode(&rejoin); err != nil || rejoin.RoomID != roomID {
+		t.Errorf("Mac rejoined with %+v, want room %s", rejoin, roomID)
+	}
+	if got := fs.count(protocol.EventJoinRoom); got != joins+1 {
+		t.Errorf("%d join_room after reconnecting, want %d", got, joins+1)
+	}
+	if mac.RoomID() != roomID || watch.RoomID() != roomID {
+		t.Errorf("rooms after reconnecting: Mac %q, watch %q, want %q", mac.RoomID(), watch.RoomID(), roomID)
+	}
+	if _, err := watch.Request(ctx, "get_battery"); err != nil {
+		t.Errorf("Request after reconnecting: %v", err)
+	}
+}
+
+func TestReconnectUnauthorized(t *testing.T) {
+	fs := newFakeServer(t)
+	c := connect(t, fs, testOptions())
+
+	fs.mu.Lock()
+	fs.revoked = true
+	fs.mu.Unlock()
+	fs.drop()
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client kept reconnecting with a refused token")
+	}
+	if !errors.Is(c.Err(), ErrUnauthorized) {
+		t.Errorf("Err = %v, want ErrUnauthorized", c.Err())
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"echo/protocol"
+)
+
+// CreateRoom creates a room owned by this device, which must be a Mac, and
+// returns its ID. A Mac that already owns a room rejoins it.
+func (c *Client) CreateRoom(ctx context.Context) (string, error) {
+	return c.createRoom(ctx, "")
+}
+
+func (c *Client) createRoom(ctx context.Context, roomID string) (string, error) {
+	resp, err := c.call(ctx, protocol.EventCreateRoom, protocol.CreateRoom{RoomID: roomID}, protocol.EventRoomJoined)
+	if err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+// JoinRoom joins the room roomID. The server answers with status joined
+// and role client; a Mac rejoins the room it owns with CreateRoom.
+func (c *Client) JoinRoom(ctx context.Context, roomID string) (protocol.RoomJoined, error) {
+	var joined protocol.RoomJoined
+	resp, err := c.call(ctx, protocol.EventJoinRoom, protocol.JoinRoom{RoomID: roomID}, protocol.EventRoomJoined)
+	if err != nil {
+		return joined, err
+	}
+	err = resp.Decode(&joined)
+	return joined, err
+}
+
+// Request asks the other device of the room, or the server's cache, for
+// action, such as "get_battery", and returns the response payload. Without
+// a deadline on ctx it gives up after Options.RequestTimeout.
+func (c *Client) Request(ctx context.Context, action string) (json.RawMessage, error) {
+	resp, err := c.call(ctx, protocol.EventRequest, protocol.Request{Action: action}, protocol.EventResponse)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
@@ -0,0 +1,44 @@
+package client
+
+import "echo/protocol"
+
+// Subscribe calls fn with every event of type eventType and its payload
+// decoded into T, usually the protocol type of that event. Events whose
+// payload does not decode or validate are logged and skipped. It returns a
+// function that cancels the subscription.
+//
+// Callbacks run one at a time on the goroutine that reads from the server,
+// so they must not block; in particular they must not wait for a call such
+// as Request, whose reply that goroutine would deliver.
+func Subscribe[T any](c *Client, eventType string, fn func(protocol.Event, T)) (unsubscribe func()) {
+	return c.subscribe(eventType, func(ev protocol.Event) {
+		var payload T
+		if err := ev.Decode(&payload); err != nil {
+			c.opts.Logger.Warn("Ignoring event with invalid payload", "type", ev.Type, "error", err)
+			return
+		}
+		fn(ev, payload)
+	})
+}
+
+// SubscribeEvent calls fn with every event of type eventType, leaving its
+// payload undecoded. The same rules as for Subscribe apply.
+func (c *Client) SubscribeEvent(eventType string, fn func(protocol.Event)) (unsubscribe func()) {
+	return c.subscribe(eventType, fn)
+}
+
+func (c *Client) subscribe(eventType string, fn func(protocol.Event)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextSub++
+	id := c.nextSub
+	if c.subs[eventType] == nil {
+		c.subs[eventType] = make(map[uint64]func(protocol.Event))
+	}
+	c.subs[eventType][id] = fn
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.subs[eventType], id)
+	}
+}
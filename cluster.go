@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Kinds of messages exchanged between server instances over the backplane.
+const (
+	clusterMsgBroadcast = "broadcast"
+	clusterMsgDirect    = "direct"
+	clusterMsgResponse  = "response"
+	clusterMsgPresence  = "presence"
+	clusterMsgPairing   = "pairing_decision"
+	clusterMsgClose     = "close"
+)
+
+// clusterMessage is published on a room's channel so that every instance
+// with members in that room can act on it.
+type clusterMessage struct {
+	Kind       string `json:"kind"`
+	Node       string `json:"node"`
+	RoomID     string `json:"room_id"`
+	DeviceID   string `json:"device_id,omitempty"`
+	DeviceType string `json:"device_type,omitempty"`
+	Exclude    string `json:"exclude,omitempty"`
+	Present    bool   `json:"present,omitempty"`
+	Approved   bool   `json:"approved,omitempty"`
+	Event      *Event `json:"event,omitempty"`
+}
+
+// presenceEntry is stored in the shared presence hash of a room, one field
+// per connected device.
+type presenceEntry struct {
+	Node       string    `json:"node"`
+	DeviceType string    `json:"device_type"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (p presenceEntry) fresh() bool {
+	return time.Since(p.UpdatedAt) <= presenceTTL
+}
+
+// Cluster is this instance's view of the backplane: it subscribes to the
+// channels of local rooms and keeps room presence in the shared store.
+type Cluster struct {
+	nodeID  string
+	bp      Backplane
+	handler func(msg clusterMessage)
+
+	mu     sync.Mutex
+	unsubs map[string]func() // roomID -> unsubscribe
+}
+
+func NewCluster(bp Backplane, handler func(msg clusterMessage)) (*Cluster, error) {
+	nodeID, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{
+		nodeID:  nodeID,
+		bp:      bp,
+		handler: handler,
+		unsubs:  make(map[string]func()),
+	}, nil
+}
+
+func roomChannel(roomID string) string {
+	return "echo:room:" + roomID
+}
+
+func presenceKey(roomID string) string {
+	return "echo:presence:" + roomID
+}
+
+// attach subscribes to a room's channel. It is a no-op if already attached.
+func (cl *Cluster) attach(roomID string) {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if _, ok := cl.unsubs[roomID]; ok {
+		return
+	}
+
+	unsub, err := cl.bp.Subscribe(roomChannel(roomID), func(data []byte) {
+		var msg clusterMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			slog.Warn("Dropping malformed backplane message", "room_id", roomID, "error", err)
+			return
+		}
+		if msg.Node == cl.nodeID {
+			return
+		}
+		cl.handler(msg)
+	})
+	if err != nil {
+		slog.Error("Failed to subscribe to room", "room_id", roomID, "error", err)
+		return
+	}
+	cl.unsubs[roomID] = unsub
+}
+
+func (cl *Cluster) detach(roomID string) {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	unsub, ok := cl.unsubs[roomID]
+	delete(cl.unsubs, roomID)
+	cl.mu.Unlock()
+
+	if ok {
+		unsub()
+	}
+}
+
+func (cl *Cluster) publish(msg clusterMessage) {
+	if cl == nil {
+		return
+	}
+
+	msg.Node = cl.nodeID
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling backplane message", "room_id", msg.RoomID, "error", err)
+		return
+	}
+	if err := cl.bp.Publish(roomChannel(msg.RoomID), data); err != nil {
+		slog.Error("Failed to publish backplane message", "kind", msg.Kind, "room_id", msg.RoomID, "error", err)
+	}
+}
+
+// announce records a local device as present in a room and tells the other
+// instances about it.
+func (cl *Cluster) announce(roomID, deviceID, deviceType string) {
+	if cl == nil {
+		return
+	}
+
+	entry, _ := json.Marshal(presenceEntry{
+		Node:       cl.nodeID,
+		DeviceType: deviceType,
+		UpdatedAt:  time.Now(),
+	})
+	if err := cl.bp.HSet(presenceKey(roomID), deviceID, string(entry)); err != nil {
+		slog.Warn("Failed to record presence", "device_id", deviceID, "room_id", roomID, "error", err)
+	}
+	cl.publish(clusterMessage{
+		Kind:       clusterMsgPresence,
+		RoomID:     roomID,
+		DeviceID:   deviceID,
+		DeviceType: deviceType,
+		Present:    true,
+	})
+}
+
+// withdraw removes a local device from a room's presence. Entries written by
+// another instance (the device reconnected elsewhere) are left alone.
+func (cl *Cluster) withdraw(roomID, deviceID, deviceType string) {
+	if cl == nil {
+		return
+	}
+
+	key := presenceKey(roomID)
+	raw, ok, err := cl.bp.HGet(key, deviceID)
+	if err != nil {
+		slog.Warn("Failed to read presence", "device_id", deviceID, "room_id", roomID, "error", err)
+	}
+	if ok {
+		var entry presenceEntry
+		if json.Unmarshal([]byte(raw), &entry) == nil && entry.Node != cl.nodeID {
+			return
+		}
+		if _, err := cl.bp.HDel(key, deviceID); err != nil {
+			slog.Warn("Failed to clear presence", "device_id", deviceID, "room_id", roomID, "error", err)
+		}
+	}
+	cl.publish(clusterMessage{
+		Kind:       clusterMsgPresence,
+		RoomID:     roomID,
+		DeviceID:   deviceID,
+		DeviceType: deviceType,
+		Present:    false,
+	})
+}
+
+// remotePresence returns the fresh presence entries of a room that belong
+// to other instances.
+func (cl *Cluster) remotePresence(roomID string) map[string]presenceEntry {
+	result := make(map[string]presenceEntry)
+	if cl == nil {
+		return result
+	}
+
+	all, err := cl.bp.HGetAll(presenceKey(roomID))
+	if err != nil {
+		slog.Warn("Failed to load presence", "room_id", roomID, "error", err)
+		return result
+	}
+	for deviceID, raw := range all {
+		var entry presenceEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			continue
+		}
+		if entry.Node != cl.nodeID && entry.fresh() {
+			result[deviceID] = entry
+		}
+	}
+	return result
+}
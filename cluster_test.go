@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+
+	echoclient "echo/client"
+	"echo/protocol"
+)
+
+const testSecret = "test-secret"
+
+// useTestKeys makes the server accept tokens signed with testSecret for
+// the duration of the test.
+func useTestKeys(t *testing.T) {
+	t.Helper()
+	keys, err := newJWTVerifier(jwtConfig{Secrets: [][]byte{[]byte(testSecret)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := jwtKeys
+	jwtKeys = keys
+	t.Cleanup(func() { jwtKeys = previous })
+}
+
+// startNode runs a Manager on bp behind a test server, as one instance of
+// a cluster, and returns it with the URL of its WebSocket endpoint.
+func startNode(t *testing.T, bp Backplane) (*Manager, string) {
+	t.Helper()
+	m, err := NewManager(NewBackplaneRoomStore(bp), bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(m.serveWs))
+	t.Cleanup(func() {
+		srv.Close()
+		m.Close()
+	})
+	return m, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// connectDevice connects to url as a device with a freshly signed token.
+func connectDevice(t *testing.T, url, deviceID, deviceType string) *echoclient.Client {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"device_id":   deviceID,
+		"device_type": deviceType,
+		"exp":         time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := echoclient.Connect(ctx, url, token, &echoclient.Options{RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("connect %s: %v", deviceID, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// collect returns a channel receiving the events of eventType that c
+// is sent from now on.
+func collect(c *echoclient.Client, eventType string) <-chan protocol.Event {
+	ch := make(chan protocol.Event, 16)
+	c.SubscribeEvent(eventType, func(ev protocol.Event) {
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	return ch
+}
+
+func expectEvent(t *testing.T, ch <-chan protocol.Event, what string) protocol.Event {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		return protocol.Event{}
+	}
+}
+
+// testTwoNodes runs a Mac on one instance and its paired watch on another,
+// each with its own view of the shared backplane, and checks that room
+// traffic crosses between them.
+func testTwoNodes(t *testing.T, bp1, bp2 Backplane) {
+	useTestKeys(t)
+	m1, url1 := startNode(t, bp1)
+	_, url2 := startNode(t, bp2)
+	ctx := context.Background()
+
+	mac := connectDevice(t, url1, "mac-1", DeviceTypeMac)
+	roomID, err := mac.CreateRoom(ctx)
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	room, _ := m1.lookupRoom(roomID)
+	room.authorize("watch-1")
+	m1.persistRoom(room)
+
+	connected := collect(mac, EventPeerConnected)
+	disconnected := collect(mac, EventPeerDisconnected)
+	requests := collect(mac, EventRequest)
+	media := collect(mac, EventMediaAction)
+
+	// Presence: the watch's instance sees the Mac and lets the watch in, and
+	// the Mac hears about the watch.
+	watch := connectDevice(t, url2, "watch-1", DeviceTypeWatch)
+	if _, err := watch.JoinRoom(ctx, roomID); err != nil {
+		t.Fatalf("join room on the other instance: %v", err)
+	}
+	if ev := expectEvent(t, connected, "peer_connected"); ev.DeviceID != "watch-1" {
+		t.Errorf("peer_connected for %q, want watch-1", ev.DeviceID)
+	}
+
+	t.Run("broadcast", func(t *testing.T) {
+		battery := collect(watch, EventBatteryUpdate)
+		if err := mac.Send(EventBatteryUpdate, protocol.BatteryStatus{Percent: 42}); err != nil {
+			t.Fatal(err)
+		}
+		var status protocol.BatteryStatus
+		if err := expectEvent(t, battery, "battery_update").Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Percent != 42 {
+			t.Errorf("percent %v, want 42", status.Percent)
+		}
+	})
+
+	t.Run("forward to peer", func(t *testing.T) {
+		if err := watch.Send(EventMediaAction, protocol.MediaAction{Action: protocol.MediaActions[0]}); err != nil {
+			t.Fatal(err)
+		}
+		ev := expectEvent(t, media, "media_action")
+		if ev.DeviceID != "watch-1" || ev.RoomID != roomID {
+			t.Errorf("media_action from %q in %q, want watch-1 in %q", ev.DeviceID, ev.RoomID, roomID)
+		}
+	})
+
+	t.Run("request and response", func(t *testing.T) {
+		type result struct {
+			payload json.RawMessage
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			payload, err := watch.Request(ctx, "get_volume")
+			done <- result{payload, err}
+		}()
+
+		req := expectEvent(t, requests, "request")
+		if req.RequestID == "" {
+			t.Fatal("request relayed without request_id")
+		}
+		if err := mac.Reply(req, EventResponse, map[string]int{"volume": 7}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-done:
+			if r.err != nil {
+				t.Fatalf("request: %v", r.err)
+			}
+			if string(r.payload) != `{"volume":7}` {
+				t.Errorf("response %s, want {\"volume\":7}", r.payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the response")
+		}
+	})
+
+	watch.Close()
+	if ev := expectEvent(t, disconnected, "peer_disconnected"); ev.DeviceID != "watch-1" {
+		t.Errorf("peer_disconnected for %q, want watch-1", ev.DeviceID)
+	}
+}
+
+func TestClusterMemoryBackplane(t *testing.T) {
+	bp := NewMemoryBackplane()
+	defer bp.Close()
+	testTwoNodes(t, bp, bp)
+}
+
+func TestClusterRedisBackplane(t *testing.T) {
+	mr := miniredis.RunT(t)
+	testTwoNodes(t, newTestRedisBackplane(t, mr), newTestRedisBackplane(t, mr))
+}
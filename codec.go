@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec turns events into WebSocket frames and back. Handlers always see
+// JSON payloads; binary codecs convert payloads at the edge of the
+// connection so the wire format never leaks into routing.
+type Codec interface {
+	Name() string
+	// FrameType is the WebSocket message type the codec is carried in.
+	FrameType() int
+	Encode(ev Event) ([]byte, error)
+	Decode(data []byte) (Event, error)
+}
+
+// Wire encoding names, also used as WebSocket subprotocols prefixed with
+// subprotocolPrefix.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+	EncodingCBOR    = "cbor"
+
+	subprotocolPrefix = "echo."
+)
+
+var codecs = map[string]Codec{
+	EncodingJSON:    jsonCodec{},
+	EncodingMsgpack: msgpackCodec{},
+	EncodingCBOR:    newCBORCodec(),
+}
+
+// encodings lists the supported encodings in order of preference.
+var encodings = []string{EncodingMsgpack, EncodingCBOR, EncodingJSON}
+
+// subprotocols returns the subprotocols offered during the upgrade.
+func subprotocols() []string {
+	protocols := make([]string, 0, len(encodings))
+	for _, name := range encodings {
+		protocols = append(protocols, subprotocolPrefix+name)
+	}
+	return protocols
+}
+
+// codecForSubprotocol returns the codec selected by the WebSocket handshake,
+// falling back to JSON when none was negotiated.
+func codecForSubprotocol(protocol string) Codec {
+	for _, name := range encodings {
+		if protocol == subprotocolPrefix+name {
+			return codecs[name]
+		}
+	}
+	return codecs[EncodingJSON]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string   { return EncodingJSON }
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (jsonCodec) Encode(ev Event) ([]byte, error) {
+	return json.Marshal(ev)
+}
+
+func (jsonCodec) Decode(data []byte) (Event, error) {
+	var ev Event
+	err := json.Unmarshal(data, &ev)
+	return ev, err
+}
+
+// wireEvent is the binary form of Event. The payload is a native value of
+// the encoding instead of embedded JSON.
+type wireEvent struct {
+	Type      string    `msgpack:"type" cbor:"type"`
+	RoomID    string    `msgpack:"room_id,omitempty" cbor:"room_id,omitempty"`
+	DeviceID  string    `msgpack:"device_id,omitempty" cbor:"device_id,omitempty"`
+	RequestID string    `msgpack:"request_id,omitempty" cbor:"request_id,omitempty"`
+	Seq       uint64    `msgpack:"seq,omitempty" cbor:"seq,omitempty"`
+	Version   uint64    `msgpack:"version,omitempty" cbor:"version,omitempty"`
+	Delta     bool      `msgpack:"delta,omitempty" cbor:"delta,omitempty"`
+	Timestamp time.Time `msgpack:"timestamp" cbor:"timestamp"`
+	Payload   any       `msgpack:"payload" cbor:"payload"`
+
+	Trace map[string]string `msgpack:"trace,omitempty" cbor:"trace,omitempty"`
+}
+
+func toWire(ev Event) (wireEvent, error) {
+	w := wireEvent{
+		Type:      ev.Type,
+		RoomID:    ev.RoomID,
+		DeviceID:  ev.DeviceID,
+		RequestID: ev.RequestID,
+		Seq:       ev.Seq,
+		Version:   ev.Version,
+		Delta:     ev.Delta,
+		Timestamp: ev.Timestamp,
+		Trace:     ev.Trace,
+	}
+	if len(ev.Payload) == 0 {
+		return w, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(ev.Payload))
+	dec.UseNumber()
+	var payload any
+	if err := dec.Decode(&payload); err != nil {
+		return w, fmt.Errorf("decode payload: %w", err)
+	}
+	w.Payload = nativeNumbers(payload)
+	return w, nil
+}
+
+// nativeNumbers replaces json.Number values with integers where possible
+// so binary encodings do not turn every number into a float.
+func nativeNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = nativeNumbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = nativeNumbers(item)
+		}
+	}
+	return v
+}
+
+func fromWire(w wireEvent) (Event, error) {
+	ev := Event{
+		Type:      w.Type,
+		RoomID:    w.RoomID,
+		DeviceID:  w.DeviceID,
+		RequestID: w.RequestID,
+		Seq:       w.Seq,
+		Version:   w.Version,
+		Delta:     w.Delta,
+		Timestamp: w.Timestamp,
+		Trace:     w.Trace,
+	}
+	if w.Payload != nil {
+		payload, err := json.Marshal(w.Payload)
+		if err != nil {
+			return ev, fmt.Errorf("encode payload: %w", err)
+		}
+		ev.Payload = payload
+	}
+	return ev, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string   { return EncodingMsgpack }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Encode(ev Event) ([]byte, error) {
+	w, err := toWire(ev)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(w)
+}
+
+func (msgpackCodec) Decode(data []byte) (Event, error) {
+	var w wireEvent
+	if err := msgpack.Unmarshal(data, &w); err != nil {
+		return Event{}, err
+	}
+	return fromWire(w)
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	// Decode maps with string keys so payloads can be re-encoded as JSON.
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) Name() string   { return EncodingCBOR }
+func (cborCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (c cborCodec) Encode(ev Event) ([]byte, error) {
+	w, err := toWire(ev)
+	if err != nil {
+		return nil, err
+	}
+	return c.enc.Marshal(w)
+}
+
+func (c cborCodec) Decode(data []byte) (Event, error) {
+	var w wireEvent
+	if err := c.dec.Unmarshal(data, &w); err != nil {
+		return Event{}, err
+	}
+	return fromWire(w)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Compression settings, overridable through COMPRESSION_LEVEL and
+// COMPRESSION_MIN_SIZE.
+var (
+	compressionLevel   = flate.BestSpeed
+	compressionMinSize = defaultCompressionMinSize
+)
+
+// loadCompressionConfig applies the environment overrides. Empty values keep
+// the defaults.
+func loadCompressionConfig(level, minSize string) error {
+	if level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < flate.HuffmanOnly || n > flate.BestCompression {
+			return fmt.Errorf("compression level %q must be between %d and %d", level, flate.HuffmanOnly, flate.BestCompression)
+		}
+		compressionLevel = n
+	}
+	if minSize != "" {
+		n, err := strconv.Atoi(minSize)
+		if err != nil || n < 0 {
+			return fmt.Errorf("compression min size %q must be a non-negative integer", minSize)
+		}
+		compressionMinSize = n
+	}
+	return nil
+}
+
+var (
+	compressionSampleCounter atomic.Uint64
+	flateWriters             sync.Pool
+)
+
+// recordCompression updates the stats for one outgoing message. Every
+// compressionSampleRate-th compressed message is deflated here as well to
+// measure the ratio, since the connection does not expose the size of its
+// compressed frames.
+func recordCompression(eventType string, data []byte, compressed bool) {
+	if !compressed {
+		compressionMessages.WithLabelValues(eventType, compressionUncompressed).Inc()
+		return
+	}
+	compressionMessages.WithLabelValues(eventType, compressionCompressed).Inc()
+
+	if compressionSampleCounter.Add(1)%compressionSampleRate != 0 {
+		return
+	}
+	size, err := deflatedSize(data)
+	if err != nil {
+		return
+	}
+	compressionSampledBytes.WithLabelValues(eventType, compressionRaw).Add(float64(len(data)))
+	compressionSampledBytes.WithLabelValues(eventType, compressionCompressed).Add(float64(size))
+}
+
+// deflatedSize returns the size of data compressed at compressionLevel.
+func deflatedSize(data []byte) (int, error) {
+	var buf bytes.Buffer
+	w, _ := flateWriters.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, compressionLevel); err != nil {
+			return 0, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer flateWriters.Put(w)
+
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+// offersCompression reports whether the upgrade request offers
+// permessage-deflate, which the upgrader then accepts.
+func offersCompression(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"time"
+
+	"echo/protocol"
 )
 
 const (
-	DeviceTypeMac   = "mac"
-	DeviceTypeWatch = "watch"
+	DeviceTypeMac   = protocol.DeviceTypeMac
+	DeviceTypeWatch = protocol.DeviceTypeWatch
 )
 
 const (
@@ -14,6 +16,70 @@ const (
 	cacheTTL       = 5 * time.Minute
 	batteryTTL     = 30 * time.Second
 	downloadsTTL   = 10 * time.Second
+	deviceInfoTTL  = 24 * time.Hour
 	addr           = ":8080"
 	statusInterval = 5 * time.Second
+
+	pairingCodeTTL       = 2 * time.Minute
+	pairingMaxAttempts   = 5
+	pairingAttemptWindow = 5 * time.Minute
+	// Once this many redemptions fail across the cluster in an attempt
+	// window, all redemptions are refused until the next window, bounding
+	// the odds of guessing any PIN.
+	pairingMaxFailures = 100
+
+	backplaneTimeout        = 2 * time.Second
+	presenceRefreshInterval = 15 * time.Second
+	presenceTTL             = 45 * time.Second
+
+	batteryMinInterval   = 2 * time.Second
+	storageMinInterval   = 5 * time.Second
+	downloadsMinInterval = 1 * time.Second
+
+	cacheHistoryLimit = 32
+
+	outboxRetention = 5 * time.Minute
+	outboxMaxEvents = 100
+
+	// minProtocolVersion is the oldest protocol accepted; raising it above
+	// legacyProtocolVersion rejects clients that do not send hello.
+	minProtocolVersion = legacyProtocolVersion
+
+	resumeWindow     = 2 * time.Minute
+	replayWindowSize = 256
+
+	egressCapacity     = 64
+	egressBlockTimeout = 500 * time.Millisecond
+	// egressBlockOverflow is how many events BackpressureBlock may queue
+	// past egressCapacity.
+	egressBlockOverflow = 16
+
+	// Messages smaller than this are sent uncompressed; deflate rarely
+	// pays off for them.
+	defaultCompressionMinSize = 512
+	compressionSampleRate     = 16
+
+	// Clients get a token_expiring event this long before their JWT
+	// expires, leaving time to send refresh_token.
+	tokenExpiryWarning = 2 * time.Minute
+
+	// Connections opened without a token must send an auth event within
+	// authTimeout.
+	authTimeout        = 10 * time.Second
+	authMaxMessageSize = 16 * 1024
+
+	// maxPayloadSize bounds event payloads whose schema sets no MaxSize.
+	maxPayloadSize      = 64 * 1024
+	maxValidationErrors = 20
+
+	// Devices rejected more than rateLimitMaxStrikes times within
+	// rateLimitStrikeWindow are disconnected.
+	rateLimitMaxStrikes    = 50
+	rateLimitStrikeWindow  = time.Minute
+	rateLimitSweepInterval = time.Minute
+	rateLimitIdleTimeout   = 10 * time.Minute
+
+	defaultJWKSCacheTTL    = 10 * time.Minute
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksFetchTimeout       = 5 * time.Second
 )
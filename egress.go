@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"echo/protocol"
+)
+
+// BackpressurePolicy decides what happens to an outgoing event when the
+// client's egress queue is full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureDropOldest evicts the oldest queued event that may itself
+	// be dropped, or drops the incoming event if none may.
+	BackpressureDropOldest BackpressurePolicy = iota
+	// BackpressureCoalesce replaces a queued event of the same type, so only
+	// the latest value is delivered. It falls back to BackpressureDropOldest.
+	BackpressureCoalesce
+	// BackpressureBlock queues the event past the limit, up to
+	// egressBlockOverflow more, and the writer drops it if it is still
+	// waiting after egressBlockTimeout. The wait happens in the writer, since
+	// senders may hold locks that other senders need.
+	BackpressureBlock
+	// BackpressureDisconnect closes the connection of the slow consumer. The
+	// client can resume its session to recover what it missed.
+	BackpressureDisconnect
+)
+
+var backpressureNames = map[string]BackpressurePolicy{
+	"drop-oldest": BackpressureDropOldest,
+	"coalesce":    BackpressureCoalesce,
+	"block":       BackpressureBlock,
+	"disconnect":  BackpressureDisconnect,
+}
+
+func (p BackpressurePolicy) String() string {
+	for name, policy := range backpressureNames {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// egressPolicies maps event types to their backpressure policy. Types not
+// listed use BackpressureDropOldest. Telemetry only matters in its latest
+// form; replies and commands are worth waiting for.
+var egressPolicies = map[string]BackpressurePolicy{
+	EventDeviceInfo:      BackpressureCoalesce,
+	EventBatteryUpdate:   BackpressureCoalesce,
+	EventStorageUpdate:   BackpressureCoalesce,
+	EventDownloadsUpdate: BackpressureCoalesce,
+	EventStatusUpdate:    BackpressureCoalesce,
+
+	EventActionRequest:   BackpressureBlock,
+	EventActionResult:    BackpressureBlock,
+	EventMediaAction:     BackpressureBlock,
+	EventRequest:         BackpressureBlock,
+	EventResponse:        BackpressureBlock,
+	EventError:           BackpressureBlock,
+	EventRoomJoined:      BackpressureBlock,
+	EventPairingApproval: BackpressureBlock,
+	EventPairingDecision: BackpressureBlock,
+	EventResumed:         BackpressureBlock,
+}
+
+// loadEgressPolicies overrides egressPolicies from a spec such as
+// "battery_update=coalesce,action_result=disconnect".
+func loadEgressPolicies(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eventType, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid egress policy %q: want type=policy", entry)
+		}
+		policy, ok := backpressureNames[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unknown backpressure policy %q for %s", name, eventType)
+		}
+		egressPolicies[strings.TrimSpace(eventType)] = policy
+	}
+	return nil
+}
+
+func egressPolicyFor(eventType string) BackpressurePolicy {
+	if policy, ok := egressPolicies[eventType]; ok {
+		return policy
+	}
+	return BackpressureDropOldest
+}
+
+// pushResult tells the sender what became of an event.
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushDropped
+	pushDisconnect
+)
+
+// egressQueue is the bounded queue of events waiting to be written to a
+// client. Events dropped because of backpressure are counted per type and
+// reported to the client once the queue drains.
+type egressQueue struct {
+	mu       sync.Mutex
+	events   []egressEvent
+	capacity int
+	dropped  map[string]int
+	closed   bool
+
+	ready chan struct{} // signalled when an event is queued
+}
+
+// egressEvent is an event waiting in an egressQueue. Events queued past
+// the limit by BackpressureBlock carry the deadline for writing them.
+type egressEvent struct {
+	Event
+	deadline time.Time
+}
+
+func newEgressQueue(capacity int) *egressQueue {
+	return &egressQueue{
+		capacity: capacity,
+		dropped:  make(map[string]int),
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues ev according to the backpressure policy of its type. It
+// never waits for the writer.
+func (q *egressQueue) push(ev Event) pushResult {
+	policy := egressPolicyFor(ev.Type)
+	queued := egressEvent{Event: ev}
+	result := pushQueued
+
+	q.mu.Lock()
+	switch {
+	case q.closed:
+		q.mu.Unlock()
+		return pushDropped
+	case policy == BackpressureCoalesce && q.replaceLocked(ev):
+		q.mu.Unlock()
+		notify(q.ready)
+		return pushQueued
+	case len(q.events) < q.capacity:
+	case policy == BackpressureDisconnect:
+		q.mu.Unlock()
+		return pushDisconnect
+	case policy == BackpressureBlock && len(q.events) < q.capacity+egressBlockOverflow:
+		queued.deadline = time.Now().Add(egressBlockTimeout)
+	case policy == BackpressureBlock:
+		q.recordDropLocked(ev.Type)
+		result = pushDropped
+	case !q.evictLocked():
+		q.recordDropLocked(ev.Type)
+		result = pushDropped
+	}
+
+	if result == pushQueued {
+		q.events = append(q.events, queued)
+	}
+	q.mu.Unlock()
+	notify(q.ready)
+	return result
+}
+
+// recordDropLocked counts a dropped event for the next drop report.
+func (q *egressQueue) recordDropLocked(eventType string) {
+	q.dropped[eventType]++
+	egressDropped.WithLabelValues(eventType).Inc()
+}
+
+// evictLocked drops the oldest queued event whose own policy allows
+// dropping it, so telemetry never pushes out replies or commands.
+func (q *egressQueue) evictLocked() bool {
+	for i, queued := range q.events {
+		switch egressPolicyFor(queued.Type) {
+		case BackpressureDropOldest, BackpressureCoalesce:
+			q.recordDropLocked(queued.Type)
+			q.events = append(q.events[:i], q.events[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// replaceLocked removes a queued event of the same type and appends ev in
+// its place at the back, keeping sequence numbers in order. A delta is
+// folded into the event it replaces so no change is lost.
+func (q *egressQueue) replaceLocked(ev Event) bool {
+	for i, queued := range q.events {
+		if queued.Type == ev.Type && queued.RoomID == ev.RoomID {
+			if ev.Delta {
+				merged, ok := foldDelta(queued.Event, ev)
+				if !ok {
+					return false
+				}
+				ev = merged
+			}
+			q.events = append(q.events[:i], q.events[i+1:]...)
+			q.events = append(q.events, egressEvent{Event: ev, deadline: queued.deadline})
+			return true
+		}
+	}
+	return false
+}
+
+// foldDelta combines a queued event with a delta that follows it.
+func foldDelta(queued, delta Event) (Event, bool) {
+	var payload []byte
+	var err error
+	if queued.Delta {
+		payload, err = composeMergePatch(queued.Payload, delta.Payload)
+	} else {
+		payload, err = applyMergePatch(queued.Payload, delta.Payload)
+		delta.Delta = false
+	}
+	if err != nil {
+		return Event{}, false
+	}
+	delta.Payload = payload
+	return delta, true
+}
+
+// pop takes the next event to write, dropping the events queued past the
+// limit that missed their deadline. A pending drop report goes first so the
+// client learns about the gap before it sees newer events.
+func (q *egressQueue) pop() (Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for len(q.events) > 0 && !q.events[0].deadline.IsZero() && now.After(q.events[0].deadline) {
+		q.recordDropLocked(q.events[0].Type)
+		q.events = q.events[1:]
+	}
+	if len(q.dropped) > 0 {
+		ev := droppedEvent(q.dropped)
+		q.dropped = make(map[string]int)
+		return ev, true
+	}
+	if len(q.events) == 0 {
+		return Event{}, false
+	}
+	ev := q.events[0]
+	q.events = q.events[1:]
+	return ev.Event, true
+}
+
+func (q *egressQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.events = nil
+}
+
+// droppedEvent reports events lost to backpressure. It carries no sequence
+// number since it describes the connection rather than the session; the
+// dropped events themselves remain in the session's replay buffer.
+func droppedEvent(counts map[string]int) Event {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return Event{
+		Type:      EventEventsDropped,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.EventsDropped{Dropped: counts, Total: total}),
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"echo/protocol"
+)
+
+// drain pops every event from q and returns their types along with the
+// counts of the drop report, if one was sent.
+func drain(t *testing.T, q *egressQueue) ([]string, map[string]int) {
+	t.Helper()
+	var types []string
+	var dropped map[string]int
+	for {
+		ev, ok := q.pop()
+		if !ok {
+			return types, dropped
+		}
+		if ev.Type != EventEventsDropped {
+			types = append(types, ev.Type)
+			continue
+		}
+		if types != nil {
+			t.Errorf("drop report after %v", types)
+		}
+		var report protocol.EventsDropped
+		if err := json.Unmarshal(ev.Payload, &report); err != nil {
+			t.Fatal(err)
+		}
+		dropped = report.Dropped
+	}
+}
+
+func TestEgressQueuePolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		queued      []string
+		push        string
+		want        pushResult
+		wantTypes   []string
+		wantDropped map[string]int
+	}{
+		{
+			name:      "room to spare",
+			queued:    []string{EventActionResult},
+			push:      EventPeerConnected,
+			want:      pushQueued,
+			wantTypes: []string{EventActionResult, EventPeerConnected},
+		},
+		{
+			name:        "drop oldest skips replies",
+			queued:      []string{EventActionResult, EventResponse, EventPeerConnected, EventSyncResult},
+			push:        EventPeerConnected,
+			want:        pushQueued,
+			wantTypes:   []string{EventActionResult, EventResponse, EventSyncResult, EventPeerConnected},
+			wantDropped: map[string]int{EventPeerConnected: 1},
+		},
+		{
+			name:        "drop oldest with only replies queued",
+			queued:      []string{EventActionResult, EventResponse, EventError, EventRoomJoined},
+			push:        EventPeerConnected,
+			want:        pushDropped,
+			wantTypes:   []string{EventActionResult, EventResponse, EventError, EventRoomJoined},
+			wantDropped: map[string]int{EventPeerConnected: 1},
+		},
+		{
+			name:      "coalesce replaces",
+			queued:    []string{EventBatteryUpdate, EventResponse, EventStorageUpdate, EventError},
+			push:      EventBatteryUpdate,
+			want:      pushQueued,
+			wantTypes: []string{EventResponse, EventStorageUpdate, EventError, EventBatteryUpdate},
+		},
+		{
+			name:        "coalesce falls back to drop oldest",
+			queued:      []string{EventResponse, EventStorageUpdate, EventError, EventPeerConnected},
+			push:        EventBatteryUpdate,
+			want:        pushQueued,
+			wantTypes:   []string{EventResponse, EventError, EventPeerConnected, EventBatteryUpdate},
+			wantDropped: map[string]int{EventStorageUpdate: 1},
+		},
+		{
+			name:        "coalesce with only replies queued",
+			queued:      []string{EventResponse, EventResponse, EventError, EventActionResult},
+			push:        EventBatteryUpdate,
+			want:        pushDropped,
+			wantTypes:   []string{EventResponse, EventResponse, EventError, EventActionResult},
+			wantDropped: map[string]int{EventBatteryUpdate: 1},
+		},
+		{
+			name:      "block queues past the limit",
+			queued:    []string{EventPeerConnected, EventPeerConnected, EventPeerConnected, EventPeerConnected},
+			push:      EventActionResult,
+			want:      pushQueued,
+			wantTypes: []string{EventPeerConnected, EventPeerConnected, EventPeerConnected, EventPeerConnected, EventActionResult},
+		},
+		{
+			name:      "disconnect",
+			queued:    []string{EventPeerConnected, EventPeerConnected, EventPeerConnected, EventPeerConnected},
+			push:      "test_disconnect",
+			want:      pushDisconnect,
+			wantTypes: []string{EventPeerConnected, EventPeerConnected, EventPeerConnected, EventPeerConnected},
+		},
+	}
+
+	egressPolicies["test_disconnect"] = BackpressureDisconnect
+	defer delete(egressPolicies, "test_disconnect")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newEgressQueue(4)
+			for _, eventType := range tt.queued {
+				if got := q.push(Event{Type: eventType}); got != pushQueued {
+					t.Fatalf("push %s while filling: %v", eventType, got)
+				}
+			}
+			if got := q.push(Event{Type: tt.push}); got != tt.want {
+				t.Errorf("push %s = %v, want %v", tt.push, got, tt.want)
+			}
+			types, dropped := drain(t, q)
+			if !slices.Equal(types, tt.wantTypes) {
+				t.Errorf("queue %v, want %v", types, tt.wantTypes)
+			}
+			if !maps.Equal(dropped, tt.wantDropped) {
+				t.Errorf("dropped %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestEgressQueueCoalesceKeepsRooms(t *testing.T) {
+	q := newEgressQueue(4)
+	q.push(Event{Type: EventBatteryUpdate, RoomID: "a", Payload: json.RawMessage(`1`)})
+	q.push(Event{Type: EventBatteryUpdate, RoomID: "b", Payload: json.RawMessage(`2`)})
+	q.push(Event{Type: EventBatteryUpdate, RoomID: "a", Payload: json.RawMessage(`3`)})
+
+	var got []string
+	for ev, ok := q.pop(); ok; ev, ok = q.pop() {
+		got = append(got, ev.RoomID+"="+string(ev.Payload))
+	}
+	if want := []string{"b=2", "a=3"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEgressQueueBlockOverflow(t *testing.T) {
+	q := newEgressQueue(1)
+	q.push(Event{Type: EventPeerConnected})
+	for i := range egressBlockOverflow {
+		if got := q.push(Event{Type: EventResponse}); got != pushQueued {
+			t.Fatalf("push %d past the limit = %v, want queued", i+1, got)
+		}
+	}
+	if got := q.push(Event{Type: EventResponse}); got != pushDropped {
+		t.Errorf("push beyond the overflow = %v, want dropped", got)
+	}
+
+	// Expire the first half of the overflow; once it reaches the head of the
+	// queue, pop drops it and reports it.
+	past := time.Now().Add(-time.Millisecond)
+	q.mu.Lock()
+	for i := 1; i <= egressBlockOverflow/2; i++ {
+		q.events[i].deadline = past
+	}
+	q.mu.Unlock()
+
+	for _, want := range []string{EventEventsDropped, EventPeerConnected} {
+		if ev, _ := q.pop(); ev.Type != want {
+			t.Fatalf("pop %s, want %s", ev.Type, want)
+		}
+	}
+	types, dropped := drain(t, q)
+	if len(types) != egressBlockOverflow/2 {
+		t.Errorf("%d responses written, want %d", len(types), egressBlockOverflow/2)
+	}
+	if want := map[string]int{EventResponse: egressBlockOverflow / 2}; !maps.Equal(dropped, want) {
+		t.Errorf("dropped %v, want %v", dropped, want)
+	}
+}
+
+func TestEgressQueueClosed(t *testing.T) {
+	q := newEgressQueue(4)
+	q.push(Event{Type: EventResponse})
+	q.close()
+	if got := q.push(Event{Type: EventResponse}); got != pushDropped {
+		t.Errorf("push after close = %v, want dropped", got)
+	}
+	if ev, ok := q.pop(); ok {
+		t.Errorf("pop after close = %s", ev.Type)
+	}
+}
@@ -1,55 +1,74 @@
 package main
 
-import (
-	"encoding/json"
-	"time"
-)
+import "echo/protocol"
 
+// Event types, defined in the protocol package shared with clients.
 const (
 	// Connection events
-	EventConnect    = "connect"
-	EventDisconnect = "disconnect"
+	EventConnect    = protocol.EventConnect
+	EventDisconnect = protocol.EventDisconnect
+	EventHello      = protocol.EventHello
+	EventWelcome    = protocol.EventWelcome
+
+	// Session events
+	EventAck     = protocol.EventAck
+	EventResume  = protocol.EventResume
+	EventResumed = protocol.EventResumed
+
+	// Token events
+	EventAuth           = protocol.EventAuth
+	EventTokenExpiring  = protocol.EventTokenExpiring
+	EventRefreshToken   = protocol.EventRefreshToken
+	EventTokenRefreshed = protocol.EventTokenRefreshed
+
+	// EventEventsDropped reports events lost to egress backpressure
+	EventEventsDropped = protocol.EventEventsDropped
 
 	// Room events
-	EventCreateRoom = "create_room"
-	EventJoinRoom   = "join_room"
-	EventLeaveRoom  = "leave_room"
-	EventRoomJoined = "room_joined"
-	EventRoomStatus = "room_status"
+	EventCreateRoom = protocol.EventCreateRoom
+	EventJoinRoom   = protocol.EventJoinRoom
+	EventLeaveRoom  = protocol.EventLeaveRoom
+	EventRoomJoined = protocol.EventRoomJoined
+	EventRoomStatus = protocol.EventRoomStatus
+
+	// Pairing events
+	EventPairingRequest  = protocol.EventPairingRequest
+	EventPairingCode     = protocol.EventPairingCode
+	EventPairingRedeem   = protocol.EventPairingRedeem
+	EventPairingPending  = protocol.EventPairingPending
+	EventPairingApproval = protocol.EventPairingApproval
+	EventPairingDecision = protocol.EventPairingDecision
+
 	// Data sync events
-	EventDeviceInfo      = "device_info"
-	EventBatteryUpdate   = "battery_update"
-	EventDownloadsUpdate = "downloads_update"
-	EventStorageUpdate   = "storage_update"
+	EventDeviceInfo      = protocol.EventDeviceInfo
+	EventBatteryUpdate   = protocol.EventBatteryUpdate
+	EventDownloadsUpdate = protocol.EventDownloadsUpdate
+	EventStorageUpdate   = protocol.EventStorageUpdate
+	EventSync            = protocol.EventSync
+	EventSyncResult      = protocol.EventSyncResult
 
 	// Action events
-	EventAction        = "action"
-	EventActionRequest = "action_request"
-	EventActionResult  = "action_result"
+	EventAction        = protocol.EventAction
+	EventActionRequest = protocol.EventActionRequest
+	EventActionResult  = protocol.EventActionResult
 
 	// Media Action
-	EventMediaAction        = "media_action"
-	EventMediaActionRequest = "media_action_request"
-	EventMediaActionResult  = "media_action_result"
+	EventMediaAction        = protocol.EventMediaAction
+	EventMediaActionRequest = protocol.EventMediaActionRequest
+	EventMediaActionResult  = protocol.EventMediaActionResult
 
 	// Generic request/response
-	EventRequest  = "request"
-	EventResponse = "response"
-	EventError    = "error"
+	EventRequest  = protocol.EventRequest
+	EventResponse = protocol.EventResponse
+	EventError    = protocol.EventError
 
 	// Peer events
-	EventPeerConnected    = "peer_connected"
-	EventPeerDisconnected = "peer_disconnected"
+	EventPeerConnected    = protocol.EventPeerConnected
+	EventPeerDisconnected = protocol.EventPeerDisconnected
 
 	// Status events
-	EventStatusUpdate = "status_update"
+	EventStatusUpdate = protocol.EventStatusUpdate
 )
 
-type Event struct {
-	Type      string          `json:"type"`
-	RoomID    string          `json:"room_id,omitempty"`
-	DeviceID  string          `json:"device_id,omitempty"`
-	RequestID string          `json:"request_id,omitempty"`
-	Timestamp time.Time       `json:"timestamp"`
-	Payload   json.RawMessage `json:"payload,omitempty"`
-}
+// Event is the envelope of every message.
+type Event = protocol.Event
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"echo/protocol"
+)
+
+// Protocol versions. Version 1 is the original protocol, spoken by clients
+// that never send hello. They receive the same events and fields as other
+// clients, except events_dropped, which is only sent to clients that
+// negotiated FeatureDropReports; clients are expected to ignore event types
+// and fields they do not know.
+const (
+	legacyProtocolVersion = protocol.LegacyVersion
+	protocolVersion       = protocol.Version
+)
+
+// Optional protocol features, negotiated in the hello/welcome exchange.
+const (
+	FeatureResume          = "resume"
+	FeatureSync            = "sync"
+	FeatureTelemetryDeltas = "telemetry_deltas"
+	FeatureDropReports     = "drop_reports"
+)
+
+var serverFeatures = []string{
+	FeatureResume,
+	FeatureSync,
+	FeatureTelemetryDeltas,
+	FeatureDropReports,
+}
+
+// handleHello negotiates the protocol version and features with a client
+// and replies with a welcome describing the server's limits.
+func (m *Manager) handleHello(ev Event, c *Client) error {
+	var payload protocol.Hello
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	c.mu.RLock()
+	negotiated := c.protocol != 0
+	c.mu.RUnlock()
+	if negotiated {
+		return newRouteError(ErrCodeInvalidPayload, "protocol already negotiated")
+	}
+
+	if payload.ProtocolVersion < minProtocolVersion {
+		m.rejectProtocol(c, payload.ProtocolVersion)
+		return nil
+	}
+	version := min(payload.ProtocolVersion, protocolVersion)
+
+	supported := make(map[string]bool, len(serverFeatures))
+	for _, f := range serverFeatures {
+		supported[f] = true
+	}
+	features := make(map[string]bool)
+	for _, f := range payload.Features {
+		if supported[f] {
+			features[f] = true
+		}
+	}
+
+	c.mu.Lock()
+	c.protocol = version
+	for f := range features {
+		c.features[f] = true
+	}
+	if payload.CompressionMinSize != nil {
+		c.compressMinSize = *payload.CompressionMinSize
+	}
+	compressMinSize := c.compressMinSize
+	encoding := c.codec.Name()
+	for _, name := range payload.Encodings {
+		if codec, ok := codecs[name]; ok {
+			c.pendingCodec = codec
+			encoding = name
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	agreed := make([]string, 0, len(features))
+	for f := range features {
+		agreed = append(agreed, f)
+	}
+	sort.Strings(agreed)
+
+	c.send(Event{
+		Type:      EventWelcome,
+		RequestID: ev.RequestID,
+		Timestamp: time.Now(),
+		Payload: protocol.EncodePayload(protocol.Welcome{
+			ProtocolVersion: version,
+			Features:        agreed,
+			Encoding:        encoding,
+			ResumeToken:     c.currentSession().token,
+			Limits: protocol.Limits{
+				MaxMessageSize:     maxMessageSize,
+				RequestTimeoutMs:   requestTimeout.Milliseconds(),
+				StatusIntervalMs:   statusInterval.Milliseconds(),
+				ResumeWindowMs:     resumeWindow.Milliseconds(),
+				ReplayWindow:       replayWindowSize,
+				EgressCapacity:     egressCapacity,
+				CompressionMinSize: compressMinSize,
+			},
+		}),
+	})
+	return nil
+}
+
+// negotiateLegacy is called for the first event of a client that did not
+// start with hello. It falls back to the legacy protocol if still allowed
+// and reports false if the client was rejected.
+func (m *Manager) negotiateLegacy(c *Client) bool {
+	c.mu.Lock()
+	if c.protocol != 0 {
+		c.mu.Unlock()
+		return true
+	}
+	if legacyProtocolVersion < minProtocolVersion {
+		c.mu.Unlock()
+		m.rejectProtocol(c, legacyProtocolVersion)
+		return false
+	}
+	c.protocol = legacyProtocolVersion
+	c.mu.Unlock()
+	return true
+}
+
+// rejectProtocol closes the connection of a client speaking a protocol
+// version that is no longer supported. The reason travels in the close
+// frame so it reaches the client even though pending events are dropped.
+func (m *Manager) rejectProtocol(c *Client, version int) {
+	c.logger().Warn("Rejecting unsupported protocol version", "protocol_version", version)
+	reason := fmt.Sprintf("%s: version %d, supported %d-%d", ErrCodeUnsupportedProtocol, version, minProtocolVersion, protocolVersion)
+	c.closeWithReason(websocket.CloseProtocolError, reason)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"echo/protocol"
+)
+
+// patchOp is a JSON Patch (RFC 6902) operation. Only the operations needed
+// to describe the difference between two documents are produced.
+type patchOp = protocol.PatchOp
+
+// createJSONPatch returns the operations that turn original into modified.
+// Arrays are compared index by index, which keeps in-place updates and
+// appends (the common case for lists like downloads) small.
+func createJSONPatch(original, modified []byte) ([]patchOp, error) {
+	var orig, mod any
+	if err := json.Unmarshal(original, &orig); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(modified, &mod); err != nil {
+		return nil, err
+	}
+
+	var ops []patchOp
+	if err := diffJSON("", orig, mod, &ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func diffJSON(path string, orig, mod any, ops *[]patchOp) error {
+	if reflect.DeepEqual(orig, mod) {
+		return nil
+	}
+
+	switch o := orig.(type) {
+	case map[string]any:
+		m, ok := mod.(map[string]any)
+		if !ok {
+			break
+		}
+		for _, key := range sortedKeys(o) {
+			if _, ok := m[key]; !ok {
+				*ops = append(*ops, patchOp{Op: "remove", Path: path + "/" + escapePointer(key)})
+			}
+		}
+		for _, key := range sortedKeys(m) {
+			prev, ok := o[key]
+			if !ok {
+				if err := appendOp(ops, "add", path+"/"+escapePointer(key), m[key]); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := diffJSON(path+"/"+escapePointer(key), prev, m[key], ops); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case []any:
+		m, ok := mod.([]any)
+		if !ok {
+			break
+		}
+		common := min(len(o), len(m))
+		for i := 0; i < common; i++ {
+			if err := diffJSON(path+"/"+strconv.Itoa(i), o[i], m[i], ops); err != nil {
+				return err
+			}
+		}
+		for i := common; i < len(m); i++ {
+			if err := appendOp(ops, "add", path+"/-", m[i]); err != nil {
+				return err
+			}
+		}
+		for i := len(o) - 1; i >= common; i-- {
+			*ops = append(*ops, patchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		return nil
+	}
+
+	return appendOp(ops, "replace", path, mod)
+}
+
+func appendOp(ops *[]patchOp, op, path string, value any) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	*ops = append(*ops, patchOp{Op: op, Path: path, Value: b})
+	return nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapePointer escapes a member name for use in a JSON Pointer (RFC 6901).
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// applyPatch applies the add, remove and replace operations of RFC 6902 to
+// doc, as clients do with the patches of sync_result.
+func applyPatch(doc any, ops []patchOp) (any, error) {
+	for _, op := range ops {
+		var value any
+		if op.Op != "remove" {
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+			}
+		}
+		if op.Path == "" {
+			if op.Op == "remove" {
+				return nil, fmt.Errorf("remove of the root")
+			}
+			doc = value
+			continue
+		}
+		var err error
+		if doc, err = patchAt(doc, strings.Split(op.Path, "/")[1:], op.Op, value); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// patchAt applies an operation at the pointer tokens below doc and returns
+// the updated doc.
+func patchAt(doc any, tokens []string, op string, value any) (any, error) {
+	token := strings.NewReplacer("~1", "/", "~0", "~").Replace(tokens[0])
+	last := len(tokens) == 1
+
+	switch d := doc.(type) {
+	case map[string]any:
+		child, exists := d[token]
+		switch {
+		case !last:
+			if !exists {
+				return nil, fmt.Errorf("no member %q", token)
+			}
+			updated, err := patchAt(child, tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			d[token] = updated
+		case op == "add":
+			d[token] = value
+		case !exists:
+			return nil, fmt.Errorf("no member %q", token)
+		case op == "remove":
+			delete(d, token)
+		default:
+			d[token] = value
+		}
+		return d, nil
+
+	case []any:
+		if last && op == "add" && token == "-" {
+			return append(d, value), nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i > len(d) || (i == len(d) && !(last && op == "add")) {
+			return nil, fmt.Errorf("index %q out of range", token)
+		}
+		switch {
+		case !last:
+			updated, err := patchAt(d[i], tokens[1:], op, value)
+			if err != nil {
+				return nil, err
+			}
+			d[i] = updated
+		case op == "add":
+			d = append(d[:i], append([]any{value}, d[i:]...)...)
+		case op == "remove":
+			d = append(d[:i], d[i+1:]...)
+		default:
+			d[i] = value
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("cannot descend into %T", doc)
+}
+
+func TestJSONPatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name               string
+		original, modified string
+	}{
+		{"unchanged", `{"a":1,"b":[1,2]}`, `{"a":1,"b":[1,2]}`},
+		{"scalar change", `{"percent":40,"is_charging":false}`, `{"percent":41,"is_charging":true}`},
+		{"member added and removed", `{"a":1,"b":2}`, `{"b":2,"c":3}`},
+		{"array grows", `{"downloads":[{"name":"a","progress":0.5}]}`,
+			`{"downloads":[{"name":"a","progress":0.6},{"name":"b","progress":0},{"name":"c","progress":0}]}`},
+		{"array shrinks", `{"downloads":[{"name":"a"},{"name":"b"},{"name":"c"}]}`, `{"downloads":[{"name":"b"}]}`},
+		{"array emptied", `[1,2,3]`, `[]`},
+		{"array from empty", `[]`, `[1,[2],{"c":3}]`},
+		{"nested arrays", `[[1,2],[3]]`, `[[1],[3,4,5]]`},
+		{"escaped keys", `{"a/b":1,"c~d":{"e~1f":1},"~":[1]}`, `{"a/b":2,"c~d":{"e~1f":2,"/":3},"~":[1,2]}`},
+		{"escaped key removed", `{"a/b":1,"~0":2}`, `{}`},
+		{"member type change", `{"a":{"b":1},"c":[1],"d":"x"}`, `{"a":[1],"c":{"b":1},"d":null}`},
+		{"root type change", `{"a":1}`, `[1,2]`},
+		{"root to scalar", `[1,2]`, `"done"`},
+		{"null values", `{"a":null,"b":1}`, `{"a":1,"b":null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := createJSONPatch([]byte(tt.original), []byte(tt.modified))
+			if err != nil {
+				t.Fatalf("createJSONPatch: %v", err)
+			}
+			var doc, want any
+			if err := json.Unmarshal([]byte(tt.original), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.modified), &want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyPatch(doc, ops)
+			if err != nil {
+				t.Fatalf("apply %+v: %v", ops, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("apply(diff(a, b)) = %v, want %v; patch %+v", got, want, ops)
+			}
+			if tt.original == tt.modified && len(ops) > 0 {
+				t.Errorf("patch between equal documents: %+v", ops)
+			}
+		})
+	}
+}
+
+func TestJSONPatchEscapesPointers(t *testing.T) {
+	ops, err := createJSONPatch([]byte(`{}`), []byte(`{"a/b~c":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Path != "/a~1b~0c" {
+		t.Errorf("got %+v, want one op at /a~1b~0c", ops)
+	}
+}
+
+func TestJSONPatchInvalidDocument(t *testing.T) {
+	if _, err := createJSONPatch([]byte(`{"a":1}`), []byte(`{"a":`)); err == nil {
+		t.Error("want an error for malformed JSON")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwksCache holds the keys of a JWKS endpoint. Keys are refetched once the
+// TTL has passed, or earlier when a token names an unknown kid so newly
+// rotated keys are picked up, at most once per jwksMinRefreshInterval.
+type jwksCache struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	fetchMu sync.Mutex // serializes fetches
+	mu      sync.RWMutex
+	set     []verificationKey
+	fetched time.Time // last successful fetch
+	tried   time.Time // last attempt
+}
+
+func newJWKSCache(url string, ttl time.Duration) *jwksCache {
+	return &jwksCache{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+}
+
+// keys returns the cached keys, refreshing them first if they are stale or
+// kid is not among them. If a refresh fails the previous keys are kept.
+func (jc *jwksCache) keys(kid string) ([]verificationKey, error) {
+	jc.mu.RLock()
+	set, fetched := jc.set, jc.fetched
+	jc.mu.RUnlock()
+
+	if !fetched.IsZero() && time.Since(fetched) < jc.ttl && (kid == "" || hasKid(set, kid)) {
+		return set, nil
+	}
+
+	jc.fetchMu.Lock()
+	defer jc.fetchMu.Unlock()
+
+	// Another caller may have refreshed while this one waited.
+	jc.mu.RLock()
+	set, fetched, tried := jc.set, jc.fetched, jc.tried
+	jc.mu.RUnlock()
+	stale := fetched.IsZero() || time.Since(fetched) >= jc.ttl
+	if !stale && (kid == "" || hasKid(set, kid)) {
+		return set, nil
+	}
+	if time.Since(tried) < jwksMinRefreshInterval {
+		if set == nil {
+			return nil, errors.New("JWKS unavailable")
+		}
+		return set, nil
+	}
+
+	fresh, err := jc.fetch()
+	jc.mu.Lock()
+	jc.tried = time.Now()
+	if err == nil {
+		jc.set, jc.fetched = fresh, jc.tried
+		set = fresh
+	}
+	jc.mu.Unlock()
+
+	if err != nil {
+		slog.Warn("Failed to fetch JWKS", "url", jc.url, "error", err)
+		if set == nil {
+			return nil, fmt.Errorf("fetch JWKS: %w", err)
+		}
+	}
+	return set, nil
+}
+
+func hasKid(set []verificationKey, kid string) bool {
+	for _, k := range set {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+func (jc *jwksCache) fetch() ([]verificationKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jc.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := jc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	var set []verificationKey
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// One unsupported key should not lock out tokens signed
+			// with the others.
+			slog.Warn("Skipping JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		set = append(set, verificationKey{kid: k.Kid, key: key})
+	}
+	if len(set) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	slog.Info("Fetched JWKS", "url", jc.url, "keys", len(set))
+	return set, nil
+}
+
+// jwk is a JSON Web Key (RFC 7517) holding a public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -1,37 +1,252 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
-	
-"github.com/golang-jwt/jwt/v5"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 )
 
+// jwtKeys verifies device tokens. main sets it up from the environment.
+var jwtKeys *jwtVerifier
+
+// jwtConfig selects the keys and claims accepted in device tokens.
+type jwtConfig struct {
+	// Secrets are HMAC secrets. The first signs new tokens on the auth
+	// service side; the others stay accepted while a rotation is rolled out.
+	Secrets [][]byte
+	// PublicKeyFile is a PEM file of RSA, ECDSA or Ed25519 public keys or
+	// certificates. A "kid" PEM header ties a key to a key ID.
+	PublicKeyFile string
+	// JWKSURL is fetched for public keys, selected by the token's kid.
+	JWKSURL      string
+	JWKSCacheTTL time.Duration
+	// Issuer and Audience, if set, are required in the iss and aud claims.
+	// A token passes if its aud contains any of Audience.
+	Issuer   string
+	Audience []string
+}
+
+// loadJWTConfig reads the token settings from the environment:
+//
+//	JWT_SECRET             HMAC secret
+//	JWT_PREVIOUS_SECRETS   comma-separated HMAC secrets still accepted
+//	JWT_PUBLIC_KEY_FILE    PEM file of public keys
+//	JWT_JWKS_URL           JWKS endpoint of the auth service
+//	JWT_JWKS_CACHE_TTL     how long fetched keys are used, e.g. 10m
+//	JWT_ISSUER             required iss claim
+//	JWT_AUDIENCE           comma-separated accepted aud values
+func loadJWTConfig() (jwtConfig, error) {
+	cfg := jwtConfig{
+		PublicKeyFile: os.Getenv("JWT_PUBLIC_KEY_FILE"),
+		JWKSURL:       os.Getenv("JWT_JWKS_URL"),
+		JWKSCacheTTL:  defaultJWKSCacheTTL,
+		Issuer:        os.Getenv("JWT_ISSUER"),
+		Audience:      splitList(os.Getenv("JWT_AUDIENCE")),
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		cfg.Secrets = append(cfg.Secrets, []byte(secret))
+	}
+	for _, secret := range splitList(os.Getenv("JWT_PREVIOUS_SECRETS")) {
+		cfg.Secrets = append(cfg.Secrets, []byte(secret))
+	}
+	if ttl := os.Getenv("JWT_JWKS_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid JWT_JWKS_CACHE_TTL %q", ttl)
+		}
+		cfg.JWKSCacheTTL = d
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// jwtVerifier holds the keys device tokens may be signed with.
+type jwtVerifier struct {
+	secrets [][]byte
+	keys    []verificationKey // from the PEM file
+	jwks    *jwksCache        // nil without a JWKS URL
+	methods []string          // signing methods the configured keys support
+	options []jwt.ParserOption
+}
+
+// verificationKey is a public key with its optional key ID.
+type verificationKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+func newJWTVerifier(cfg jwtConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{secrets: cfg.Secrets}
+	if cfg.PublicKeyFile != "" {
+		data, err := os.ReadFile(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read public keys: %w", err)
+		}
+		if v.keys, err = parsePublicKeys(data); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", cfg.PublicKeyFile, err)
+		}
+	}
+	if cfg.JWKSURL != "" {
+		v.jwks = newJWKSCache(cfg.JWKSURL, cfg.JWKSCacheTTL)
+	}
+	if len(v.secrets) == 0 && len(v.keys) == 0 && v.jwks == nil {
+		return nil, errors.New("no JWT keys configured, set JWT_SECRET, JWT_PUBLIC_KEY_FILE or JWT_JWKS_URL")
+	}
+
+	if len(v.secrets) > 0 {
+		v.methods = append(v.methods, "HS256", "HS384", "HS512")
+	}
+	if len(v.keys) > 0 || v.jwks != nil {
+		// Key types are matched against the method per token in keysFor.
+		v.methods = append(v.methods,
+			"RS256", "RS384", "RS512", "PS256", "PS384", "PS512",
+			"ES256", "ES384", "ES512", "EdDSA")
+	}
+
+	v.options = []jwt.ParserOption{jwt.WithValidMethods(v.methods)}
+	if cfg.Issuer != "" {
+		v.options = append(v.options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if len(cfg.Audience) > 0 {
+		v.options = append(v.options, jwt.WithAudience(cfg.Audience...))
+	}
+	return v, nil
+}
+
+// keysFor returns the keys that may have signed t: the key with the
+// token's kid if one is known, otherwise every key of the right type.
+func (v *jwtVerifier) keysFor(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		set := jwt.VerificationKeySet{}
+		for _, secret := range v.secrets {
+			set.Keys = append(set.Keys, secret)
+		}
+		return set, nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	candidates := v.keys
+	if v.jwks != nil {
+		jwksKeys, err := v.jwks.keys(kid)
+		if err != nil && len(v.keys) == 0 {
+			return nil, err
+		}
+		candidates = append(candidates[:len(candidates):len(candidates)], jwksKeys...)
+	}
+
+	set := jwt.VerificationKeySet{}
+	for _, k := range candidates {
+		if kid != "" && k.kid == kid && matchesMethod(k.key, t.Method) {
+			return k.key, nil
+		}
+	}
+	for _, k := range candidates {
+		if (kid == "" || k.kid == "") && matchesMethod(k.key, t.Method) {
+			set.Keys = append(set.Keys, k.key)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no key for kid %q and method %s", kid, t.Method.Alg())
+	}
+	return set, nil
+}
+
+// matchesMethod reports whether key can verify signatures of method.
+func matchesMethod(key crypto.PublicKey, method jwt.SigningMethod) bool {
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodEd25519:
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+// parsePublicKeys reads the public keys and certificates in a PEM file.
+func parsePublicKeys(data []byte) ([]verificationKey, error) {
+	var keys []verificationKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		keys = append(keys, verificationKey{kid: block.Headers["kid"], key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+	return keys, nil
+}
+
 func validateJWT(tokenStr string) (map[string]interface{}, error) {
 	if tokenStr == "" {
 		return nil, errors.New("empty token")
 	}
-	
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
-	
+
+	token, err := jwt.Parse(tokenStr, jwtKeys.keysFor, jwtKeys.options...)
 	if err != nil || !token.Valid {
 		return nil, fmt.Errorf("invalid token: %w", err)
 	}
-	
+
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
 		return nil, errors.New("invalid claims type")
 	}
-	
+
 	result := make(map[string]interface{})
 	for k, v := range claims {
 		result[k] = v
 	}
 	return result, nil
-}
\ No newline at end of file
+}
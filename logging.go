@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log formats accepted in LOG_FORMAT.
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// setupLogging installs the default slog logger. level is one of debug,
+// info, warn or error and format is json or text; empty values select info
+// and json.
+func setupLogging(level, format string) error {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid log level %q", level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", logFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case logFormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, want %s or %s", format, logFormatJSON, logFormatText)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newConnectionID returns an ID for one WebSocket connection, so log lines
+// of a device can be told apart across reconnects.
+func newConnectionID() string {
+	id, err := randomHex(8)
+	if err != nil {
+		return "unknown"
+	}
+	return id
+}
+
+// logger returns the connection's logger with the room it is in, if any.
+func (c *Client) logger() *slog.Logger {
+	c.mu.RLock()
+	room := c.room
+	c.mu.RUnlock()
+
+	if room == nil {
+		return c.log
+	}
+	return c.log.With("room_id", room.id)
+}
+
+// eventAttrs returns the attributes identifying ev in a log line.
+func eventAttrs(ev Event) []any {
+	attrs := []any{"event_type", ev.Type}
+	if ev.RequestID != "" {
+		attrs = append(attrs, "request_id", ev.RequestID)
+	}
+	return attrs
+}
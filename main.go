@@ -2,49 +2,127 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var jwtSecret []byte
-
 func init() {
 	// .env is OPTIONAL (Render does not use it)
 	_ = godotenv.Load()
 
-	// JWT secret is REQUIRED
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	// LOG_LEVEL is debug, info, warn or error; LOG_FORMAT is json or text
+	if err := setupLogging(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging config: %v\n", err)
+		os.Exit(1)
 	}
-	jwtSecret = []byte(secret)
 }
 
 func main() {
 	// Panic safety
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC recovered in main: %v", r)
+			slog.Error("Panic recovered in main", "panic", r)
 		}
 	}()
 
 	// Render-injected PORT (MANDATORY)
 	port := os.Getenv("PORT")
 	if port == "" {
-		log.Fatal("PORT environment variable is not set (Render injects this automatically)")
+		fatal("PORT environment variable is not set (Render injects this automatically)")
+	}
+
+	// JWT keys are REQUIRED: JWT_SECRET, JWT_PUBLIC_KEY_FILE or JWT_JWKS_URL
+	cfg, err := loadJWTConfig()
+	if err != nil {
+		fatal("Invalid JWT config", "error", err)
+	}
+	if jwtKeys, err = newJWTVerifier(cfg); err != nil {
+		fatal("Invalid JWT config", "error", err)
+	}
+	if jwtKeys.jwks != nil {
+		// Warm the cache; on failure keys are fetched again on demand.
+		_, _ = jwtKeys.jwks.keys("")
+	}
+
+	// EGRESS_POLICIES overrides per-event backpressure, e.g. "battery_update=coalesce"
+	if err := loadEgressPolicies(os.Getenv("EGRESS_POLICIES")); err != nil {
+		fatal("Invalid EGRESS_POLICIES", "error", err)
+	}
+
+	// COMPRESSION_LEVEL (-2 to 9) and COMPRESSION_MIN_SIZE (bytes) tune
+	// permessage-deflate for clients that negotiate it.
+	if err := loadCompressionConfig(os.Getenv("COMPRESSION_LEVEL"), os.Getenv("COMPRESSION_MIN_SIZE")); err != nil {
+		fatal("Invalid compression config", "error", err)
+	}
+
+	// RATE_LIMITS overrides budgets as type=rate:burst, e.g. "upgrade=1:20,*=50:100"
+	if err := loadRateLimits(os.Getenv("RATE_LIMITS")); err != nil {
+		fatal("Invalid RATE_LIMITS", "error", err)
+	}
+	// FORWARDED_FOR_HOPS is the number of proxies in front of the server
+	// whose X-Forwarded-For entries identify the client's IP
+	if hops := os.Getenv("FORWARDED_FOR_HOPS"); hops != "" {
+		n, err := strconv.Atoi(hops)
+		if err != nil || n < 0 {
+			fatal("Invalid FORWARDED_FOR_HOPS", "value", hops)
+		}
+		forwardedForHops = n
+	}
+
+	// ALLOWED_ORIGINS lists the browser origins that may open a socket, e.g.
+	// "https://app.example.com,https://*.example.com"; ORIGIN_POLICY=native
+	// admits only native clients, which send no Origin header.
+	if err := loadOriginPolicy(os.Getenv("ORIGIN_POLICY"), os.Getenv("ALLOWED_ORIGINS")); err != nil {
+		fatal("Invalid origin config", "error", err)
 	}
 
-	manager := NewManager()
+	// OTEL_EXPORTER_OTLP_ENDPOINT (e.g. http://localhost:4318) enables tracing
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+
+	// REDIS_URL is optional; without it this instance runs standalone
+
+	backplane, err := openBackplane(os.Getenv("REDIS_URL"))
+	if err != nil {
+		fatal("Failed to connect to backplane", "error", err)
+	}
+
+	store, err := openRoomStore(os.Getenv("ROOM_STORE_PATH"), backplane)
+	if err != nil {
+		fatal("Failed to open room store", "error", err)
+	}
+	if _, ok := store.(*MemoryRoomStore); ok {
+		slog.Warn("ROOM_STORE_PATH not set, rooms will not survive a restart")
+	}
+
+	manager, err := NewManager(store, backplane)
+	if err != nil {
+		fatal("Failed to create manager", "error", err)
+	}
+	registerManagerMetrics(manager)
 
 	// Routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", manager.serveWs)
+	mux.HandleFunc("/asyncapi.json", manager.serveAsyncAPI)
+	mux.Handle("/metrics", promhttp.Handler())
+	// ADMIN_TOKEN enables the admin API; requests must send it as a bearer token
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		mux.Handle("/admin/", manager.adminHandler(token))
+	} else {
+		slog.Info("ADMIN_TOKEN not set, admin API disabled")
+	}
 	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
@@ -60,9 +138,9 @@ func main() {
 
 	// Start server
 	go func() {
-		log.Printf("WebSocket server starting on :%s", port)
+		slog.Info("WebSocket server starting", "port", port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed: %v", err)
+			fatal("Server failed", "error", err)
 		}
 	}()
 
@@ -71,14 +149,25 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shutdown", "error", err)
 	} else {
-		log.Println("Server exited gracefully")
+		slog.Info("Server exited gracefully")
+	}
+
+	manager.Close()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	if err := store.Close(); err != nil {
+		slog.Error("Failed to close room store", "error", err)
+	}
+	if err := backplane.Close(); err != nil {
+		slog.Error("Failed to close backplane", "error", err)
 	}
 }
@@ -1,58 +1,579 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"strconv"
 	"time"
 
 	"net/http"
 	"sync"
 
 	"github.com/gorilla/websocket"
-)
+	"go.opentelemetry.io/otel/trace"
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+	"echo/protocol"
+)
 
 type Manager struct {
-	mu       sync.RWMutex
-	rooms    map[string]*Room // roomID -> room
-	upgrader websocket.Upgrader
+	mu          sync.RWMutex
+	rooms       map[string]*Room // roomID -> room
+	upgrader    websocket.Upgrader
+	handlers    *HandlerRegistry
+	pairing     *PairingManager
+	store       RoomStore
+	cluster     *Cluster
+	sessions    *SessionStore
+	revocations *RevocationList
+	limiter     *RateLimiter
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func NewManager() *Manager {
-	return &Manager{
+func NewManager(store RoomStore, backplane Backplane) (*Manager, error) {
+	m := &Manager{
 		rooms: make(map[string]*Room),
+		store: store,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
+			CheckOrigin:       func(r *http.Request) bool { return allowedOrigins.check(r) },
+			Subprotocols:      subprotocols(),
+			EnableCompression: true,
 		},
+		handlers: NewHandlerRegistry(),
+		sessions: NewSessionStore(),
+		limiter:  NewRateLimiter(),
+		done:     make(chan struct{}),
+	}
+
+	cluster, err := NewCluster(backplane, m.handleClusterMessage)
+	if err != nil {
+		return nil, fmt.Errorf("create cluster: %w", err)
+	}
+	m.cluster = cluster
+	m.pairing = NewPairingManager(backplane, cluster.nodeID)
+
+	revocations, err := NewRevocationList(backplane, m.enforceRevocation)
+	if err != nil {
+		return nil, fmt.Errorf("create revocation list: %w", err)
+	}
+	m.revocations = revocations
+
+	m.registerHandlers()
+	m.rehydrateRooms()
+	go m.refreshPresence()
+	return m, nil
+}
+
+// Close stops background work and withdraws this instance's clients from
+// the shared presence so other instances stop routing to them.
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.revocations.Close()
+
+		m.mu.RLock()
+		rooms := make([]*Room, 0, len(m.rooms))
+		for _, room := range m.rooms {
+			rooms = append(rooms, room)
+		}
+		m.mu.RUnlock()
+
+		for _, room := range rooms {
+			room.mu.RLock()
+			clients := make([]*Client, 0, len(room.clients))
+			for _, c := range room.clients {
+				clients = append(clients, c)
+			}
+			room.mu.RUnlock()
+
+			for _, c := range clients {
+				m.cluster.withdraw(room.id, c.deviceID, c.deviceType)
+			}
+			m.cluster.detach(room.id)
+		}
+	})
+}
+
+// attachRoom connects a room to the backplane and loads the devices that
+// are already present on other instances.
+func (m *Manager) attachRoom(room *Room) {
+	room.cluster = m.cluster
+	m.cluster.attach(room.id)
+
+	presence := m.cluster.remotePresence(room.id)
+	room.mu.Lock()
+	for deviceID, entry := range presence {
+		room.remote[deviceID] = remotePeer{node: entry.Node, deviceType: entry.DeviceType, seenAt: entry.UpdatedAt}
+	}
+	room.mu.Unlock()
+}
+
+// refreshPresence periodically re-announces local clients so their presence
+// entries do not go stale on other instances.
+func (m *Manager) refreshPresence() {
+	ticker := time.NewTicker(presenceRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.mu.RLock()
+			rooms := make([]*Room, 0, len(m.rooms))
+			for _, room := range m.rooms {
+				rooms = append(rooms, room)
+			}
+			m.mu.RUnlock()
+
+			for _, room := range rooms {
+				room.mu.RLock()
+				clients := make([]*Client, 0, len(room.clients))
+				for _, c := range room.clients {
+					clients = append(clients, c)
+				}
+				room.mu.RUnlock()
+
+				for _, c := range clients {
+					m.cluster.announce(room.id, c.deviceID, c.deviceType)
+				}
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// handleClusterMessage applies a message published by another instance to
+// the local copy of the room.
+func (m *Manager) handleClusterMessage(msg clusterMessage) {
+	m.mu.RLock()
+	room, exists := m.rooms[msg.RoomID]
+	m.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	switch msg.Kind {
+	case clusterMsgBroadcast:
+		if msg.Event == nil {
+			return
+		}
+		ev := *msg.Event
+		base, hasBase := room.cacheEvent(&ev)
+		room.mu.RLock()
+		if _, ok := telemetryIntervals[ev.Type]; ok {
+			room.broadcastTelemetryLocked(msg.Exclude, ev, base, hasBase)
+		} else {
+			room.broadcastExceptLocked(msg.Exclude, ev)
+		}
+		room.mu.RUnlock()
+
+	case clusterMsgDirect:
+		if msg.Event == nil {
+			return
+		}
+		if c := room.localClient(msg.DeviceID); c != nil {
+			c.send(*msg.Event)
+		}
+
+	case clusterMsgResponse:
+		if msg.Event != nil {
+			room.fulfillLocal(*msg.Event)
+		}
+
+	case clusterMsgPresence:
+		if msg.Present && room.localClient(msg.DeviceID) != nil {
+			// The device reconnected to another instance; drop our stale connection.
+			slog.Info("Device moved to another node, closing local connection", "device_id", msg.DeviceID, "room_id", room.id, "node", msg.Node)
+			room.evict(msg.DeviceID)
+		}
+		room.updateRemote(msg.DeviceID, msg.DeviceType, msg.Node, msg.Present)
+		if msg.Present {
+			room.forwardOutbox(msg.DeviceID)
+		}
+
+	case clusterMsgPairing:
+		if watch, ok := m.pairing.takeLocalPending(room.id, msg.DeviceID); ok {
+			m.completePairing(room, watch, msg.Approved)
+		}
+
+	case clusterMsgClose:
+		m.closeRoom(room)
+	}
+}
+
+// rehydrateRooms restores persisted rooms as dormant rooms so owners and
+// paired watches can reconnect after a restart.
+func (m *Manager) rehydrateRooms() {
+	records, err := m.store.LoadRooms()
+	if err != nil {
+		slog.Error("Failed to load rooms from store", "error", err)
+		return
 	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range records {
+		room := restoreRoom(rec)
+		m.attachRoom(room)
+		m.rooms[rec.ID] = room
+	}
+	slog.Info("Restored rooms from store", "rooms", len(records))
+}
+
+// persistRoom saves the room's owner and pairings to the store.
+func (m *Manager) persistRoom(room *Room) {
+	if err := m.store.SaveRoom(room.record()); err != nil {
+		slog.Error("Failed to persist room", "room_id", room.id, "error", err)
+	}
+}
+
+// registerHandlers wires every inbound event type to its handler.
+func (m *Manager) registerHandlers() {
+	// since maps cache keys to the version the client already has.
+	sinceField := FieldSchema{Name: "since", Type: FieldObject, MaxItems: 16,
+		Values: &FieldSchema{Type: FieldInteger, Min: bound(0)}}
+
+	joinRoomSchema := &PayloadSchema{Fields: []FieldSchema{
+		{Name: "room_id", Type: FieldString, Required: true, MaxLength: 64},
+		sinceField,
+	}}
+	createRoomSchema := &PayloadSchema{Fields: []FieldSchema{
+		{Name: "room_id", Type: FieldString, MaxLength: 64},
+	}}
+	// Results and responses are opaque to the server and only bounded in
+	// size.
+	resultSchema := &PayloadSchema{Type: FieldAny, MaxSize: 256 * 1024}
+
+	m.handlers.Register(EventHandler{
+		Type: EventHello,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "protocol_version", Type: FieldInteger, Required: true},
+			{Name: "features", Type: FieldArray, MaxItems: 32,
+				Items: &FieldSchema{Type: FieldString, MaxLength: 64}},
+			{Name: "encodings", Type: FieldArray, MaxItems: 8,
+				Items: &FieldSchema{Type: FieldString, MaxLength: 32}},
+			{Name: "compression_min_size", Type: FieldInteger, Min: bound(0)},
+		}},
+		Handle:  m.handleHello,
+		Summary: "Negotiates the protocol version, features and wire encoding",
+		Replies: []string{EventWelcome},
+	})
+	m.handlers.Register(EventHandler{
+		Type:    EventRoomStatus,
+		Schema:  &PayloadSchema{},
+		Handle:  m.handleRoomStatus,
+		Summary: "Asks whether the device is in a room",
+		Replies: []string{EventResponse},
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventCreateRoom,
+		DeviceTypes: []string{DeviceTypeMac},
+		Schema:      createRoomSchema,
+		Handle:      m.handleCreateRoom,
+		Summary:     "Creates a room owned by the Mac, or rejoins it",
+		Replies:     []string{EventRoomJoined},
+	})
+	m.handlers.Register(EventHandler{
+		Type:    EventJoinRoom,
+		Schema:  joinRoomSchema,
+		Handle:  m.handleJoinRoom,
+		Summary: "Joins a room, receiving its cached data",
+		Replies: []string{EventRoomJoined, EventSyncResult},
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventDeviceInfo,
+		DeviceTypes: []string{DeviceTypeMac},
+		Room:        RoomIgnore,
+		Schema: &PayloadSchema{MaxSize: 16 * 1024, Fields: []FieldSchema{
+			{Name: "name", Type: FieldString, MaxLength: 256},
+			{Name: "model", Type: FieldString, MaxLength: 256},
+		}},
+		Handle:  m.handleDeviceInfo,
+		Summary: "Describes the Mac",
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventBatteryUpdate,
+		Room: RoomIgnore,
+		Schema: &PayloadSchema{MaxSize: 1024, Fields: []FieldSchema{
+			{Name: "percent", Type: FieldNumber, Required: true,
+				Min: bound(protocol.MinBatteryPercent), Max: bound(protocol.MaxBatteryPercent)},
+			{Name: "is_charging", Type: FieldBoolean},
+		}},
+		Handle:  m.handleBatteryUpdate,
+		Summary: "Reports the battery level, throttled per room",
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventStorageUpdate,
+		Room: RoomIgnore,
+		Schema: &PayloadSchema{MaxSize: 1024, Fields: []FieldSchema{
+			{Name: "total_bytes", Type: FieldInteger, Required: true, Min: bound(0)},
+			{Name: "available_bytes", Type: FieldInteger, Required: true, Min: bound(0)},
+		}},
+		Handle:  m.handleStorageUpdate,
+		Summary: "Reports disk usage, throttled per room",
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventDownloadsUpdate,
+		Room: RoomIgnore,
+		Schema: &PayloadSchema{MaxSize: 64 * 1024, Fields: []FieldSchema{
+			{Name: "downloads", Type: FieldArray, Required: true, MaxItems: protocol.MaxDownloads,
+				Items: &FieldSchema{Type: FieldObject, Fields: []FieldSchema{
+					{Name: "name", Type: FieldString, Required: true, MaxLength: 512},
+					{Name: "progress", Type: FieldNumber, Required: true,
+						Min: bound(protocol.MinProgress), Max: bound(protocol.MaxProgress)},
+				}}},
+		}},
+		Handle:  m.handleDownloadsUpdate,
+		Summary: "Reports active downloads, throttled per room",
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventActionRequest,
+		DeviceTypes: []string{DeviceTypeWatch},
+		Room:        RoomRequired,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "action", Type: FieldString, Required: true, Enum: protocol.DeviceActions},
+		}},
+		Handle:  m.handleActionRequest,
+		Summary: "Asks the Mac to run a device action",
+		Replies: []string{EventActionResult},
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventMediaAction,
+		DeviceTypes: []string{DeviceTypeWatch},
+		Room:        RoomRequired,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "action", Type: FieldString, Required: true, Enum: protocol.MediaActions},
+		}},
+		Handle:  m.handleMediaAction,
+		Summary: "Asks the Mac to control media playback",
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventActionResult,
+		DeviceTypes: []string{DeviceTypeMac},
+		Room:        RoomRequired,
+		Schema:      resultSchema,
+		Handle:      m.handleActionResult,
+		Summary:     "Answers an action_request with the same request_id",
+		Relay:       true,
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventRequest,
+		Room: RoomRequired,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "action", Type: FieldString, MaxLength: 64},
+		}},
+		Handle:  m.handleGenericRequest,
+		Summary: "Asks the other device, or the server's cache, for data",
+		Replies: []string{EventResponse},
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type:    EventResponse,
+		Room:    RoomRequired,
+		Schema:  resultSchema,
+		Handle:  m.handleResponse,
+		Summary: "Answers a request with the same request_id",
+		Relay:   true,
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventPairingRequest,
+		DeviceTypes: []string{DeviceTypeMac},
+		Room:        RoomRequired,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "mode", Type: FieldString, Enum: []string{PairingModePIN, PairingModeQR}},
+		}},
+		Handle:  m.handlePairingRequest,
+		Summary: "Issues a pairing code for the Mac's room",
+		Replies: []string{EventPairingCode},
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventPairingRedeem,
+		DeviceTypes: []string{DeviceTypeWatch},
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "code", Type: FieldString, Required: true, MaxLength: 64},
+		}},
+		Handle:  m.handlePairingRedeem,
+		Summary: "Redeems a pairing code; the Mac is asked to approve",
+		Replies: []string{EventPairingPending},
+	})
+	m.handlers.Register(EventHandler{
+		Type:        EventPairingDecision,
+		DeviceTypes: []string{DeviceTypeMac},
+		Room:        RoomRequired,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "device_id", Type: FieldString, Required: true, MaxLength: 128},
+			{Name: "approved", Type: FieldBoolean, Required: true},
+		}},
+		Handle:  m.handlePairingDecision,
+		Summary: "Approves or rejects a watch awaiting pairing",
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventSync,
+		Room: RoomRequired,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			sinceField,
+		}},
+		Handle:  m.handleSync,
+		Summary: "Asks for the cache entries that changed since the given versions",
+		Replies: []string{EventSyncResult},
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventAck,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "seq", Type: FieldInteger, Required: true, Min: bound(0)},
+		}},
+		Handle:  m.handleAck,
+		Summary: "Acknowledges the events up to seq",
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventResume,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "resume_token", Type: FieldString, Required: true, MaxLength: 128},
+			{Name: "last_seq", Type: FieldInteger, Required: true, Min: bound(0)},
+		}},
+		Handle:  m.handleResume,
+		Summary: "Moves a previous session onto this connection",
+		Replies: []string{EventResumed},
+	})
+	m.handlers.Register(EventHandler{
+		Type: EventRefreshToken,
+		Schema: &PayloadSchema{Fields: []FieldSchema{
+			{Name: "token", Type: FieldString, Required: true, MaxLength: 8 * 1024},
+		}},
+		Handle:  m.handleRefreshToken,
+		Summary: "Replaces the connection's token without reconnecting",
+		Replies: []string{EventTokenRefreshed},
+	})
 }
 
-func (m *Manager) createRoom(roomID, macID string) *Room {
+// createRoom creates a room owned by macID under a server-generated ID.
+func (m *Manager) createRoom(macID string) (*Room, error) {
+	roomID, err := randomHex(16)
+	if err != nil {
+		return nil, fmt.Errorf("generate room id: %w", err)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	room := NewRoom(roomID, macID)
+	if err := m.store.SaveRoom(room.record()); err != nil {
+		return nil, fmt.Errorf("persist room: %w", err)
+	}
+	m.attachRoom(room)
 	m.rooms[roomID] = room
-	log.Printf("Room created: id=%s mac_id=%s", roomID, macID)
+	slog.Info("Room created", "room_id", roomID, "mac_id", macID)
+	return room, nil
+}
+
+// lookupRoom returns a room whether or not it is active. Rooms created on
+// another instance are loaded from the store on first use.
+func (m *Manager) lookupRoom(roomID string) (*Room, bool) {
+	m.mu.RLock()
+	room, exists := m.rooms[roomID]
+	m.mu.RUnlock()
+	if exists {
+		return room, true
+	}
+
+	rec, err := m.store.LoadRoom(roomID)
+	if err != nil {
+		if !errors.Is(err, ErrRoomNotFound) {
+			slog.Error("Failed to load room from store", "room_id", roomID, "error", err)
+		}
+		return nil, false
+	}
+	return m.adoptRoom(rec), true
+}
+
+// adoptRoom installs a room loaded from the store unless another goroutine
+// beat us to it.
+func (m *Manager) adoptRoom(rec RoomRecord) *Room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if room, exists := m.rooms[rec.ID]; exists {
+		return room
+	}
+	room := restoreRoom(rec)
+	m.attachRoom(room)
+	m.rooms[rec.ID] = room
 	return room
 }
 
-func (m *Manager) getRoom(roomID string) (*Room, bool) {
+// reloadRoom refreshes a room's pairings from the store, picking up watches
+// paired through another instance.
+func (m *Manager) reloadRoom(room *Room) {
+	rec, err := m.store.LoadRoom(room.id)
+	if err != nil {
+		return
+	}
+	room.mu.Lock()
+	for _, deviceID := range rec.Authorized {
+		room.authorized[deviceID] = true
+	}
+	room.mu.Unlock()
+}
+
+// roomOwnedBy returns the room owned by macID, if any.
+func (m *Manager) roomOwnedBy(macID string) (*Room, bool) {
+	m.mu.RLock()
+	for _, room := range m.rooms {
+		room.mu.RLock()
+		owner := room.macID
+		room.mu.RUnlock()
+		if owner == macID {
+			m.mu.RUnlock()
+			return room, true
+		}
+	}
+	m.mu.RUnlock()
+
+	records, err := m.store.LoadRooms()
+	if err != nil {
+		slog.Error("Failed to load rooms from store", "error", err)
+		return nil, false
+	}
+	for _, rec := range records {
+		if rec.MacID == macID {
+			return m.adoptRoom(rec), true
+		}
+	}
+	return nil, false
+}
+
+// activeRoomCount returns the number of rooms whose Mac is connected.
+func (m *Manager) activeRoomCount() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	room, exists := m.rooms[roomID]
-	if exists && !room.isActive {
+	n := 0
+	for _, room := range m.rooms {
+		if room.active() {
+			n++
+		}
+	}
+	return n
+}
+
+// getRoom returns a room only while its owner Mac is connected somewhere.
+func (m *Manager) getRoom(roomID string) (*Room, bool) {
+	room, exists := m.lookupRoom(roomID)
+	if !exists || !room.active() {
 		return nil, false
 	}
-	return room, exists
+	return room, true
 }
 
 func (m *Manager) removeClient(c *Client) {
@@ -62,7 +583,7 @@ func (m *Manager) removeClient(c *Client) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC recovered in removeClient for device %s: %v", c.deviceID, r)
+			c.logger().Error("Panic recovered in removeClient", "panic", r)
 		}
 	}()
 
@@ -74,39 +595,57 @@ func (m *Manager) removeClient(c *Client) {
 		room.removeClient(c)
 
 		// Clean up empty or inactive rooms
-		m.mu.Lock()
 		room.mu.RLock()
 		clientCount := len(room.clients)
-		isActive := room.isActive
 		roomID := room.id
 		room.mu.RUnlock()
+		isActive := room.active()
 
 		if clientCount == 0 || !isActive {
-			delete(m.rooms, roomID)
-			log.Printf("Room %s cleaned up (clients: %d, active: %v)", roomID, clientCount, isActive)
+			m.reloadRoom(room)
+			if room.hasPairings() {
+				// Keep paired rooms around so the owner Mac can rejoin
+				// without re-pairing its watches.
+				slog.Info("Room dormant", "room_id", roomID, "clients", clientCount, "active", isActive)
+			} else {
+				m.mu.Lock()
+				delete(m.rooms, roomID)
+				m.mu.Unlock()
+				m.cluster.detach(roomID)
+				room.stopTelemetry()
+
+				// Other instances may still be serving this room.
+				if len(m.cluster.remotePresence(roomID)) == 0 {
+					m.pairing.revokeRoom(roomID)
+					if err := m.store.DeleteRoom(roomID); err != nil {
+						slog.Error("Failed to delete room from store", "room_id", roomID, "error", err)
+					}
+				}
+				slog.Info("Room cleaned up", "room_id", roomID, "clients", clientCount, "active", isActive)
+			}
 		}
-		m.mu.Unlock()
 	}
 
-	log.Printf("Client %s (%s) removed from manager", c.deviceID, c.deviceType)
+	c.logger().Info("Client removed from manager")
 }
 
 // Event handlers
 func (m *Manager) handleCreateRoom(ev Event, c *Client) error {
-	var payload struct {
-		RoomID string `json:"room_id"`
-	}
+	var payload protocol.CreateRoom
 
 	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
 		return fmt.Errorf("invalid payload: %w", err)
 	}
 
-	if c.deviceType != DeviceTypeMac {
-		return errors.New("only Mac devices can create rooms")
+	// Room IDs are generated by the server. A room_id in the payload is only
+	// used by the owner to rejoin a room it created earlier.
+	var existingRoom *Room
+	var exists bool
+	if payload.RoomID != "" {
+		existingRoom, exists = m.lookupRoom(payload.RoomID)
+	} else {
+		existingRoom, exists = m.roomOwnedBy(c.deviceID)
 	}
-
-	// Check if room already exists
-	existingRoom, exists := m.getRoom(payload.RoomID)
 	if exists {
 		// If room exists and this Mac is the owner, just add the client to the room
 		existingRoom.mu.RLock()
@@ -115,7 +654,7 @@ func (m *Manager) handleCreateRoom(ev Event, c *Client) error {
 		existingRoom.mu.RUnlock()
 		
 		if isOwner {
-			log.Printf("Device %s (%s) rejoining existing room %s", c.deviceID, c.deviceType, payload.RoomID)
+			c.logger().Info("Device rejoining existing room", "room_id", roomID)
 			
 			// Reactivate room if it was deactivated
 			existingRoom.mu.Lock()
@@ -125,17 +664,18 @@ func (m *Manager) handleCreateRoom(ev Event, c *Client) error {
 			existingRoom.addClient(c)
 			
 			// Check if watch is already connected
-			watchConnected := existingRoom.getPeer(DeviceTypeWatch) != nil
-			statusPayload := fmt.Sprintf(`{"in_room":true,"watch_connected":%t}`, watchConnected)
+			watchConnected := existingRoom.hasPeer(DeviceTypeWatch)
+			statusPayload := protocol.EncodePayload(protocol.StatusUpdate{InRoom: true, WatchConnected: watchConnected})
 			
 			// Immediately inform Mac of status after rejoining
-			c.send(Event{Type: EventStatusUpdate, RoomID: roomID, Timestamp: time.Now(), Payload: []byte(statusPayload)})
+			c.send(Event{Type: EventStatusUpdate, RoomID: roomID, Timestamp: time.Now(), Payload: statusPayload})
 			
 			c.send(Event{
 				Type:      EventRoomJoined,
 				RoomID:    roomID,
+				RequestID: ev.RequestID,
 				Timestamp: time.Now(),
-				Payload:   []byte(fmt.Sprintf(`{"status":"rejoined","role":"host"}`)),
+				Payload:   protocol.EncodePayload(protocol.RoomJoined{Status: protocol.RoomStatusRejoined, Role: protocol.RoleHost}),
 			})
 			return nil
 		}
@@ -143,28 +683,30 @@ func (m *Manager) handleCreateRoom(ev Event, c *Client) error {
 	}
 
 	// Log which device is creating the room
-	log.Printf("Device %s (%s) creating room %s", c.deviceID, c.deviceType, payload.RoomID)
+	c.logger().Info("Device creating room")
 
-	room := m.createRoom(payload.RoomID, c.deviceID)
+	room, err := m.createRoom(c.deviceID)
+	if err != nil {
+		return err
+	}
 	room.addClient(c)
 
 	// Immediately inform Mac of status after room creation
-	c.send(Event{Type: EventStatusUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: []byte(`{"in_room":true,"watch_connected":false}`)})
+	c.send(Event{Type: EventStatusUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: protocol.EncodePayload(protocol.StatusUpdate{InRoom: true})})
 
 	c.send(Event{
 		Type:      EventRoomJoined,
 		RoomID:    room.id,
+		RequestID: ev.RequestID,
 		Timestamp: time.Now(),
-		Payload:   []byte(fmt.Sprintf(`{"status":"created","role":"host"}`)),
+		Payload:   protocol.EncodePayload(protocol.RoomJoined{Status: protocol.RoomStatusCreated, Role: protocol.RoleHost}),
 	})
 
 	return nil
 }
 
 func (m *Manager) handleJoinRoom(ev Event, c *Client) error {
-	var payload struct {
-		RoomID string `json:"room_id"`
-	}
+	var payload protocol.JoinRoom
 
 	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
 		return fmt.Errorf("invalid payload: %w", err)
@@ -175,28 +717,51 @@ func (m *Manager) handleJoinRoom(ev Event, c *Client) error {
 		return errors.New("room not found or inactive")
 	}
 
+	// Watches must have been paired through the pairing flow; a Mac may
+	// only join the room it owns.
+	switch c.deviceType {
+	case DeviceTypeWatch:
+		if !room.isAuthorized(c.deviceID) {
+			// The watch may have been paired through another instance.
+			m.reloadRoom(room)
+		}
+		if !room.isAuthorized(c.deviceID) {
+			return newRouteError(ErrCodeNotAuthorized, "device is not paired with this room")
+		}
+	case DeviceTypeMac:
+		room.mu.RLock()
+		isOwner := room.macID == c.deviceID
+		room.mu.RUnlock()
+		if !isOwner {
+			return newRouteError(ErrCodeNotAuthorized, "only the room owner can join as Mac")
+		}
+	}
+
 	// Check device limits (1 Mac, multiple watches possible but typically 1)
-	if c.deviceType == DeviceTypeMac && room.getPeer(DeviceTypeMac) != nil {
+	if c.deviceType == DeviceTypeMac && room.hasPeer(DeviceTypeMac) {
 		return errors.New("room already has a Mac device")
 	}
 
 	room.addClient(c)
 
 	// Send cached data to new client if available
-	m.sendCachedData(c, room)
+	if payload.Since != nil {
+		m.sendSync(c, room, payload.Since, ev.RequestID)
+	} else {
+		m.sendCachedData(c, room)
+	}
 
 	c.send(Event{
 		Type:      EventRoomJoined,
 		RoomID:    room.id,
+		RequestID: ev.RequestID,
 		Timestamp: time.Now(),
-		Payload:   []byte(fmt.Sprintf(`{"status":"joined","role":"client"}`)),
+		Payload:   protocol.EncodePayload(protocol.RoomJoined{Status: protocol.RoomStatusJoined, Role: protocol.RoleClient}),
 	})
 
 	// If a watch joined, notify Mac about watch connection status
 	if c.deviceType == DeviceTypeWatch {
-		if mac := room.getPeer(DeviceTypeMac); mac != nil {
-			mac.send(Event{Type: EventStatusUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: []byte(`{"in_room":true,"watch_connected":true}`)})
-		}
+		room.sendToPeer(DeviceTypeMac, Event{Type: EventStatusUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: protocol.EncodePayload(protocol.StatusUpdate{InRoom: true, WatchConnected: true})})
 	}
 
 	return nil
@@ -206,57 +771,44 @@ func (m *Manager) sendCachedData(c *Client, room *Room) {
 
 	if c.deviceType == DeviceTypeWatch {
 
-		if data, ok := room.cache.Get("device_info"); ok {
-			c.send(Event{Type: EventDeviceInfo, RoomID: room.id, Timestamp: time.Now(), Payload: data})
+		if data, version, ok := room.cache.GetVersion("device_info"); ok {
+			c.send(Event{Type: EventDeviceInfo, RoomID: room.id, Version: version, Timestamp: time.Now(), Payload: data})
 		}
-		if data, ok := room.cache.Get("battery"); ok {
-			c.send(Event{Type: EventBatteryUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: data})
+		if data, version, ok := room.cache.GetVersion("battery"); ok {
+			c.send(Event{Type: EventBatteryUpdate, RoomID: room.id, Version: version, Timestamp: time.Now(), Payload: data})
 		}
-		if data, ok := room.cache.Get("storage"); ok {
-			c.send(Event{Type: EventStorageUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: data})
+		if data, version, ok := room.cache.GetVersion("storage"); ok {
+			c.send(Event{Type: EventStorageUpdate, RoomID: room.id, Version: version, Timestamp: time.Now(), Payload: data})
 		}
-		if data, ok := room.cache.Get("downloads"); ok {
-			c.send(Event{Type: EventDownloadsUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: data})
+		if data, version, ok := room.cache.GetVersion("downloads"); ok {
+			c.send(Event{Type: EventDownloadsUpdate, RoomID: room.id, Version: version, Timestamp: time.Now(), Payload: data})
 		}
 	}
 }
 
 func (m *Manager) handleDeviceInfo(ev Event, c *Client) error {
-	if c.room == nil {
-		// Silently ignore if not in a room - client may send this before joining
-		return nil
-	}
-
-	// Only Mac can send device info
-	if c.deviceType != DeviceTypeMac {
-		return errors.New("only Mac devices can send device info")
-	}
-
-	// Cache with long TTL (static data)
-	c.room.cache.Set("device_info", ev.Payload, 24*time.Hour)
-
-	// Broadcast to watches
-	c.room.broadcastExcept(c.deviceID, Event{
+	info := Event{
 		Type:      EventDeviceInfo,
 		RoomID:    c.room.id,
 		DeviceID:  c.deviceID,
 		Timestamp: time.Now(),
 		Payload:   ev.Payload,
-	})
+	}
+	// Cache with long TTL (static data)
+	c.room.cacheEvent(&info)
+
+	// Broadcast to watches
+	c.room.broadcastExcept(c.deviceID, info)
 
 	return nil
 }
 
 func (m *Manager) handleBatteryUpdate(ev Event, c *Client) error {
-	if c.room == nil {
-		// Silently ignore if not in a room - client may send this before joining
-		return nil
+	if err := decodePayload(ev, &protocol.BatteryStatus{}); err != nil {
+		return err
 	}
-
-	// Cache with short TTL (dynamic data)
-	c.room.cache.Set("battery", ev.Payload, batteryTTL)
-
-	c.room.broadcastExcept(c.deviceID, Event{
+	// Throttled per room; cached when actually broadcast
+	c.room.publishTelemetry(Event{
 		Type:      EventBatteryUpdate,
 		RoomID:    c.room.id,
 		DeviceID:  c.deviceID,
@@ -268,15 +820,11 @@ func (m *Manager) handleBatteryUpdate(ev Event, c *Client) error {
 }
 
 func (m *Manager) handleStorageUpdate(ev Event, c *Client) error {
-	if c.room == nil {
-		// Silently ignore if not in a room - client may send this before joining
-		return nil
+	if err := decodePayload(ev, &protocol.StorageStatus{}); err != nil {
+		return err
 	}
-
-	// Cache with medium TTL (semi-dynamic data)
-	c.room.cache.Set("storage", ev.Payload, cacheTTL)
-
-	c.room.broadcastExcept(c.deviceID, Event{
+	// Throttled per room; cached when actually broadcast
+	c.room.publishTelemetry(Event{
 		Type:      EventStorageUpdate,
 		RoomID:    c.room.id,
 		DeviceID:  c.deviceID,
@@ -288,15 +836,11 @@ func (m *Manager) handleStorageUpdate(ev Event, c *Client) error {
 }
 
 func (m *Manager) handleDownloadsUpdate(ev Event, c *Client) error {
-	if c.room == nil {
-		// Silently ignore if not in a room - client may send this before joining
-		return nil
+	if err := decodePayload(ev, &protocol.DownloadsList{}); err != nil {
+		return err
 	}
-
-	// Cache with short TTL (dynamic data)
-	c.room.cache.Set("downloads", ev.Payload, downloadsTTL)
-
-	c.room.broadcastExcept(c.deviceID, Event{
+	// Throttled per room; cached when actually broadcast
+	c.room.publishTelemetry(Event{
 		Type:      EventDownloadsUpdate,
 		RoomID:    c.room.id,
 		DeviceID:  c.deviceID,
@@ -307,34 +851,10 @@ func (m *Manager) handleDownloadsUpdate(ev Event, c *Client) error {
 	return nil
 }
 func (m *Manager) handleMediaAction(ev Event, c *Client) error {
-	if c.room == nil {
-		return errors.New("not in a room")
-	}
-
-	// Only Watch can request media actions
-	if c.deviceType != DeviceTypeWatch {
-		return errors.New("only Watch devices can request media actions")
-	}
-	var payload struct {
-		Action string `json:"action"`
-	}
-	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
-		return fmt.Errorf("invalid payload: %w", err)
-	}
-	// Validate media actions (case-insensitive check)
-	validActions := map[string]bool{
-		"play": true, "pause": true, "volup": true, "voldown": true,
-		"next": true, "prev": true, "volumeup": true, "volumedown": true,
+	if err := decodePayload(ev, &protocol.MediaAction{}); err != nil {
+		return err
 	}
-	if !validActions[payload.Action] {
-		return errors.New("invalid media action")
-	}
-	mac := c.room.getPeer(DeviceTypeMac)
-	if mac == nil {
-		c.sendError(ev.RequestID, "mac_unavailable", "Mac device not connected")
-		return nil
-	}
-	mac.send(Event{
+	sent := c.room.forwardToPeer(traceContext(context.Background(), ev), c, DeviceTypeMac, Event{
 		Type:      EventMediaAction,
 		RoomID:    c.room.id,
 		DeviceID:  c.deviceID,
@@ -342,44 +862,30 @@ func (m *Manager) handleMediaAction(ev Event, c *Client) error {
 		Timestamp: time.Now(),
 		Payload:   ev.Payload,
 	})
+	if !sent {
+		c.sendError(ev.RequestID, ErrCodeMacUnavailable, "Mac device not connected")
+	}
 	return nil
 }
 func (m *Manager) handleActionRequest(ev Event, c *Client) error {
-	if c.room == nil {
-		return errors.New("not in a room")
-	}
-
-	// Only Watch can request actions
-	if c.deviceType != DeviceTypeWatch {
-		return errors.New("only Watch devices can request actions")
-	}
-
-	var payload struct {
-		Action string `json:"action"`
-	}
-
-	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
-		return fmt.Errorf("invalid payload: %w", err)
-	}
-
-	// Validate action
-	if payload.Action != "shutdown" && payload.Action != "sleep" {
-		return errors.New("invalid action")
+	if err := decodePayload(ev, &protocol.Action{}); err != nil {
+		return err
 	}
 
 	// Forward to Mac
-	mac := c.room.getPeer(DeviceTypeMac)
-	if mac == nil {
-		c.sendError(ev.RequestID, "mac_unavailable", "Mac device not connected")
+	if !c.room.hasPeer(DeviceTypeMac) {
+		c.sendError(ev.RequestID, ErrCodeMacUnavailable, "Mac device not connected")
 		return nil
 	}
 
+	ctx := traceContext(context.Background(), ev)
+
 	// Create response waiter if request ID provided
 	if ev.RequestID != "" {
-		respCh := c.room.waitForResponse(ev.RequestID)
+		respCh := c.room.waitForResponse(ev.RequestID, ev.Type)
 
 		// Forward to Mac
-		mac.send(Event{
+		c.room.forwardToPeer(ctx, c, DeviceTypeMac, Event{
 			Type:      EventActionRequest,
 			RoomID:    c.room.id,
 			DeviceID:  c.deviceID,
@@ -387,35 +893,46 @@ func (m *Manager) handleActionRequest(ev Event, c *Client) error {
 			Timestamp: time.Now(),
 			Payload:   ev.Payload,
 		})
+		_, wait := startEventSpan(ctx, "await_response", ev, c, trace.SpanKindInternal)
 
 		// Wait for response
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("PANIC recovered in handleActionRequest goroutine: %v", r)
+					c.logger().Error("Panic recovered in handleActionRequest goroutine", append(eventAttrs(ev), "panic", r)...)
 				}
 			}()
 
 			select {
 			case resp, ok := <-respCh:
-				if ok && c != nil {
-					c.send(Event{
+				if !ok {
+					endSpan(wait, errPeerDisconnected)
+					return
+				}
+				wait.End()
+				if c != nil {
+					dctx, deliver := startDeliverSpan(ctx, resp, c)
+					c.send(withTrace(dctx, Event{
 						Type:      EventActionResult,
 						RequestID: resp.RequestID,
 						RoomID:    c.room.id,
 						Timestamp: time.Now(),
 						Payload:   resp.Payload,
-					})
+					}))
+					deliver.End()
 				}
 			case <-time.After(requestTimeout):
+				endSpan(wait, errRequestTimeout)
+				c.logger().Warn("Request timed out", eventAttrs(ev)...)
+				requestTimeouts.WithLabelValues(ev.Type).Inc()
 				if c != nil {
-					c.sendError(ev.RequestID, "timeout", "Mac did not respond in time")
+					c.sendError(ev.RequestID, ErrCodeTimeout, "Mac did not respond in time")
 				}
 			}
 		}()
 	} else {
 		// Fire and forget
-		mac.send(Event{
+		c.room.forwardToPeer(ctx, c, DeviceTypeMac, Event{
 			Type:      EventActionRequest,
 			RoomID:    c.room.id,
 			DeviceID:  c.deviceID,
@@ -428,52 +945,30 @@ func (m *Manager) handleActionRequest(ev Event, c *Client) error {
 }
 
 func (m *Manager) handleActionResult(ev Event, c *Client) error {
-	if c.room == nil {
-		return errors.New("not in a room")
-	}
-
-	// Only Mac can send action results
-	if c.deviceType != DeviceTypeMac {
-		return errors.New("only Mac devices can send action results")
-	}
-
 	// Fulfill pending response
 	c.room.fulfillResponse(ev)
 	return nil
 }
 
-func (m *Manager) handleRoomStatus(_ Event, c *Client) error {
-
-	if c.room == nil {
-		c.send(Event{
-			Type:      EventResponse,
-			Timestamp: time.Now(),
-			Payload:   []byte(`{"status":"false"}`),
-		})
-	} else {
-		c.send(Event{
-			Type:      EventResponse,
-			Timestamp: time.Now(),
-			Payload:   []byte(`{"status":"true"}`),
-		})
-	}
-
+func (m *Manager) handleRoomStatus(ev Event, c *Client) error {
+	c.send(Event{
+		Type:      EventResponse,
+		RequestID: ev.RequestID,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.RoomStatusResponse{Status: strconv.FormatBool(c.room != nil)}),
+	})
 	return nil
 
 }
 func (m *Manager) handleGenericRequest(ev Event, c *Client) error {
-	if c.room == nil {
-		return errors.New("not in a room")
-	}
-
 	if ev.RequestID == "" {
 		return errors.New("missing request_id")
 	}
 
-	var payload struct {
-		Action string `json:"action"`
+	var payload protocol.Request
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
 	}
-	json.Unmarshal(ev.Payload, &payload)
 
 	// Try cache first for certain requests
 	switch payload.Action {
@@ -502,42 +997,52 @@ func (m *Manager) handleGenericRequest(ev Event, c *Client) error {
 	}
 
 	// Forward to appropriate peer
-	var target *Client
+	targetType := DeviceTypeWatch
 	if c.deviceType == DeviceTypeWatch {
-		target = c.room.getPeer(DeviceTypeMac)
-	} else {
-		target = c.room.getPeer(DeviceTypeWatch)
+		targetType = DeviceTypeMac
 	}
 
-	if target == nil {
-		c.sendError(ev.RequestID, "peer_unavailable", "Target device not connected")
+	if !c.room.hasPeer(targetType) {
+		c.sendError(ev.RequestID, ErrCodePeerUnavailable, "Target device not connected")
 		return nil
 	}
 
-	respCh := c.room.waitForResponse(ev.RequestID)
-	target.send(ev)
+	ctx := traceContext(context.Background(), ev)
+	respCh := c.room.waitForResponse(ev.RequestID, ev.Type)
+	c.room.forwardToPeer(ctx, c, targetType, ev)
+	_, wait := startEventSpan(ctx, "await_response", ev, c, trace.SpanKindInternal)
 
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("PANIC recovered in handleGenericRequest goroutine: %v", r)
+				c.logger().Error("Panic recovered in handleGenericRequest goroutine", append(eventAttrs(ev), "panic", r)...)
 			}
 		}()
 
 		select {
 		case resp, ok := <-respCh:
-			if ok && c != nil && c.room != nil {
-				c.send(Event{
+			if !ok {
+				endSpan(wait, errPeerDisconnected)
+				return
+			}
+			wait.End()
+			if c != nil && c.room != nil {
+				dctx, deliver := startDeliverSpan(ctx, resp, c)
+				c.send(withTrace(dctx, Event{
 					Type:      EventResponse,
 					RequestID: resp.RequestID,
 					RoomID:    c.room.id,
 					Timestamp: time.Now(),
 					Payload:   resp.Payload,
-				})
+				}))
+				deliver.End()
 			}
 		case <-time.After(requestTimeout):
+			endSpan(wait, errRequestTimeout)
+			c.logger().Warn("Request timed out", eventAttrs(ev)...)
+			requestTimeouts.WithLabelValues(ev.Type).Inc()
 			if c != nil {
-				c.sendError(ev.RequestID, "timeout", "Peer did not respond in time")
+				c.sendError(ev.RequestID, ErrCodeTimeout, "Peer did not respond in time")
 			}
 		}
 	}()
@@ -546,10 +1051,6 @@ func (m *Manager) handleGenericRequest(ev Event, c *Client) error {
 }
 
 func (m *Manager) handleResponse(ev Event, c *Client) error {
-	if c.room == nil {
-		return errors.New("not in a room")
-	}
-
 	c.room.fulfillResponse(ev)
 	return nil
 }
@@ -558,7 +1059,7 @@ func (m *Manager) routeEvent(ev Event, c *Client) error {
 	// Recover from panics in event handlers
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC recovered in routeEvent for event %s from device %s: %v", ev.Type, c.deviceID, r)
+			c.logger().Error("Panic recovered in routeEvent", append(eventAttrs(ev), "panic", r)...)
 		}
 	}()
 
@@ -566,89 +1067,121 @@ func (m *Manager) routeEvent(ev Event, c *Client) error {
 		return errors.New("client is nil")
 	}
 
-	switch ev.Type {
-	case EventRoomStatus:
-		return m.handleRoomStatus(ev, c)
-	case EventCreateRoom:
-		return m.handleCreateRoom(ev, c)
-	case EventJoinRoom:
-		return m.handleJoinRoom(ev, c)
-	case EventDeviceInfo:
-		return m.handleDeviceInfo(ev, c)
-	case EventBatteryUpdate:
-		return m.handleBatteryUpdate(ev, c)
-	case EventStorageUpdate:
-		return m.handleStorageUpdate(ev, c)
-	case EventDownloadsUpdate:
-		return m.handleDownloadsUpdate(ev, c)
-	case EventActionRequest:
-		return m.handleActionRequest(ev, c)
-	case EventMediaAction:
-		return m.handleMediaAction(ev, c)
-	case EventActionResult:
-		return m.handleActionResult(ev, c)
-	case EventRequest:
-		return m.handleGenericRequest(ev, c)
-	case EventResponse:
-		return m.handleResponse(ev, c)
-	default:
-		return fmt.Errorf("unknown event type: %s", ev.Type)
+	// Clients that skip hello speak the legacy protocol.
+	if ev.Type != EventHello && !m.negotiateLegacy(c) {
+		return nil
+	}
+
+	if traced(ev) {
+		ctx, span := startEventSpan(context.Background(), "route", ev, c, trace.SpanKindInternal)
+		err := m.handlers.dispatch(withTrace(ctx, ev), c)
+		endSpan(span, err)
+		return err
 	}
+	return m.handlers.dispatch(ev, c)
 }
 
 func (m *Manager) serveWs(w http.ResponseWriter, r *http.Request) {
 	// Recover from any panics during connection setup
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC recovered in serveWs: %v", r)
+			slog.Error("Panic recovered in serveWs", "panic", r)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
 	}()
 
-	// JWT validation
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+	if ok, retryAfter := m.limiter.allowUpgrade(clientIP(r)); !ok {
+		slog.Warn("Connection attempts rate limited", "ip", clientIP(r))
+		rateLimited.WithLabelValues(rateLimitUpgrade).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many connection attempts", http.StatusTooManyRequests)
 		return
 	}
 
-	claims, err := validateJWT(token)
+	// The token comes in an Authorization header, a subprotocol or the
+	// deprecated token query parameter. Without one, the client must send
+	// an auth event right after the upgrade.
+	token, transport := tokenFromRequest(r)
+	var id identity
+	if token != "" {
+		var authErr *authError
+		if id, authErr = m.authenticate(token); authErr != nil {
+			slog.Warn("JWT validation failed", "remote_addr", r.RemoteAddr, "transport", transport, "error", authErr)
+			if authErr.reason != "" {
+				jwtFailures.WithLabelValues(authErr.reason).Inc()
+			}
+			http.Error(w, authErr.message, authErr.status)
+			return
+		}
+		if transport == authTransportQuery {
+			slog.Warn("Token sent in query string, which is deprecated; use an Authorization header",
+				"device_id", id.deviceID, "remote_addr", r.RemoteAddr)
+		}
+	}
+
+	conn, err := m.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("JWT validation failed: %v", err)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		slog.Warn("Failed to upgrade connection", "device_id", id.deviceID, "error", err)
 		return
 	}
 
-	// Extract device info from JWT
-	deviceID, ok := claims["device_id"].(string)
-	if !ok || deviceID == "" {
-		http.Error(w, "Missing or invalid device_id in token", http.StatusBadRequest)
-		return
+	if token == "" {
+		transport = authTransportMessage
+		var authErr *authError
+		if id, authErr = m.authenticateFirstMessage(conn); authErr != nil {
+			slog.Warn("JWT validation failed", "remote_addr", r.RemoteAddr, "transport", transport, "error", authErr)
+			if authErr.reason != "" {
+				jwtFailures.WithLabelValues(authErr.reason).Inc()
+			}
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, authErr.closeReason()),
+				time.Now().Add(writeWait))
+			conn.Close()
+			return
+		}
 	}
+	authTransports.WithLabelValues(transport).Inc()
 
-	deviceType, ok := claims["device_type"].(string)
-	if !ok || (deviceType != DeviceTypeMac && deviceType != DeviceTypeWatch) {
-		http.Error(w, "Invalid device_type in token", http.StatusBadRequest)
-		return
+	connID := newConnectionID()
+	logger := slog.With(
+		"connection_id", connID,
+		"device_id", id.deviceID,
+		"device_type", id.deviceType,
+	)
+
+	client := NewClient(conn, m)
+	client.deviceID = id.deviceID
+	client.deviceType = id.deviceType
+	client.connID = connID
+	client.log = logger
+	client.codec = codecForSubprotocol(conn.Subprotocol())
+	if offersCompression(r) {
+		client.compress = true
+		conn.SetCompressionLevel(compressionLevel)
+	}
+	// Watches on metered links can ask for telemetry as merge-patch deltas
+	// here or through hello.
+	if r.URL.Query().Get("deltas") == "1" {
+		client.features[FeatureTelemetryDeltas] = true
 	}
 
-	conn, err := m.upgrader.Upgrade(w, r, nil)
+	session, err := m.sessions.create(client)
 	if err != nil {
-		log.Printf("Failed to upgrade connection for device %s: %v", deviceID, err)
+		logger.Error("Failed to start session", "error", err)
+		conn.Close()
 		return
 	}
+	client.session = session
+	client.setToken(id.token)
+	connectedClients.WithLabelValues(id.deviceType).Inc()
 
-	client := NewClient(conn, m)
-	client.deviceID = deviceID
-	client.deviceType = deviceType
-
-	log.Printf("Device %s (%s) connected from %s", deviceID, deviceType, r.RemoteAddr)
+	logger.Info("Device connected", "remote_addr", r.RemoteAddr)
 
 	// Start write handler first to ensure we can send messages
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("PANIC recovered in writeMessages goroutine for %s: %v", deviceID, r)
+				logger.Error("Panic recovered in writeMessages goroutine", "panic", r)
 			}
 		}()
 		client.writeMessages()
@@ -658,7 +1191,7 @@ func (m *Manager) serveWs(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("PANIC recovered in readMessages goroutine for %s: %v", deviceID, r)
+				logger.Error("Panic recovered in readMessages goroutine", "panic", r)
 			}
 		}()
 		client.readMessages()
@@ -668,7 +1201,14 @@ func (m *Manager) serveWs(w http.ResponseWriter, r *http.Request) {
 	// Use a small delay to ensure writeMessages goroutine is ready
 	go func() {
 		time.Sleep(10 * time.Millisecond)
-		client.send(Event{Type: EventConnect, Timestamp: time.Now()})
+		// The resume token lets the client pick this session up again after
+		// a reconnect instead of doing a full resync.
+		client.send(Event{Type: EventConnect, Timestamp: time.Now(), Payload: protocol.EncodePayload(protocol.Connect{
+			ResumeToken:        session.token,
+			ProtocolVersion:    protocolVersion,
+			MinProtocolVersion: minProtocolVersion,
+			Encoding:           client.currentCodec().Name(),
+		})})
 		client.startStatusPinger()
 	}()
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// JSON merge patch (RFC 7386) helpers used to send telemetry deltas.
+
+var errMergePatchNull = errors.New("document contains null values, which a merge patch cannot express")
+
+// createMergePatch returns a merge patch that turns original into modified.
+// Documents containing null members are rejected, since a null in a merge
+// patch deletes the member instead of setting it.
+func createMergePatch(original, modified []byte) ([]byte, error) {
+	var orig, mod any
+	if err := json.Unmarshal(original, &orig); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(modified, &mod); err != nil {
+		return nil, err
+	}
+	if containsNull(mod) {
+		return nil, errMergePatchNull
+	}
+	return json.Marshal(diffMerge(orig, mod))
+}
+
+func diffMerge(orig, mod any) any {
+	origObj, ok1 := orig.(map[string]any)
+	modObj, ok2 := mod.(map[string]any)
+	if !ok1 || !ok2 {
+		return mod
+	}
+
+	patch := make(map[string]any)
+	for key := range origObj {
+		if _, ok := modObj[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	for key, value := range modObj {
+		prev, ok := origObj[key]
+		if !ok {
+			patch[key] = value
+			continue
+		}
+		if reflect.DeepEqual(prev, value) {
+			continue
+		}
+		patch[key] = diffMerge(prev, value)
+	}
+	return patch
+}
+
+func containsNull(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]any:
+		for _, item := range v {
+			if containsNull(item) {
+				return true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if containsNull(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyMergePatch applies patch to target as described in RFC 7386.
+func applyMergePatch(target, patch []byte) ([]byte, error) {
+	var doc, p any
+	if len(target) > 0 {
+		if err := json.Unmarshal(target, &doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(doc, p))
+}
+
+func mergeValue(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = make(map[string]any)
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergeValue(targetObj[key], value)
+	}
+	return targetObj
+}
+
+var errMergePatchCompose = errors.New("merge patches cannot be composed")
+
+// composeMergePatch returns a single patch equivalent to applying first and
+// then second. It fails when second patches a member that first deletes or
+// replaces with a scalar, which one merge patch cannot express.
+func composeMergePatch(first, second []byte) ([]byte, error) {
+	var a, b any
+	if err := json.Unmarshal(first, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(second, &b); err != nil {
+		return nil, err
+	}
+	composed, ok := composeValue(a, b)
+	if !ok {
+		return nil, errMergePatchCompose
+	}
+	return json.Marshal(composed)
+}
+
+func composeValue(first, second any) (any, bool) {
+	secondObj, ok := second.(map[string]any)
+	if !ok {
+		return second, true
+	}
+	firstObj, ok := first.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	for key, value := range secondObj {
+		prev, ok := firstObj[key]
+		if value == nil || !ok {
+			firstObj[key] = value
+			continue
+		}
+		composed, ok := composeValue(prev, value)
+		if !ok {
+			return nil, false
+		}
+		firstObj[key] = composed
+	}
+	return firstObj, true
+}
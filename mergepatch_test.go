@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// jsonEqual reports whether a and b encode the same JSON value.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("unmarshal %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("unmarshal %s: %v", b, err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestMergePatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name               string
+		original, modified string
+	}{
+		{"unchanged", `{"percent":40}`, `{"percent":40}`},
+		{"scalar change", `{"percent":40,"is_charging":false}`, `{"percent":41,"is_charging":false}`},
+		{"member added and removed", `{"a":1,"b":2}`, `{"b":2,"c":3}`},
+		{"nested object", `{"a":{"b":1,"c":2},"d":1}`, `{"a":{"b":1,"e":3},"d":1}`},
+		{"array grows", `{"downloads":[{"name":"a","progress":0.5}]}`,
+			`{"downloads":[{"name":"a","progress":0.6},{"name":"b","progress":0}]}`},
+		{"array shrinks", `{"downloads":[{"name":"a"},{"name":"b"}]}`, `{"downloads":[]}`},
+		{"escaped keys", `{"a/b":1,"c~d":{"~1":1}}`, `{"a/b":2,"c~d":{"~1":2,"/":3}}`},
+		{"member type change", `{"a":{"b":1},"c":[1]}`, `{"a":[1],"c":{"b":1}}`},
+		{"object to scalar", `{"a":{"b":1}}`, `{"a":"x"}`},
+		{"root type change", `{"a":1}`, `[1,2]`},
+		{"root from scalar", `"x"`, `{"a":1}`},
+		{"null in original", `{"a":null,"b":1}`, `{"b":2}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := createMergePatch([]byte(tt.original), []byte(tt.modified))
+			if err != nil {
+				t.Fatalf("createMergePatch: %v", err)
+			}
+			got, err := applyMergePatch([]byte(tt.original), patch)
+			if err != nil {
+				t.Fatalf("applyMergePatch %s: %v", patch, err)
+			}
+			if !jsonEqual(t, got, []byte(tt.modified)) {
+				t.Errorf("apply(diff(a, b)) = %s, want %s; patch %s", got, tt.modified, patch)
+			}
+		})
+	}
+}
+
+func TestMergePatchRejectsNull(t *testing.T) {
+	for _, modified := range []string{`{"a":null}`, `{"a":{"b":null}}`, `{"a":[1,null]}`, `null`} {
+		if _, err := createMergePatch([]byte(`{"a":1}`), []byte(modified)); !errors.Is(err, errMergePatchNull) {
+			t.Errorf("createMergePatch to %s: got %v, want errMergePatchNull", modified, err)
+		}
+	}
+}
+
+func TestComposeMergePatch(t *testing.T) {
+	tests := []struct {
+		name                  string
+		target, first, second string
+	}{
+		{"disjoint members", `{"a":1,"b":1}`, `{"a":2}`, `{"b":2}`},
+		{"same member", `{"a":1}`, `{"a":2}`, `{"a":3}`},
+		{"nested", `{"a":{"b":1,"c":1}}`, `{"a":{"b":2}}`, `{"a":{"c":null}}`},
+		{"delete after set", `{"a":1,"b":1}`, `{"a":2}`, `{"a":null}`},
+		{"set after delete", `{"a":1}`, `{"a":null}`, `{"a":3}`},
+		{"replace with scalar", `{"a":{"b":1}}`, `{"a":{"b":2}}`, `{"a":5}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := applyMergePatch([]byte(tt.target), []byte(tt.first))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := applyMergePatch(step, []byte(tt.second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			composed, err := composeMergePatch([]byte(tt.first), []byte(tt.second))
+			if err != nil {
+				t.Fatalf("composeMergePatch: %v", err)
+			}
+			got, err := applyMergePatch([]byte(tt.target), composed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(t, got, want) {
+				t.Errorf("apply(compose(p1, p2)) = %s, want %s; composed %s", got, want, composed)
+			}
+		})
+	}
+
+	for _, first := range []string{`{"a":null}`, `{"a":5}`} {
+		if _, err := composeMergePatch([]byte(first), []byte(`{"a":{"b":1}}`)); !errors.Is(err, errMergePatchCompose) {
+			t.Errorf("compose %s with a nested patch: got %v, want errMergePatchCompose", first, err)
+		}
+	}
+}
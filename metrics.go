@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Event directions for eventsTotal.
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+// Labels of compressionMessages and compressionSampledBytes.
+const (
+	compressionCompressed   = "compressed"
+	compressionUncompressed = "uncompressed"
+	compressionRaw          = "raw"
+)
+
+var (
+	connectedClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "echo_connected_clients",
+		Help: "WebSocket clients connected to this instance.",
+	}, []string{"device_type"})
+
+	eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_events_total",
+		Help: "Events received from and sent to clients.",
+	}, []string{"type", "direction"})
+
+	egressDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_egress_dropped_total",
+		Help: "Outgoing events dropped because a client's egress queue was full.",
+	}, []string{"type"})
+
+	routingErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_routing_errors_total",
+		Help: "Client events that failed routing, by error code.",
+	}, []string{"code"})
+
+	compressionMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_compression_messages_total",
+		Help: "Outgoing messages, by event type and whether they were sent compressed.",
+	}, []string{"type", "mode"})
+
+	// The compression ratio of an event type is the rate of its compressed
+	// sampled bytes over the rate of its raw ones.
+	compressionSampledBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_compression_sampled_bytes_total",
+		Help: "Raw and deflated sizes of a sample of the compressed outgoing messages, by event type.",
+	}, []string{"type", "size"})
+
+	requestTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_request_timeouts_total",
+		Help: "Requests whose peer did not respond within the request timeout.",
+	}, []string{"type"})
+
+	jwtFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_jwt_failures_total",
+		Help: "Rejected connection attempts, by token failure reason.",
+	}, []string{"reason"})
+
+	authTransports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_auth_transport_total",
+		Help: "Authenticated connections, by how the token was sent.",
+	}, []string{"transport"})
+
+	rejectedOrigins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_rejected_origins_total",
+		Help: "WebSocket upgrades rejected by the origin policy, by reason.",
+	}, []string{"reason"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echo_rate_limited_total",
+		Help: "Events and connection attempts rejected by rate limits, by event type or \"upgrade\".",
+	}, []string{"type"})
+
+	requestLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "echo_request_round_trip_seconds",
+		Help:    "Time from forwarding a request to receiving its response.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		connectedClients,
+		eventsTotal,
+		egressDropped,
+		routingErrors,
+		compressionMessages,
+		compressionSampledBytes,
+		requestTimeouts,
+		jwtFailures,
+		authTransports,
+		rejectedOrigins,
+		rateLimited,
+		requestLatency,
+	)
+}
+
+// registerManagerMetrics exports gauges computed from m's state at scrape
+// time.
+func registerManagerMetrics(m *Manager) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "echo_active_rooms",
+		Help: "Rooms on this instance whose Mac is connected.",
+	}, func() float64 {
+		return float64(m.activeRoomCount())
+	}))
+}
+
+// eventTypeLabel returns the label for an event type received from a
+// client. Unregistered types share one label so clients cannot grow the
+// series count.
+func (m *Manager) eventTypeLabel(eventType string) string {
+	if _, ok := m.handlers.lookup(eventType); !ok {
+		return "unknown"
+	}
+	return eventType
+}
+
+// JWT failure reasons for jwtFailures.
+const (
+	jwtReasonMissing   = "missing"
+	jwtReasonExpired   = "expired"
+	jwtReasonMalformed = "malformed"
+	jwtReasonSignature = "signature"
+	jwtReasonClaims    = "claims"
+	jwtReasonRevoked   = "revoked"
+	jwtReasonInvalid   = "invalid"
+)
+
+// jwtFailureReason classifies a validateJWT error.
+func jwtFailureReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired), errors.Is(err, jwt.ErrTokenNotValidYet):
+		return jwtReasonExpired
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return jwtReasonMalformed
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return jwtReasonSignature
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer), errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return jwtReasonClaims
+	default:
+		return jwtReasonInvalid
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Origin policies accepted in ORIGIN_POLICY.
+const (
+	// originPolicyAllowlist accepts native clients, which send no Origin
+	// header, and browsers on an allowed origin.
+	originPolicyAllowlist = "allowlist"
+	// originPolicyNative accepts native clients only.
+	originPolicyNative = "native"
+)
+
+// Reasons an upgrade was rejected, as counted in rejectedOrigins.
+const (
+	originReasonNotAllowed = "not_allowed"
+	originReasonNativeOnly = "native_only"
+	originReasonMalformed  = "malformed"
+)
+
+// originPolicy decides which Origin headers may open a socket. A stolen
+// token is then of no use to a page on another origin.
+type originPolicy struct {
+	nativeOnly bool
+	allowed    []originPattern
+}
+
+// originPattern matches origins such as https://app.example.com or, with a
+// leading "*.", any subdomain of a host. An empty scheme or port matches
+// any.
+type originPattern struct {
+	scheme string
+	host   string // without the "*." for wildcards
+	port   string
+	sub    bool // host is a wildcard matching subdomains only
+}
+
+// allowedOrigins is the policy of the upgrader, set up from the
+// environment in main. By default only native clients are accepted.
+var allowedOrigins = &originPolicy{}
+
+// loadOriginPolicy parses ORIGIN_POLICY and the comma-separated origins of
+// ALLOWED_ORIGINS, e.g. "https://app.example.com,https://*.example.com".
+func loadOriginPolicy(policy, origins string) error {
+	p := &originPolicy{}
+	switch strings.ToLower(policy) {
+	case "", originPolicyAllowlist:
+	case originPolicyNative:
+		p.nativeOnly = true
+	default:
+		return fmt.Errorf("invalid origin policy %q, want %s or %s", policy, originPolicyAllowlist, originPolicyNative)
+	}
+
+	for _, origin := range splitList(origins) {
+		pattern, err := parseOriginPattern(origin)
+		if err != nil {
+			return err
+		}
+		p.allowed = append(p.allowed, pattern)
+	}
+	if p.nativeOnly && len(p.allowed) > 0 {
+		slog.Warn("ALLOWED_ORIGINS is ignored with the native origin policy")
+	}
+	allowedOrigins = p
+	return nil
+}
+
+func parseOriginPattern(origin string) (originPattern, error) {
+	var pattern originPattern
+	rest := strings.ToLower(origin)
+	if scheme, hostport, ok := strings.Cut(rest, "://"); ok {
+		pattern.scheme, rest = scheme, hostport
+	}
+	if strings.ContainsAny(rest, "/?#") {
+		return pattern, fmt.Errorf("invalid origin %q: must not contain a path", origin)
+	}
+	if host, port, ok := strings.Cut(rest, ":"); ok {
+		rest, pattern.port = host, port
+	}
+	if host, ok := strings.CutPrefix(rest, "*."); ok {
+		rest, pattern.sub = host, true
+	}
+	if rest == "" || strings.Contains(rest, "*") {
+		return pattern, fmt.Errorf("invalid origin %q: only a leading *. wildcard is supported", origin)
+	}
+	pattern.host = rest
+	return pattern, nil
+}
+
+func (op originPattern) matches(u *url.URL) bool {
+	if op.scheme != "" && op.scheme != u.Scheme {
+		return false
+	}
+	if op.port != "" && op.port != u.Port() {
+		return false
+	}
+	host := u.Hostname()
+	if op.sub {
+		return strings.HasSuffix(host, "."+op.host)
+	}
+	return host == op.host
+}
+
+// check reports whether the upgrade request r may proceed, logging and
+// counting rejections. It is the upgrader's CheckOrigin.
+func (p *originPolicy) check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	reason := originReasonNotAllowed
+	if p.nativeOnly {
+		reason = originReasonNativeOnly
+	} else if u, err := url.Parse(strings.ToLower(origin)); err != nil || u.Host == "" {
+		reason = originReasonMalformed
+	} else {
+		for _, pattern := range p.allowed {
+			if pattern.matches(u) {
+				return true
+			}
+		}
+	}
+
+	slog.Warn("Rejected WebSocket origin", "origin", origin, "reason", reason, "remote_addr", r.RemoteAddr)
+	rejectedOrigins.WithLabelValues(reason).Inc()
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"time"
+)
+
+// outboxPolicy decides whether events of a type are held for a device that
+// has briefly disconnected, and for how long.
+type outboxPolicy struct {
+	ttl time.Duration
+	// coalesce keeps only the latest queued event of the type.
+	coalesce bool
+}
+
+// outboxPolicies lists the event types that are replayed to a device when it
+// rejoins. Anything not listed is dropped while the device is away; media
+// and action commands in particular must not fire long after they were sent.
+var outboxPolicies = map[string]outboxPolicy{
+	EventDeviceInfo:      {ttl: outboxRetention, coalesce: true},
+	EventDownloadsUpdate: {ttl: outboxRetention, coalesce: true},
+	EventStorageUpdate:   {ttl: outboxRetention, coalesce: true},
+	EventBatteryUpdate:   {ttl: batteryTTL, coalesce: true},
+	EventStatusUpdate:    {ttl: outboxRetention, coalesce: true},
+	EventActionResult:    {ttl: requestTimeout},
+	EventResponse:        {ttl: requestTimeout},
+	EventError:           {ttl: requestTimeout},
+}
+
+type queuedEvent struct {
+	ev        Event
+	expiresAt time.Time
+}
+
+// outbox holds events for one recently disconnected device.
+type outbox struct {
+	deviceType string
+	leftAt     time.Time
+	events     []queuedEvent
+}
+
+func (o *outbox) expired(now time.Time) bool {
+	return now.Sub(o.leftAt) > outboxRetention
+}
+
+// push appends ev, replacing an older event of the same type when the type
+// coalesces and dropping the oldest event once the outbox is full.
+func (o *outbox) push(ev Event, policy outboxPolicy, now time.Time) {
+	if policy.coalesce {
+		for i, q := range o.events {
+			if q.ev.Type == ev.Type {
+				o.events = append(o.events[:i], o.events[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(o.events) >= outboxMaxEvents {
+		o.events = o.events[1:]
+	}
+	o.events = append(o.events, queuedEvent{ev: ev, expiresAt: now.Add(policy.ttl)})
+}
+
+// drain returns the unexpired events in the order they were queued.
+func (o *outbox) drain(now time.Time) []Event {
+	events := make([]Event, 0, len(o.events))
+	for _, q := range o.events {
+		if now.Before(q.expiresAt) {
+			events = append(events, q.ev)
+		}
+	}
+	o.events = nil
+	return events
+}
+
+// openOutbox starts holding events for a device that just left the room.
+func (r *Room) openOutbox(deviceID, deviceType string) {
+	r.outboxMu.Lock()
+	defer r.outboxMu.Unlock()
+
+	r.outboxes[deviceID] = &outbox{deviceType: deviceType, leftAt: time.Now()}
+}
+
+// takeOutbox removes the outbox of a device and returns its pending events.
+func (r *Room) takeOutbox(deviceID string) []Event {
+	r.outboxMu.Lock()
+	defer r.outboxMu.Unlock()
+
+	o, ok := r.outboxes[deviceID]
+	if !ok {
+		return nil
+	}
+	delete(r.outboxes, deviceID)
+
+	now := time.Now()
+	if o.expired(now) {
+		return nil
+	}
+	return o.drain(now)
+}
+
+// enqueue holds ev for deviceID if the device recently left and the event
+// type opts in. It reports whether the event was queued.
+func (r *Room) enqueue(deviceID string, ev Event) bool {
+	policy, ok := outboxPolicies[ev.Type]
+	if !ok {
+		return false
+	}
+
+	r.outboxMu.Lock()
+	defer r.outboxMu.Unlock()
+
+	o, ok := r.outboxes[deviceID]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	if o.expired(now) {
+		delete(r.outboxes, deviceID)
+		return false
+	}
+	o.push(ev, policy, now)
+	return true
+}
+
+// enqueueAbsentLocked holds ev for every recently departed device except exclude.
+// Callers must hold r.mu so the set of connected devices is stable.
+func (r *Room) enqueueAbsentLocked(excludeDeviceID string, ev Event) {
+	if _, ok := outboxPolicies[ev.Type]; !ok {
+		return
+	}
+
+	r.outboxMu.Lock()
+	ids := make([]string, 0, len(r.outboxes))
+	for deviceID := range r.outboxes {
+		ids = append(ids, deviceID)
+	}
+	r.outboxMu.Unlock()
+
+	for _, deviceID := range ids {
+		if deviceID == excludeDeviceID || r.clients[deviceID] != nil {
+			continue
+		}
+		if p, ok := r.remote[deviceID]; ok && p.fresh() {
+			continue
+		}
+		r.enqueue(deviceID, ev)
+	}
+}
+
+// enqueueForType holds ev for a recently departed device of the given type.
+func (r *Room) enqueueForType(deviceType string, ev Event) bool {
+	r.outboxMu.Lock()
+	var target string
+	for deviceID, o := range r.outboxes {
+		if o.deviceType == deviceType {
+			target = deviceID
+			break
+		}
+	}
+	r.outboxMu.Unlock()
+
+	if target == "" {
+		return false
+	}
+	return r.enqueue(target, ev)
+}
+
+// forwardOutbox sends the held events of a device that rejoined through
+// another instance.
+func (r *Room) forwardOutbox(deviceID string) {
+	for _, ev := range r.takeOutbox(deviceID) {
+		ev := ev
+		r.cluster.publish(clusterMessage{
+			Kind:     clusterMsgDirect,
+			RoomID:   r.id,
+			DeviceID: deviceID,
+			Event:    &ev,
+		})
+	}
+}
+
+// deliverTo sends ev to a specific device wherever it is connected, holding
+// it in the device's outbox if it is currently away.
+func (r *Room) deliverTo(deviceID string, ev Event) {
+	if c := r.localClient(deviceID); c != nil {
+		c.send(ev)
+		return
+	}
+
+	r.mu.RLock()
+	p, remote := r.remote[deviceID]
+	r.mu.RUnlock()
+	if remote && p.fresh() {
+		r.cluster.publish(clusterMessage{
+			Kind:     clusterMsgDirect,
+			RoomID:   r.id,
+			DeviceID: deviceID,
+			Event:    &ev,
+		})
+		return
+	}
+
+	r.enqueue(deviceID, ev)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"echo/protocol"
+)
+
+const (
+	PairingModePIN = protocol.PairingModePIN
+	PairingModeQR  = protocol.PairingModeQR
+)
+
+var (
+	errPairingCodeInvalid = errors.New("invalid or expired pairing code")
+	errPairingRateLimited = errors.New("too many pairing attempts, try again later")
+)
+
+// Pairing state shared between instances lives in these backplane hashes.
+const (
+	pairingCodesKey   = "echo:pairing:codes"   // code -> pairingCode
+	pairingRoomsKey   = "echo:pairing:rooms"   // roomID -> active code
+	pairingPendingKey = "echo:pairing:pending" // roomID/deviceID -> pendingPairing
+
+	// pairingFailuresKey counts failed redemptions per device and attempt
+	// window under deviceID/window; pairingThrottleKey counts them per
+	// window across all devices.
+	pairingFailuresKey = "echo:pairing:failures"
+	pairingThrottleKey = "echo:pairing:throttle"
+)
+
+type pairingCode struct {
+	Code      string    `json:"code"`
+	Mode      string    `json:"mode"`
+	RoomID    string    `json:"room_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// pendingPairing records which instance holds the connection of a watch
+// waiting for approval.
+type pendingPairing struct {
+	Node      string    `json:"node"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PairingManager issues short-lived, single-use pairing codes and tracks
+// watches waiting for the room owner to approve them. Codes and failed
+// redemptions are kept on the backplane so a watch can redeem a code on any
+// instance, and guesses count against the same limits on every instance.
+type PairingManager struct {
+	bp     Backplane
+	nodeID string
+
+	mu      sync.Mutex
+	waiting map[string]*Client // roomID/deviceID -> watch on this instance
+}
+
+func NewPairingManager(bp Backplane, nodeID string) *PairingManager {
+	return &PairingManager{
+		bp:      bp,
+		nodeID:  nodeID,
+		waiting: make(map[string]*Client),
+	}
+}
+
+// issue creates a new code for roomID, invalidating any code issued before.
+func (pm *PairingManager) issue(roomID, mode string) (*pairingCode, error) {
+	pm.pruneCodes()
+
+	if old, ok, err := pm.bp.HGet(pairingRoomsKey, roomID); err != nil {
+		return nil, err
+	} else if ok {
+		if _, err := pm.bp.HDel(pairingCodesKey, old); err != nil {
+			return nil, err
+		}
+	}
+
+	var code string
+	for {
+		var err error
+		switch mode {
+		case PairingModePIN:
+			code, err = randomPIN()
+		case PairingModeQR:
+			code, err = randomHex(16)
+		default:
+			return nil, fmt.Errorf("unknown pairing mode: %s", mode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, taken, err := pm.bp.HGet(pairingCodesKey, code)
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			break
+		}
+	}
+
+	pc := &pairingCode{
+		Code:      code,
+		Mode:      mode,
+		RoomID:    roomID,
+		ExpiresAt: time.Now().Add(pairingCodeTTL),
+	}
+	data, _ := json.Marshal(pc)
+	if err := pm.bp.HSet(pairingCodesKey, code, string(data)); err != nil {
+		return nil, err
+	}
+	if err := pm.bp.HSet(pairingRoomsKey, roomID, code); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// peek looks up a code without consuming it. Failed lookups count against
+// the device's attempt budget and against the budget of the whole cluster;
+// while either is spent, every redemption is refused.
+func (pm *PairingManager) peek(deviceID, code string) (*pairingCode, error) {
+	now := time.Now()
+	window := attemptWindow(now)
+	total, err := pm.count(pairingThrottleKey, window)
+	if err != nil {
+		return nil, err
+	}
+	if total >= pairingMaxFailures {
+		return nil, errPairingRateLimited
+	}
+	field := attemptsField(deviceID, now)
+	failures, err := pm.count(pairingFailuresKey, field)
+	if err != nil {
+		return nil, err
+	}
+	if failures >= pairingMaxAttempts {
+		return nil, errPairingRateLimited
+	}
+
+	pc, err := pm.lookup(code)
+	if err != nil {
+		return nil, err
+	}
+	if pc == nil {
+		if _, err := pm.bp.HIncrBy(pairingFailuresKey, field, 1); err != nil {
+			return nil, err
+		}
+		total, err := pm.bp.HIncrBy(pairingThrottleKey, window, 1)
+		if err != nil {
+			return nil, err
+		}
+		if total == pairingMaxFailures {
+			slog.Warn("Throttling pairing redemptions after too many failures", "failures", total, "window", pairingAttemptWindow)
+		}
+		return nil, errPairingCodeInvalid
+	}
+	return pc, nil
+}
+
+// lookup returns the code if it is still valid.
+func (pm *PairingManager) lookup(code string) (*pairingCode, error) {
+	raw, ok, err := pm.bp.HGet(pairingCodesKey, code)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var pc pairingCode
+	if err := json.Unmarshal([]byte(raw), &pc); err != nil || time.Now().After(pc.ExpiresAt) {
+		return nil, nil
+	}
+	return &pc, nil
+}
+
+// invalidate removes pc and, if it is still its room's active code, the
+// room's reference to it.
+func (pm *PairingManager) invalidate(pc *pairingCode) {
+	_, _ = pm.bp.HDel(pairingCodesKey, pc.Code)
+	if active, ok, _ := pm.bp.HGet(pairingRoomsKey, pc.RoomID); ok && active == pc.Code {
+		_, _ = pm.bp.HDel(pairingRoomsKey, pc.RoomID)
+	}
+}
+
+// count returns a counter of key, which is 0 until first incremented.
+func (pm *PairingManager) count(key, field string) (int64, error) {
+	raw, ok, err := pm.bp.HGet(key, field)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseInt(raw, 10, 64)
+}
+
+// attemptsField is the field of pairingFailuresKey counting the failed
+// redemptions of deviceID in the attempt window that contains now.
+func attemptsField(deviceID string, now time.Time) string {
+	return deviceID + "/" + attemptWindow(now)
+}
+
+func attemptWindow(now time.Time) string {
+	return strconv.FormatInt(now.Unix()/int64(pairingAttemptWindow/time.Second), 10)
+}
+
+// redeem consumes a code and records the watch as waiting for approval.
+// Only one caller can consume a given code.
+func (pm *PairingManager) redeem(pc *pairingCode, c *Client) error {
+	claimed, err := pm.bp.HDel(pairingCodesKey, pc.Code)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return errPairingCodeInvalid
+	}
+	if active, ok, _ := pm.bp.HGet(pairingRoomsKey, pc.RoomID); ok && active == pc.Code {
+		_, _ = pm.bp.HDel(pairingRoomsKey, pc.RoomID)
+	}
+
+	key := pendingKey(pc.RoomID, c.deviceID)
+	data, _ := json.Marshal(pendingPairing{
+		Node:      pm.nodeID,
+		ExpiresAt: time.Now().Add(pairingCodeTTL),
+	})
+	if err := pm.bp.HSet(pairingPendingKey, key, string(data)); err != nil {
+		return err
+	}
+
+	_, _ = pm.bp.HDel(pairingFailuresKey, attemptsField(c.deviceID, time.Now()))
+
+	pm.mu.Lock()
+	pm.waiting[key] = c
+	pm.mu.Unlock()
+	return nil
+}
+
+// claimPending removes the pending approval for deviceID and returns the
+// instance that holds the watch's connection.
+func (pm *PairingManager) claimPending(roomID, deviceID string) (string, bool) {
+	key := pendingKey(roomID, deviceID)
+	raw, ok, err := pm.bp.HGet(pairingPendingKey, key)
+	if err != nil || !ok {
+		return "", false
+	}
+	claimed, err := pm.bp.HDel(pairingPendingKey, key)
+	if err != nil || !claimed {
+		return "", false
+	}
+
+	var p pendingPairing
+	if err := json.Unmarshal([]byte(raw), &p); err != nil || time.Now().After(p.ExpiresAt) {
+		return "", false
+	}
+	return p.Node, true
+}
+
+// takeLocalPending returns the waiting watch if it is connected here.
+func (pm *PairingManager) takeLocalPending(roomID, deviceID string) (*Client, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	key := pendingKey(roomID, deviceID)
+	c, ok := pm.waiting[key]
+	delete(pm.waiting, key)
+	return c, ok
+}
+
+// revokeRoom drops the active code and pending approvals for a room.
+func (pm *PairingManager) revokeRoom(roomID string) {
+	if code, ok, _ := pm.bp.HGet(pairingRoomsKey, roomID); ok {
+		_, _ = pm.bp.HDel(pairingCodesKey, code)
+		_, _ = pm.bp.HDel(pairingRoomsKey, roomID)
+	}
+
+	prefix := roomID + "/"
+	pending, _ := pm.bp.HGetAll(pairingPendingKey)
+	for key := range pending {
+		if strings.HasPrefix(key, prefix) {
+			_, _ = pm.bp.HDel(pairingPendingKey, key)
+		}
+	}
+
+	pm.mu.Lock()
+	for key := range pm.waiting {
+		if strings.HasPrefix(key, prefix) {
+			delete(pm.waiting, key)
+		}
+	}
+	pm.mu.Unlock()
+}
+
+// pruneCodes removes expired codes, stale approvals and the failure counts
+// of past attempt windows from the backplane.
+func (pm *PairingManager) pruneCodes() {
+	now := time.Now()
+
+	codes, err := pm.bp.HGetAll(pairingCodesKey)
+	if err != nil {
+		slog.Error("Failed to load pairing codes", "error", err)
+		return
+	}
+	for code, raw := range codes {
+		var pc pairingCode
+		if json.Unmarshal([]byte(raw), &pc) != nil || now.After(pc.ExpiresAt) {
+			pc.Code = code
+			pm.invalidate(&pc)
+		}
+	}
+
+	window := attemptWindow(now)
+	counts, _ := pm.bp.HGetAll(pairingFailuresKey)
+	for field := range counts {
+		if i := strings.LastIndex(field, "/"); i >= 0 && field[i+1:] != window {
+			_, _ = pm.bp.HDel(pairingFailuresKey, field)
+		}
+	}
+	totals, _ := pm.bp.HGetAll(pairingThrottleKey)
+	for field := range totals {
+		if field != window {
+			_, _ = pm.bp.HDel(pairingThrottleKey, field)
+		}
+	}
+
+	pending, _ := pm.bp.HGetAll(pairingPendingKey)
+	for key, raw := range pending {
+		var p pendingPairing
+		if json.Unmarshal([]byte(raw), &p) != nil || now.After(p.ExpiresAt) {
+			_, _ = pm.bp.HDel(pairingPendingKey, key)
+			pm.mu.Lock()
+			delete(pm.waiting, key)
+			pm.mu.Unlock()
+		}
+	}
+}
+
+func pendingKey(roomID, deviceID string) string {
+	return roomID + "/" + deviceID
+}
+
+func randomPIN() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func randomHex(nBytes int) (string, error) {
+	b := make([]byte, nBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (m *Manager) handlePairingRequest(ev Event, c *Client) error {
+	var payload protocol.PairingRequest
+	if len(ev.Payload) > 0 {
+		if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+	}
+	if payload.Mode == "" {
+		payload.Mode = PairingModePIN
+	}
+	if payload.Mode != PairingModePIN && payload.Mode != PairingModeQR {
+		return newRouteError(ErrCodeInvalidPayload, "unknown pairing mode: %s", payload.Mode)
+	}
+
+	room := c.room
+	room.mu.RLock()
+	isOwner := room.macID == c.deviceID
+	room.mu.RUnlock()
+	if !isOwner {
+		return newRouteError(ErrCodeNotAuthorized, "only the room owner can pair devices")
+	}
+
+	pc, err := m.pairing.issue(room.id, payload.Mode)
+	if err != nil {
+		return fmt.Errorf("issue pairing code: %w", err)
+	}
+
+	resp := protocol.PairingCode{Mode: pc.Mode, Code: pc.Code, ExpiresAt: pc.ExpiresAt}
+	if pc.Mode == PairingModeQR {
+		resp.QRPayload = "echo://pair?code=" + pc.Code
+	}
+
+	c.logger().Info("Pairing code issued", "mode", pc.Mode)
+	c.send(Event{
+		Type:      EventPairingCode,
+		RoomID:    room.id,
+		RequestID: ev.RequestID,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(resp),
+	})
+	return nil
+}
+
+func (m *Manager) handlePairingRedeem(ev Event, c *Client) error {
+	var payload protocol.PairingRedeem
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	pc, err := m.pairing.peek(c.deviceID, payload.Code)
+	if errors.Is(err, errPairingRateLimited) {
+		c.logger().Warn("Pairing attempts exhausted")
+		return newRouteError(ErrCodeRateLimited, "%s", err.Error())
+	}
+	if errors.Is(err, errPairingCodeInvalid) {
+		return newRouteError(ErrCodePairingFailed, "%s", err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("look up pairing code: %w", err)
+	}
+
+	room, exists := m.getRoom(pc.RoomID)
+	if !exists {
+		return newRouteError(ErrCodePairingFailed, "%s", errPairingCodeInvalid.Error())
+	}
+	if !room.hasPeer(DeviceTypeMac) {
+		c.sendError(ev.RequestID, ErrCodeMacUnavailable, "Mac device not connected")
+		return nil
+	}
+
+	if err := m.pairing.redeem(pc, c); err != nil {
+		if errors.Is(err, errPairingCodeInvalid) {
+			return newRouteError(ErrCodePairingFailed, "%s", err.Error())
+		}
+		return fmt.Errorf("redeem pairing code: %w", err)
+	}
+
+	c.logger().Info("Device redeemed pairing code, awaiting approval", "room_id", room.id)
+
+	c.send(Event{
+		Type:      EventPairingPending,
+		RequestID: ev.RequestID,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.PairingPending{Status: protocol.PairingStatusAwaitingApproval}),
+	})
+
+	room.sendToPeer(DeviceTypeMac, Event{
+		Type:      EventPairingApproval,
+		RoomID:    room.id,
+		DeviceID:  c.deviceID,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.PairingApproval{DeviceID: c.deviceID, DeviceType: c.deviceType}),
+	})
+	return nil
+}
+
+func (m *Manager) handlePairingDecision(ev Event, c *Client) error {
+	var payload protocol.PairingDecision
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	room := c.room
+	room.mu.RLock()
+	isOwner := room.macID == c.deviceID
+	room.mu.RUnlock()
+	if !isOwner {
+		return newRouteError(ErrCodeNotAuthorized, "only the room owner can approve devices")
+	}
+
+	node, ok := m.pairing.claimPending(room.id, payload.DeviceID)
+	if !ok {
+		return newRouteError(ErrCodePairingFailed, "no pending pairing for device %s", payload.DeviceID)
+	}
+
+	if payload.Approved {
+		room.authorize(payload.DeviceID)
+		m.persistRoom(room)
+		c.logger().Info("Device paired with room", "paired_device_id", payload.DeviceID)
+	} else {
+		c.logger().Info("Pairing rejected", "paired_device_id", payload.DeviceID)
+	}
+
+	if node != m.cluster.nodeID {
+		// The watch is connected to another instance; let it finish the join.
+		m.cluster.publish(clusterMessage{
+			Kind:     clusterMsgPairing,
+			RoomID:   room.id,
+			DeviceID: payload.DeviceID,
+			Approved: payload.Approved,
+		})
+		return nil
+	}
+
+	if watch, ok := m.pairing.takeLocalPending(room.id, payload.DeviceID); ok {
+		m.completePairing(room, watch, payload.Approved)
+	}
+	return nil
+}
+
+// completePairing tells a waiting watch about the owner's decision and, if
+// approved, adds it to the room.
+func (m *Manager) completePairing(room *Room, watch *Client, approved bool) {
+	if !approved {
+		watch.sendError("", ErrCodePairingRejected, "Pairing was rejected by the Mac")
+		return
+	}
+
+	// The owner may have approved through another instance.
+	room.authorize(watch.deviceID)
+
+	select {
+	case <-watch.done:
+		// The watch went away while waiting; it can join_room once it reconnects.
+		return
+	default:
+	}
+
+	room.addClient(watch)
+	m.sendCachedData(watch, room)
+
+	watch.send(Event{
+		Type:      EventRoomJoined,
+		RoomID:    room.id,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.RoomJoined{Status: protocol.RoomStatusPaired, Role: protocol.RoleClient}),
+	})
+	room.sendToPeer(DeviceTypeMac, Event{Type: EventStatusUpdate, RoomID: room.id, Timestamp: time.Now(), Payload: protocol.EncodePayload(protocol.StatusUpdate{InRoom: true, WatchConnected: true})})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPairingAttemptLimits(t *testing.T) {
+	bp := NewMemoryBackplane()
+	defer bp.Close()
+	// Two instances sharing the backplane.
+	a := NewPairingManager(bp, "a")
+	b := NewPairingManager(bp, "b")
+
+	pc, err := a.issue("room-1", PairingModePIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("per device", func(t *testing.T) {
+		for i := range pairingMaxAttempts {
+			pm := []*PairingManager{a, b}[i%2]
+			if _, err := pm.peek("guesser", "000000x"); !errors.Is(err, errPairingCodeInvalid) {
+				t.Fatalf("guess %d: got %v, want errPairingCodeInvalid", i+1, err)
+			}
+		}
+		if _, err := a.peek("guesser", pc.Code); !errors.Is(err, errPairingRateLimited) {
+			t.Errorf("after %d failures: got %v, want errPairingRateLimited", pairingMaxAttempts, err)
+		}
+		if got, err := b.peek("watch", pc.Code); err != nil || got == nil {
+			t.Errorf("another device: got %v, %v; want the code", got, err)
+		}
+	})
+
+	t.Run("cluster wide", func(t *testing.T) {
+		for i := 0; ; i++ {
+			pm := []*PairingManager{a, b}[i%2]
+			_, err := pm.peek("device-"+strconv.Itoa(i), "000000x")
+			if errors.Is(err, errPairingRateLimited) {
+				break
+			}
+			if i > pairingMaxFailures {
+				t.Fatalf("%d failures across devices were not throttled", i)
+			}
+		}
+		if _, err := b.peek("watch", pc.Code); !errors.Is(err, errPairingRateLimited) {
+			t.Errorf("valid code while throttled: got %v, want errPairingRateLimited", err)
+		}
+
+		// The next window lifts the throttle, and the code is still valid.
+		if _, err := bp.HDel(pairingThrottleKey, attemptWindow(time.Now())); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := a.peek("watch", pc.Code); err != nil || got == nil {
+			t.Errorf("after the throttle: got %v, %v; want the code", got, err)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error codes in ErrorPayload.
+const (
+	ErrCodeUnknownEvent        = "unknown_event"
+	ErrCodeInvalidDeviceType   = "invalid_device_type"
+	ErrCodeNotInRoom           = "not_in_room"
+	ErrCodeInvalidPayload      = "invalid_payload"
+	ErrCodeValidation          = "validation_error"
+	ErrCodeRouting             = "routing_error"
+	ErrCodeNotAuthorized       = "not_authorized"
+	ErrCodeRateLimited         = "rate_limited"
+	ErrCodePairingFailed       = "pairing_failed"
+	ErrCodePairingRejected     = "pairing_rejected"
+	ErrCodeResumeFailed        = "resume_failed"
+	ErrCodeInvalidToken        = "invalid_token"
+	ErrCodeTokenRevoked        = "token_revoked"
+	ErrCodeUnsupportedProtocol = "unsupported_protocol"
+
+	// Frames that could not be decoded
+	ErrCodeInvalidJSON    = "invalid_json"
+	ErrCodeInvalidMessage = "invalid_message"
+
+	// Requests the peer could not answer
+	ErrCodeMacUnavailable  = "mac_unavailable"
+	ErrCodePeerUnavailable = "peer_unavailable"
+	ErrCodeTimeout         = "timeout"
+)
+
+// ErrorCodes lists every error code the server sends.
+var ErrorCodes = []string{
+	ErrCodeUnknownEvent, ErrCodeInvalidDeviceType, ErrCodeNotInRoom,
+	ErrCodeInvalidPayload, ErrCodeValidation, ErrCodeRouting,
+	ErrCodeNotAuthorized, ErrCodeRateLimited, ErrCodePairingFailed,
+	ErrCodePairingRejected, ErrCodeResumeFailed, ErrCodeInvalidToken,
+	ErrCodeTokenRevoked, ErrCodeUnsupportedProtocol, ErrCodeInvalidJSON,
+	ErrCodeInvalidMessage, ErrCodeMacUnavailable, ErrCodePeerUnavailable,
+	ErrCodeTimeout,
+}
+
+// ErrorPayload is the payload of error.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Errors lists the offending fields of a validation_error.
+	Errors []FieldError `json:"errors,omitempty"`
+	// RetryAfterMs tells a rate_limited client when to try again.
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+}
+
+// NewError returns an ErrorPayload with code and message.
+func NewError(code, message string) ErrorPayload {
+	return ErrorPayload{Code: code, Message: message}
+}
+
+func (e ErrorPayload) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// FieldError is a payload field that is not valid, at Path such as
+// "since.battery" or "features[2]". The empty path is the payload itself.
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a payload.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		if f.Path == "" {
+			msgs = append(msgs, "payload "+f.Message)
+		} else {
+			msgs = append(msgs, f.Path+": "+f.Message)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validation collects FieldErrors for a Validate method.
+type validation struct {
+	fields []FieldError
+}
+
+func (v *validation) fail(path, format string, args ...any) {
+	v.fields = append(v.fields, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validation) required(path, value string) {
+	if value == "" {
+		v.fail(path, "is required")
+	}
+}
+
+func (v *validation) oneOf(path, value string, allowed []string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(path, "must be one of %s", strings.Join(allowed, ", "))
+}
+
+func (v *validation) atLeast(path string, value, lo float64) {
+	if value < lo {
+		v.fail(path, "must be at least %g", lo)
+	}
+}
+
+func (v *validation) between(path string, value, lo, hi float64) {
+	if value < lo || value > hi {
+		v.fail(path, "must be between %g and %g", lo, hi)
+	}
+}
+
+func (v *validation) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.fields}
+}
@@ -0,0 +1,157 @@
+// Package protocol defines the messages exchanged between the echo server
+// and devices: the event envelope, event types, error codes and typed
+// payloads. The server and Go clients share it so both sides agree on the
+// wire format.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Protocol versions. Version 1 is the original protocol, spoken by clients
+// that never send hello; Version is the latest, negotiated through hello.
+const (
+	LegacyVersion = 1
+	Version       = 2
+)
+
+// Device types, as carried in the device_type claim of a device's token.
+const (
+	DeviceTypeMac   = "mac"
+	DeviceTypeWatch = "watch"
+)
+
+// Event types.
+const (
+	// Connection events
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventHello      = "hello"
+	EventWelcome    = "welcome"
+
+	// Session events
+	EventAck     = "ack"
+	EventResume  = "resume"
+	EventResumed = "resumed"
+
+	// Token events
+	EventAuth           = "auth"
+	EventTokenExpiring  = "token_expiring"
+	EventRefreshToken   = "refresh_token"
+	EventTokenRefreshed = "token_refreshed"
+
+	// EventEventsDropped reports events lost to egress backpressure
+	EventEventsDropped = "events_dropped"
+
+	// Room events
+	EventCreateRoom = "create_room"
+	EventJoinRoom   = "join_room"
+	EventLeaveRoom  = "leave_room"
+	EventRoomJoined = "room_joined"
+	EventRoomStatus = "room_status"
+
+	// Pairing events
+	EventPairingRequest  = "pairing_request"
+	EventPairingCode     = "pairing_code"
+	EventPairingRedeem   = "pairing_redeem"
+	EventPairingPending  = "pairing_pending"
+	EventPairingApproval = "pairing_approval_request"
+	EventPairingDecision = "pairing_decision"
+
+	// Data sync events
+	EventDeviceInfo      = "device_info"
+	EventBatteryUpdate   = "battery_update"
+	EventDownloadsUpdate = "downloads_update"
+	EventStorageUpdate   = "storage_update"
+	EventSync            = "sync"
+	EventSyncResult      = "sync_result"
+
+	// Action events
+	EventAction        = "action"
+	EventActionRequest = "action_request"
+	EventActionResult  = "action_result"
+
+	// Media Action
+	EventMediaAction        = "media_action"
+	EventMediaActionRequest = "media_action_request"
+	EventMediaActionResult  = "media_action_result"
+
+	// Generic request/response
+	EventRequest  = "request"
+	EventResponse = "response"
+	EventError    = "error"
+
+	// Peer events
+	EventPeerConnected    = "peer_connected"
+	EventPeerDisconnected = "peer_disconnected"
+
+	// Status events
+	EventStatusUpdate = "status_update"
+)
+
+// Event is the envelope of every message. Payload holds one of the payload
+// types of this package, encoded as JSON.
+type Event struct {
+	Type      string          `json:"type"`
+	RoomID    string          `json:"room_id,omitempty"`
+	DeviceID  string          `json:"device_id,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	Version   uint64          `json:"version,omitempty"` // cache version of data sync events
+	Delta     bool            `json:"delta,omitempty"`   // Payload is a JSON merge patch (RFC 7386)
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	// Trace is an optional W3C trace context (traceparent, tracestate) that
+	// lets devices join the trace of a request.
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// Validator is implemented by payloads that can check their own fields.
+type Validator interface {
+	Validate() error
+}
+
+// NewEvent returns an event of type eventType carrying payload, which is
+// validated first if it implements Validator.
+func NewEvent(eventType string, payload any) (Event, error) {
+	if v, ok := payload.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return Event{}, fmt.Errorf("%s: %w", eventType, err)
+		}
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("%s: %w", eventType, err)
+	}
+	return Event{Type: eventType, Timestamp: time.Now(), Payload: b}, nil
+}
+
+// Decode unmarshals the payload of e into v and validates it if v
+// implements Validator.
+func (e Event) Decode(v any) error {
+	payload := e.Payload
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("%s: %w", e.Type, err)
+	}
+	if val, ok := v.(Validator); ok {
+		if err := val.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", e.Type, err)
+		}
+	}
+	return nil
+}
+
+// EncodePayload encodes a payload of this package, whose types always
+// marshal, for Event.Payload.
+func EncodePayload(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("protocol: encode %T: %v", v, err))
+	}
+	return b
+}
@@ -0,0 +1,267 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Connect is the payload of connect, sent by the server once a device's
+// connection is authenticated.
+type Connect struct {
+	// ResumeToken lets the device pick this session up again after a
+	// reconnect with resume.
+	ResumeToken        string `json:"resume_token"`
+	ProtocolVersion    int    `json:"protocol_version"`
+	MinProtocolVersion int    `json:"min_protocol_version"`
+	Encoding           string `json:"encoding"`
+}
+
+// Hello negotiates the protocol version, optional features and wire
+// encoding.
+type Hello struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features,omitempty"`
+	// Encodings lists the wire encodings the client accepts, most
+	// preferred first.
+	Encodings []string `json:"encodings,omitempty"`
+	// CompressionMinSize overrides the size below which messages are sent
+	// uncompressed on this connection.
+	CompressionMinSize *int `json:"compression_min_size,omitempty"`
+}
+
+// Welcome answers hello with what was agreed.
+type Welcome struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features"`
+	Encoding        string   `json:"encoding"`
+	ResumeToken     string   `json:"resume_token"`
+	Limits          Limits   `json:"limits"`
+}
+
+// Limits describes the server's limits in welcome.
+type Limits struct {
+	MaxMessageSize   int   `json:"max_message_size"`
+	RequestTimeoutMs int64 `json:"request_timeout_ms"`
+	StatusIntervalMs int64 `json:"status_interval_ms"`
+	ResumeWindowMs   int64 `json:"resume_window_ms"`
+	ReplayWindow     int   `json:"replay_window"`
+	EgressCapacity   int   `json:"egress_capacity"`
+	// CompressionMinSize only applies when permessage-deflate was
+	// negotiated.
+	CompressionMinSize int `json:"compression_min_size"`
+}
+
+// Ack acknowledges the events up to Seq.
+type Ack struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Resume moves a previous session onto a new connection.
+type Resume struct {
+	ResumeToken string `json:"resume_token"`
+	LastSeq     uint64 `json:"last_seq"`
+}
+
+// Resumed answers resume. FullResync is set when events were lost and the
+// device should sync.
+type Resumed struct {
+	Replayed   int  `json:"replayed"`
+	FullResync bool `json:"full_resync"`
+}
+
+// Auth carries the token of a connection opened without one.
+type Auth struct {
+	Token string `json:"token"`
+}
+
+// TokenExpiring warns that the connection's token is about to expire.
+type TokenExpiring struct {
+	ExpiresAt   time.Time `json:"expires_at"`
+	ExpiresInMs int64     `json:"expires_in_ms"`
+}
+
+// RefreshToken replaces the connection's token without reconnecting.
+type RefreshToken struct {
+	Token string `json:"token"`
+}
+
+// TokenRefreshed answers refresh_token.
+type TokenRefreshed struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EventsDropped reports events lost to backpressure, by event type.
+type EventsDropped struct {
+	Dropped map[string]int `json:"dropped"`
+	Total   int            `json:"total"`
+}
+
+// CreateRoom creates a room, or rejoins the owner's room RoomID.
+type CreateRoom struct {
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// JoinRoom joins a room. Since, as in Sync, asks for cache deltas instead
+// of snapshots.
+type JoinRoom struct {
+	RoomID string            `json:"room_id"`
+	Since  map[string]uint64 `json:"since,omitempty"`
+}
+
+// Room join statuses and roles in RoomJoined.
+const (
+	RoomStatusCreated  = "created"
+	RoomStatusRejoined = "rejoined"
+	RoomStatusJoined   = "joined"
+	RoomStatusPaired   = "paired"
+
+	RoleHost   = "host"
+	RoleClient = "client"
+)
+
+// RoomJoined tells a device it is in a room.
+type RoomJoined struct {
+	Status string `json:"status"`
+	Role   string `json:"role"`
+}
+
+// RoomStatusResponse answers room_status. Status is "true" or "false".
+type RoomStatusResponse struct {
+	Status string `json:"status"`
+}
+
+// Pairing modes.
+const (
+	PairingModePIN = "pin"
+	PairingModeQR  = "qr"
+)
+
+// PairingStatusAwaitingApproval is the status of PairingPending.
+const PairingStatusAwaitingApproval = "awaiting_approval"
+
+// PairingRequest asks for a pairing code, in PIN mode by default.
+type PairingRequest struct {
+	Mode string `json:"mode,omitempty"`
+}
+
+// PairingCode is the code a watch redeems to join the Mac's room.
+type PairingCode struct {
+	Mode      string    `json:"mode"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+	QRPayload string    `json:"qr_payload,omitempty"` // for PairingModeQR
+}
+
+// PairingRedeem redeems a pairing code.
+type PairingRedeem struct {
+	Code string `json:"code"`
+}
+
+// PairingPending tells the watch that the Mac has to approve it.
+type PairingPending struct {
+	Status string `json:"status"`
+}
+
+// PairingApproval asks the Mac to approve a watch.
+type PairingApproval struct {
+	DeviceID   string `json:"device_id"`
+	DeviceType string `json:"device_type"`
+}
+
+// PairingDecision is the Mac's answer to PairingApproval.
+type PairingDecision struct {
+	DeviceID string `json:"device_id"`
+	Approved bool   `json:"approved"`
+}
+
+// DeviceInfo describes the Mac. Devices may send further fields, which the
+// server passes through.
+type DeviceInfo struct {
+	Name  string `json:"name,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+// BatteryStatus is the payload of battery_update.
+type BatteryStatus struct {
+	Percent    float64 `json:"percent"`
+	IsCharging bool    `json:"is_charging"`
+}
+
+// StorageStatus is the payload of storage_update.
+type StorageStatus struct {
+	TotalBytes     int64 `json:"total_bytes"`
+	AvailableBytes int64 `json:"available_bytes"`
+}
+
+// DownloadsList is the payload of downloads_update.
+type DownloadsList struct {
+	Downloads []Download `json:"downloads"`
+}
+
+// Download is an entry of DownloadsList. Progress runs from 0 to 1.
+type Download struct {
+	Name     string  `json:"name"`
+	Progress float64 `json:"progress"`
+}
+
+// Sync asks for the cache entries that changed since the versions the
+// device holds, keyed by cache key.
+type Sync struct {
+	Since map[string]uint64 `json:"since,omitempty"`
+}
+
+// SyncResult answers sync, keyed by cache key.
+type SyncResult struct {
+	Entries map[string]CacheDelta `json:"entries"`
+}
+
+// CacheDelta brings a cache entry up to Version, either as a JSON Patch
+// against the version the device holds or as a full snapshot.
+type CacheDelta struct {
+	Version  uint64          `json:"version"`
+	Patch    []PatchOp       `json:"patch,omitempty"`
+	Snapshot json.RawMessage `json:"snapshot,omitempty"`
+}
+
+// PatchOp is a JSON Patch (RFC 6902) operation.
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Actions accepted in Action and MediaAction.
+var (
+	DeviceActions = []string{"shutdown", "sleep"}
+	MediaActions  = []string{"play", "pause", "volup", "voldown", "next", "prev", "volumeup", "volumedown"}
+)
+
+// Action asks the Mac to run one of DeviceActions. The watch sends it as
+// action_request, which the server relays to the Mac.
+type Action struct {
+	Action string `json:"action"`
+}
+
+// MediaAction asks the Mac to run one of MediaActions.
+type MediaAction struct {
+	Action string `json:"action"`
+}
+
+// Request is a generic request to the Mac. Actions the server can answer
+// from its cache, such as get_battery, never reach the Mac.
+type Request struct {
+	Action string `json:"action,omitempty"`
+}
+
+// PeerEvent announces that a device joined or left the room, as
+// peer_connected or peer_disconnected.
+type PeerEvent struct {
+	DeviceType string `json:"device_type"`
+}
+
+// StatusUpdate describes the room to one of its devices.
+type StatusUpdate struct {
+	InRoom          bool `json:"in_room"`
+	WatchConnected  bool `json:"watch_connected"`
+	MacDisconnected bool `json:"mac_disconnected,omitempty"`
+}
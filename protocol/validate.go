@@ -0,0 +1,117 @@
+package protocol
+
+import "fmt"
+
+// Ranges of numeric payload fields.
+const (
+	MinBatteryPercent = 0
+	MaxBatteryPercent = 100
+	MinProgress       = 0 // of a Download
+	MaxProgress       = 1
+)
+
+// MaxDownloads is the number of entries a DownloadsList may have.
+const MaxDownloads = 100
+
+func (p Hello) Validate() error {
+	var v validation
+	if p.ProtocolVersion < 1 {
+		v.fail("protocol_version", "must be at least 1")
+	}
+	if p.CompressionMinSize != nil && *p.CompressionMinSize < 0 {
+		v.fail("compression_min_size", "must be at least 0")
+	}
+	return v.err()
+}
+
+func (p Resume) Validate() error {
+	var v validation
+	v.required("resume_token", p.ResumeToken)
+	return v.err()
+}
+
+func (p Auth) Validate() error {
+	var v validation
+	v.required("token", p.Token)
+	return v.err()
+}
+
+func (p RefreshToken) Validate() error {
+	var v validation
+	v.required("token", p.Token)
+	return v.err()
+}
+
+func (p JoinRoom) Validate() error {
+	var v validation
+	v.required("room_id", p.RoomID)
+	return v.err()
+}
+
+func (p PairingRequest) Validate() error {
+	var v validation
+	if p.Mode != "" {
+		v.oneOf("mode", p.Mode, []string{PairingModePIN, PairingModeQR})
+	}
+	return v.err()
+}
+
+func (p PairingRedeem) Validate() error {
+	var v validation
+	v.required("code", p.Code)
+	return v.err()
+}
+
+func (p PairingDecision) Validate() error {
+	var v validation
+	v.required("device_id", p.DeviceID)
+	return v.err()
+}
+
+func (p BatteryStatus) Validate() error {
+	var v validation
+	v.between("percent", p.Percent, MinBatteryPercent, MaxBatteryPercent)
+	return v.err()
+}
+
+func (p StorageStatus) Validate() error {
+	var v validation
+	v.atLeast("total_bytes", float64(p.TotalBytes), 0)
+	v.atLeast("available_bytes", float64(p.AvailableBytes), 0)
+	return v.err()
+}
+
+func (p DownloadsList) Validate() error {
+	var v validation
+	if len(p.Downloads) > MaxDownloads {
+		v.fail("downloads", "must have at most %d items", MaxDownloads)
+	}
+	for i, d := range p.Downloads {
+		v.between(fmt.Sprintf("downloads[%d].progress", i), d.Progress, MinProgress, MaxProgress)
+	}
+	return v.err()
+}
+
+func (p Action) Validate() error {
+	var v validation
+	v.oneOf("action", p.Action, DeviceActions)
+	return v.err()
+}
+
+func (p MediaAction) Validate() error {
+	var v validation
+	v.oneOf("action", p.Action, MediaActions)
+	return v.err()
+}
+
+func (p PeerEvent) Validate() error {
+	var v validation
+	v.oneOf("device_type", p.DeviceType, []string{DeviceTypeMac, DeviceTypeWatch})
+	return v.err()
+}
+
+func (p ErrorPayload) Validate() error {
+	var v validation
+	v.required("code", p.Code)
+	return v.err()
+}
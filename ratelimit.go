@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"echo/protocol"
+)
+
+// Keys of rateLimits that are not event types.
+const (
+	rateLimitUpgrade = "upgrade" // WebSocket upgrades per IP
+	rateLimitDevice  = "*"       // all events of a device
+)
+
+// rateLimit is a token bucket budget: rate tokens per second, up to burst.
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+// rateLimits maps event types to the budget each device has for them.
+// Types not listed get defaultEventRateLimit. Every event also counts
+// against the rateLimitDevice budget.
+var rateLimits = map[string]rateLimit{
+	rateLimitUpgrade: {rate: 0.5, burst: 10},
+	rateLimitDevice:  {rate: 30, burst: 60},
+
+	EventAck:             {rate: 50, burst: 100},
+	EventHello:           {rate: 0.2, burst: 3},
+	EventResume:          {rate: 0.2, burst: 3},
+	EventRefreshToken:    {rate: 0.1, burst: 3},
+	EventCreateRoom:      {rate: 0.2, burst: 3},
+	EventJoinRoom:        {rate: 0.5, burst: 5},
+	EventPairingRequest:  {rate: 0.2, burst: 3},
+	EventPairingRedeem:   {rate: 0.2, burst: 3},
+	EventActionRequest:   {rate: 5, burst: 10},
+	EventMediaAction:     {rate: 5, burst: 10},
+	EventBatteryUpdate:   {rate: 2, burst: 5},
+	EventStorageUpdate:   {rate: 1, burst: 5},
+	EventDownloadsUpdate: {rate: 5, burst: 10},
+}
+
+var defaultEventRateLimit = rateLimit{rate: 10, burst: 20}
+
+// loadRateLimits overrides rateLimits from a spec such as
+// "upgrade=1:20,*=50:100,battery_update=1:3", giving each budget as
+// rate per second and burst.
+func loadRateLimits(spec string) error {
+	for _, entry := range splitList(spec) {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid rate limit %q: want type=rate:burst", entry)
+		}
+		rateStr, burstStr, ok := strings.Cut(value, ":")
+		if !ok {
+			return fmt.Errorf("invalid rate limit %q: want type=rate:burst", entry)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid rate in %q", entry)
+		}
+		burst, err := strconv.ParseFloat(strings.TrimSpace(burstStr), 64)
+		if err != nil || burst < 1 {
+			return fmt.Errorf("invalid burst in %q", entry)
+		}
+		rateLimits[strings.TrimSpace(key)] = rateLimit{rate: rate, burst: burst}
+	}
+	return nil
+}
+
+func rateLimitFor(key string) rateLimit {
+	if limit, ok := rateLimits[key]; ok {
+		return limit
+	}
+	return defaultEventRateLimit
+}
+
+// tokenBucket allows bursts of up to limit.burst and refills at limit.rate.
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.burst, last: now}
+}
+
+// take spends a token. If none is left it returns false and how long until
+// the next one.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(b.limit.burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.limit.rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// deviceLimits holds the budgets of one device, shared by its connections
+// so reconnecting does not reset them.
+type deviceLimits struct {
+	total       *tokenBucket
+	byType      map[string]*tokenBucket
+	strikes     int // rejected events since strikeStart
+	strikeStart time.Time
+	lastSeen    time.Time
+}
+
+// RateLimiter enforces rateLimits on this instance.
+type RateLimiter struct {
+	mu        sync.Mutex
+	ips       map[string]*tokenBucket
+	devices   map[string]*deviceLimits
+	lastSweep time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		ips:       make(map[string]*tokenBucket),
+		devices:   make(map[string]*deviceLimits),
+		lastSweep: time.Now(),
+	}
+}
+
+// allowUpgrade spends a token of the upgrade budget of ip.
+func (rl *RateLimiter) allowUpgrade(ip string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.sweepLocked(now)
+	b := rl.ips[ip]
+	if b == nil {
+		b = newTokenBucket(rateLimitFor(rateLimitUpgrade), now)
+		rl.ips[ip] = b
+	}
+	return b.take(now)
+}
+
+// allowEvent spends a token of the device's budget for eventType and of
+// its overall budget. When either is exhausted it returns how long the
+// client should wait and whether the device has been rejected often enough
+// to be disconnected.
+func (rl *RateLimiter) allowEvent(deviceID, eventType string) (ok bool, retryAfter time.Duration, disconnect bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.sweepLocked(now)
+	d := rl.devices[deviceID]
+	if d == nil {
+		d = &deviceLimits{
+			total:  newTokenBucket(rateLimitFor(rateLimitDevice), now),
+			byType: make(map[string]*tokenBucket),
+		}
+		rl.devices[deviceID] = d
+	}
+	d.lastSeen = now
+
+	b := d.byType[eventType]
+	if b == nil {
+		b = newTokenBucket(rateLimitFor(eventType), now)
+		d.byType[eventType] = b
+	}
+	// Check the type budget first so a flood of one type does not also
+	// drain the overall budget.
+	if ok, retryAfter = b.take(now); ok {
+		if ok, retryAfter = d.total.take(now); ok {
+			return true, 0, false
+		}
+		// Refund the type token, the event is not delivered.
+		b.tokens++
+	}
+
+	if now.Sub(d.strikeStart) > rateLimitStrikeWindow {
+		d.strikes, d.strikeStart = 0, now
+	}
+	d.strikes++
+	return false, retryAfter, d.strikes > rateLimitMaxStrikes
+}
+
+// sweepLocked drops the state of IPs and devices that have been idle long
+// enough for their buckets to have refilled.
+func (rl *RateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for ip, b := range rl.ips {
+		if now.Sub(b.last) > rateLimitIdleTimeout {
+			delete(rl.ips, ip)
+		}
+	}
+	for id, d := range rl.devices {
+		if now.Sub(d.lastSeen) > rateLimitIdleTimeout {
+			delete(rl.devices, id)
+		}
+	}
+}
+
+// clientIP returns the address the upgrade request came from. Behind
+// forwardedForHops proxies it is taken from X-Forwarded-For, counting the
+// entries added by those proxies from the right, since anything further
+// left is set by the client.
+func clientIP(r *http.Request) string {
+	if forwardedForHops > 0 {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, splitList(header)...)
+		}
+		if len(hops) >= forwardedForHops {
+			return hops[len(hops)-forwardedForHops]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedForHops is the number of trusted proxies in front of the
+// server, set from FORWARDED_FOR_HOPS. Zero ignores X-Forwarded-For.
+var forwardedForHops int
+
+// rejectRateLimited tells c that ev was dropped and when to retry, and
+// disconnects it if it keeps ignoring the limit.
+func (c *Client) rejectRateLimited(ev Event, retryAfter time.Duration, disconnect bool) {
+	rateLimited.WithLabelValues(c.manager.eventTypeLabel(ev.Type)).Inc()
+	if disconnect {
+		c.logger().Warn("Disconnecting device exceeding rate limits", eventAttrs(ev)...)
+		c.closeWithReason(websocket.ClosePolicyViolation, ErrCodeRateLimited)
+		return
+	}
+
+	c.logger().Debug("Event rate limited", append(eventAttrs(ev), "retry_after", retryAfter)...)
+	c.send(Event{
+		Type:      EventError,
+		RequestID: ev.RequestID,
+		Timestamp: time.Now(),
+		Payload: protocol.EncodePayload(protocol.ErrorPayload{
+			Code:         ErrCodeRateLimited,
+			Message:      "too many " + ev.Type + " events",
+			RetryAfterMs: retryAfter.Milliseconds(),
+		}),
+	})
+}
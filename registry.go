@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"echo/protocol"
+)
+
+// Error codes reported to clients, defined in the protocol package.
+const (
+	ErrCodeUnknownEvent      = protocol.ErrCodeUnknownEvent
+	ErrCodeInvalidDeviceType = protocol.ErrCodeInvalidDeviceType
+	ErrCodeNotInRoom         = protocol.ErrCodeNotInRoom
+	ErrCodeInvalidPayload    = protocol.ErrCodeInvalidPayload
+	ErrCodeValidation        = protocol.ErrCodeValidation
+	ErrCodeRouting           = protocol.ErrCodeRouting
+	ErrCodeNotAuthorized     = protocol.ErrCodeNotAuthorized
+	ErrCodeRateLimited       = protocol.ErrCodeRateLimited
+	ErrCodePairingFailed     = protocol.ErrCodePairingFailed
+	ErrCodePairingRejected   = protocol.ErrCodePairingRejected
+	ErrCodeResumeFailed      = protocol.ErrCodeResumeFailed
+	ErrCodeInvalidToken      = protocol.ErrCodeInvalidToken
+	ErrCodeTokenRevoked      = protocol.ErrCodeTokenRevoked
+
+	ErrCodeUnsupportedProtocol = protocol.ErrCodeUnsupportedProtocol
+
+	ErrCodeInvalidJSON     = protocol.ErrCodeInvalidJSON
+	ErrCodeInvalidMessage  = protocol.ErrCodeInvalidMessage
+	ErrCodeMacUnavailable  = protocol.ErrCodeMacUnavailable
+	ErrCodePeerUnavailable = protocol.ErrCodePeerUnavailable
+	ErrCodeTimeout         = protocol.ErrCodeTimeout
+)
+
+// RouteError is an error that carries a machine-readable code for the client.
+type RouteError struct {
+	Code    string
+	Message string
+	Fields  []FieldError // offending fields of a validation_error
+}
+
+func (e *RouteError) Error() string {
+	return e.Message
+}
+
+func newRouteError(code, format string, args ...any) *RouteError {
+	return &RouteError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// RoomPolicy controls how the registry treats events from clients that are not in a room.
+type RoomPolicy int
+
+const (
+	// RoomOptional dispatches the event whether or not the client is in a room.
+	RoomOptional RoomPolicy = iota
+	// RoomRequired rejects the event with ErrCodeNotInRoom.
+	RoomRequired
+	// RoomIgnore silently drops the event. Used for data sync events that
+	// clients may send before they have joined a room.
+	RoomIgnore
+)
+
+// HandlerFunc handles a single inbound event from a client.
+type HandlerFunc func(ev Event, c *Client) error
+
+// EventHandler describes how an inbound event type is validated and handled.
+type EventHandler struct {
+	Type        string
+	DeviceTypes []string // allowed device types; empty allows any
+	Room        RoomPolicy
+	Schema      *PayloadSchema // validated before Handle runs
+	Handle      HandlerFunc
+
+	// Summary, Replies and Relay describe the event in the protocol
+	// specification served at /asyncapi.json.
+	Summary string
+	Replies []string // event types sent back to the sender
+	Relay   bool     // the event is delivered to the other devices of the room
+}
+
+func (h *EventHandler) allowsDevice(deviceType string) bool {
+	if len(h.DeviceTypes) == 0 {
+		return true
+	}
+	for _, t := range h.DeviceTypes {
+		if t == deviceType {
+			return true
+		}
+	}
+	return false
+}
+
+// HandlerRegistry maps event types to their handlers.
+type HandlerRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]*EventHandler
+}
+
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{
+		handlers: make(map[string]*EventHandler),
+	}
+}
+
+// Register adds a handler. It panics if the type is empty, the handler or
+// schema is nil or the type is already registered, since all of these are
+// programming errors.
+func (hr *HandlerRegistry) Register(h EventHandler) {
+	if h.Type == "" {
+		panic("registry: empty event type")
+	}
+	if h.Handle == nil {
+		panic("registry: nil handler for " + h.Type)
+	}
+	if h.Schema == nil {
+		panic("registry: nil schema for " + h.Type)
+	}
+
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if _, exists := hr.handlers[h.Type]; exists {
+		panic("registry: multiple registrations for " + h.Type)
+	}
+	hr.handlers[h.Type] = &h
+}
+
+// all returns the registered handlers sorted by event type.
+func (hr *HandlerRegistry) all() []*EventHandler {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	handlers := make([]*EventHandler, 0, len(hr.handlers))
+	for _, h := range hr.handlers {
+		handlers = append(handlers, h)
+	}
+	sort.Slice(handlers, func(i, j int) bool { return handlers[i].Type < handlers[j].Type })
+	return handlers
+}
+
+func (hr *HandlerRegistry) lookup(eventType string) (*EventHandler, bool) {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	h, ok := hr.handlers[eventType]
+	return h, ok
+}
+
+// dispatch runs the registry checks for ev and invokes its handler.
+func (hr *HandlerRegistry) dispatch(ev Event, c *Client) error {
+	h, ok := hr.lookup(ev.Type)
+	if !ok {
+		return newRouteError(ErrCodeUnknownEvent, "unknown event type: %s", ev.Type)
+	}
+
+	if !h.allowsDevice(c.deviceType) {
+		return newRouteError(ErrCodeInvalidDeviceType, "device type %s cannot send %s", c.deviceType, ev.Type)
+	}
+
+	c.mu.RLock()
+	inRoom := c.room != nil
+	c.mu.RUnlock()
+	if !inRoom {
+		switch h.Room {
+		case RoomRequired:
+			return newRouteError(ErrCodeNotInRoom, "not in a room")
+		case RoomIgnore:
+			return nil
+		}
+	}
+
+	if err := h.Schema.validate(ev.Payload); err != nil {
+		return err
+	}
+
+	return h.Handle(ev, c)
+}
+
+// FieldType is the JSON type expected for a payload field.
+type FieldType string
+
+const (
+	FieldString  FieldType = "string"
+	FieldNumber  FieldType = "number"
+	FieldInteger FieldType = "integer"
+	FieldBoolean FieldType = "boolean"
+	FieldObject  FieldType = "object"
+	FieldArray   FieldType = "array"
+	// FieldAny accepts any JSON value.
+	FieldAny FieldType = "any"
+)
+
+// FieldSchema describes a payload field. Constraints that do not apply to
+// the field's type are ignored; zero values leave them unchecked.
+type FieldSchema struct {
+	Name     string
+	Type     FieldType
+	Required bool
+
+	Min, Max  *float64 // numbers
+	MaxLength int      // strings, in bytes
+	Enum      []string // strings
+	MaxItems  int      // arrays and objects
+
+	Items  *FieldSchema  // elements of an array
+	Fields []FieldSchema // known members of an object
+	Values *FieldSchema  // every member of an object, e.g. a map
+}
+
+// PayloadSchema describes the payload of an event, by default a JSON
+// object. Members not listed in Fields are passed through unchecked.
+type PayloadSchema struct {
+	Type    FieldType // of the payload itself; empty means FieldObject
+	Fields  []FieldSchema
+	MaxSize int // bytes; 0 means maxPayloadSize
+}
+
+// bound returns a pointer to v for FieldSchema.Min and Max.
+func bound(v float64) *float64 {
+	return &v
+}
+
+// FieldError is a payload that violates its schema at Path, a field path
+// such as "since.battery" or "features[2]". The empty path is the payload
+// itself.
+type FieldError = protocol.FieldError
+
+// validationError reports all violations of a schema at once.
+func validationError(errs []FieldError) *RouteError {
+	msg := "payload " + errs[0].Message
+	if errs[0].Path != "" {
+		msg = errs[0].Path + ": " + errs[0].Message
+	}
+	if len(errs) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(errs)-1)
+	}
+	return &RouteError{Code: ErrCodeValidation, Message: msg, Fields: errs}
+}
+
+// decodePayload decodes the payload of ev into v, a protocol payload type,
+// and reports what its Validate method rejects as a validation_error, so
+// that the server enforces the rules the protocol package gives clients.
+func decodePayload(ev Event, v any) error {
+	err := ev.Decode(v)
+	var invalid *protocol.ValidationError
+	if errors.As(err, &invalid) {
+		return validationError(invalid.Fields)
+	}
+	if err != nil {
+		return newRouteError(ErrCodeInvalidPayload, "invalid payload: %v", err)
+	}
+	return nil
+}
+
+func (s *PayloadSchema) validate(payload json.RawMessage) error {
+	maxSize := s.MaxSize
+	if maxSize == 0 {
+		maxSize = maxPayloadSize
+	}
+	if len(payload) > maxSize {
+		return validationError([]FieldError{{Message: fmt.Sprintf("exceeds %d bytes", maxSize)}})
+	}
+
+	payload = bytes.TrimSpace(payload)
+	root := FieldSchema{Type: s.Type, Fields: s.Fields}
+	if root.Type == "" {
+		root.Type = FieldObject
+		// An absent payload is an empty object.
+		if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+			payload = []byte("{}")
+		}
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	var v schemaValidator
+	v.check(&root, "", payload)
+	if len(v.errs) > 0 {
+		return validationError(v.errs)
+	}
+	return nil
+}
+
+// schemaValidator collects the violations of a payload.
+type schemaValidator struct {
+	errs []FieldError
+}
+
+func (v *schemaValidator) fail(path, format string, args ...any) {
+	if len(v.errs) < maxValidationErrors {
+		v.errs = append(v.errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (v *schemaValidator) check(f *FieldSchema, path string, raw json.RawMessage) {
+	if f.Type == FieldAny {
+		return
+	}
+	got := jsonType(raw)
+	if got != f.Type && !(f.Type == FieldInteger && got == FieldNumber) {
+		v.fail(path, "must be %s", article(f.Type))
+		return
+	}
+
+	switch f.Type {
+	case FieldNumber, FieldInteger:
+		var n float64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			v.fail(path, "must be a valid number")
+			return
+		}
+		if f.Type == FieldInteger && n != math.Trunc(n) {
+			v.fail(path, "must be an integer")
+		}
+		if f.Min != nil && n < *f.Min {
+			v.fail(path, "must be at least %g", *f.Min)
+		}
+		if f.Max != nil && n > *f.Max {
+			v.fail(path, "must be at most %g", *f.Max)
+		}
+
+	case FieldString:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			v.fail(path, "must be a valid string")
+			return
+		}
+		if f.MaxLength > 0 && len(s) > f.MaxLength {
+			v.fail(path, "must be at most %d bytes", f.MaxLength)
+		}
+		if len(f.Enum) > 0 && !slices.Contains(f.Enum, s) {
+			v.fail(path, "must be one of %s", strings.Join(f.Enum, ", "))
+		}
+
+	case FieldArray:
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			v.fail(path, "must be a valid array")
+			return
+		}
+		if f.MaxItems > 0 && len(items) > f.MaxItems {
+			v.fail(path, "must have at most %d items", f.MaxItems)
+			return
+		}
+		if f.Items != nil {
+			for i, item := range items {
+				v.check(f.Items, fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+
+	case FieldObject:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			v.fail(path, "must be a valid object")
+			return
+		}
+		if f.MaxItems > 0 && len(obj) > f.MaxItems {
+			v.fail(path, "must have at most %d members", f.MaxItems)
+			return
+		}
+		for i := range f.Fields {
+			field := &f.Fields[i]
+			fieldPath := joinPath(path, field.Name)
+			value, ok := obj[field.Name]
+			if !ok || bytes.Equal(value, []byte("null")) {
+				if field.Required {
+					v.fail(fieldPath, "is required")
+				}
+				continue
+			}
+			v.check(field, fieldPath, value)
+		}
+		if f.Values != nil {
+			keys := make([]string, 0, len(obj))
+			for key := range obj {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				v.check(f.Values, joinPath(path, key), obj[key])
+			}
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func article(t FieldType) string {
+	switch t {
+	case FieldArray, FieldObject, FieldInteger:
+		return "an " + string(t)
+	default:
+		return "a " + string(t)
+	}
+}
+
+func jsonType(raw json.RawMessage) FieldType {
+	switch raw[0] {
+	case '"':
+		return FieldString
+	case '{':
+		return FieldObject
+	case '[':
+		return FieldArray
+	case 't', 'f':
+		return FieldBoolean
+	case 'n':
+		return "null"
+	default:
+		return FieldNumber
+	}
+}
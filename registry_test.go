@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestPayloadSchemaValidate runs payloads against the schemas of the
+// registered handlers and compares the paths of the reported field errors.
+func TestPayloadSchemaValidate(t *testing.T) {
+	download := `{"name":"a.zip","progress":0.5}`
+	tooManyDownloads := `{"downloads":[` + strings.Repeat(download+",", 100) + download + `]}`
+
+	tests := []struct {
+		name      string
+		eventType string
+		payload   string
+		want      []string // paths of the field errors; nil if valid
+	}{
+		{"valid", EventBatteryUpdate, `{"percent":42,"is_charging":true}`, nil},
+		{"range bounds", EventBatteryUpdate, `{"percent":100}`, nil},
+		{"unknown fields pass", EventBatteryUpdate, `{"percent":0,"health":"good"}`, nil},
+		{"missing required", EventBatteryUpdate, `{"is_charging":true}`, []string{"percent"}},
+		{"null required", EventBatteryUpdate, `{"percent":null}`, []string{"percent"}},
+		{"below min", EventBatteryUpdate, `{"percent":-1}`, []string{"percent"}},
+		{"above max", EventBatteryUpdate, `{"percent":100.5}`, []string{"percent"}},
+		{"wrong type", EventBatteryUpdate, `{"percent":"full","is_charging":1}`, []string{"percent", "is_charging"}},
+		{"root not an object", EventBatteryUpdate, `[42]`, []string{""}},
+		{"exceeds max size", EventBatteryUpdate, `{"percent":1,"pad":"` + strings.Repeat("x", 1024) + `"}`, []string{""}},
+		{"absent payload", EventRoomStatus, ``, nil},
+		{"not an integer", EventStorageUpdate, `{"total_bytes":1.5,"available_bytes":1}`, []string{"total_bytes"}},
+		{"negative integer", EventStorageUpdate, `{"total_bytes":10,"available_bytes":-1}`, []string{"available_bytes"}},
+		{"all required missing", EventStorageUpdate, `{}`, []string{"total_bytes", "available_bytes"}},
+		{"nested valid", EventDownloadsUpdate, `{"downloads":[` + download + `]}`, nil},
+		{"nested out of range", EventDownloadsUpdate, `{"downloads":[{"name":"a","progress":1.5}]}`, []string{"downloads[0].progress"}},
+		{"nested missing", EventDownloadsUpdate, `{"downloads":[` + download + `,{"progress":0}]}`, []string{"downloads[1].name"}},
+		{"array not an object", EventDownloadsUpdate, `[` + download + `]`, []string{""}},
+		{"too many items", EventDownloadsUpdate, tooManyDownloads, []string{"downloads"}},
+		{"map values", EventSync, `{"since":{"battery_update":3,"storage_update":-1}}`, []string{"since.storage_update"}},
+		{"enum", EventActionRequest, `{"action":"reboot"}`, []string{"action"}},
+		{"max length", EventJoinRoom, `{"room_id":"` + strings.Repeat("a", 65) + `"}`, []string{"room_id"}},
+		{"array items", EventHello, `{"protocol_version":2,"features":["resume",7]}`, []string{"features[1]"}},
+		{"opaque payload", EventResponse, `"any value"`, nil},
+	}
+
+	handlers := specManager().handlers
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, ok := handlers.lookup(tt.eventType)
+			if !ok {
+				t.Fatalf("no handler for %s", tt.eventType)
+			}
+			err := h.Schema.validate(json.RawMessage(tt.payload))
+
+			var got []string
+			if err != nil {
+				var routeErr *RouteError
+				if !errors.As(err, &routeErr) || routeErr.Code != ErrCodeValidation {
+					t.Fatalf("got %v, want a %s", err, ErrCodeValidation)
+				}
+				for _, f := range routeErr.Fields {
+					got = append(got, f.Path)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("field errors at %q, want %q (%v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	err := validationError([]FieldError{
+		{Path: "downloads[0].progress", Message: "must be at most 1"},
+		{Path: "downloads[1].name", Message: "is required"},
+	})
+	if want := "downloads[0].progress: must be at most 1 (and 1 more)"; err.Message != want {
+		t.Errorf("message %q, want %q", err.Message, want)
+	}
+
+	err = validationError([]FieldError{{Message: "must be an object"}})
+	if want := "payload must be an object"; err.Message != want {
+		t.Errorf("message %q, want %q", err.Message, want)
+	}
+}
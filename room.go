@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
+	"sort"
 	"sync"
 	"time"
+
+	"echo/protocol"
 )
 
 type Room struct {
@@ -12,9 +15,39 @@ type Room struct {
 	mu       sync.RWMutex
 	clients  map[string]*Client
 	cache    *RoomCache
-	pending  map[string]chan Event
+	pending  map[string]*pendingRequest
 	macID    string
 	isActive bool
+	// authorized holds the device IDs of watches paired with this room.
+	authorized map[string]bool
+	createdAt  time.Time
+
+	cluster *Cluster
+	// remote holds devices of this room connected to other instances.
+	remote map[string]remotePeer
+
+	outboxMu sync.Mutex
+	outboxes map[string]*outbox // deviceID -> events held while away
+
+	telemetryMu sync.Mutex
+	telemetry   map[string]*telemetryState // event type -> throttle state
+}
+
+// pendingRequest is a request forwarded to a peer, waiting for its response.
+type pendingRequest struct {
+	ch        chan Event
+	eventType string // type of the request, for latency metrics
+	started   time.Time
+}
+
+type remotePeer struct {
+	node       string
+	deviceType string
+	seenAt     time.Time
+}
+
+func (p remotePeer) fresh() bool {
+	return time.Since(p.seenAt) <= presenceTTL
 }
 
 func NewRoom(id, macID string) *Room {
@@ -22,11 +55,70 @@ func NewRoom(id, macID string) *Room {
 		id:       id,
 		clients:  make(map[string]*Client),
 		cache:    NewRoomCache(),
-		pending:  make(map[string]chan Event),
+		pending:  make(map[string]*pendingRequest),
 		macID:    macID,
 		isActive: true,
+
+		authorized: make(map[string]bool),
+		createdAt:  time.Now(),
+		remote:     make(map[string]remotePeer),
+		outboxes:   make(map[string]*outbox),
+		telemetry:  make(map[string]*telemetryState),
+	}
+}
+
+// restoreRoom rebuilds a room from its persisted record. Restored rooms stay
+// inactive until the owner Mac reconnects.
+func restoreRoom(rec RoomRecord) *Room {
+	r := NewRoom(rec.ID, rec.MacID)
+	r.isActive = false
+	r.createdAt = rec.CreatedAt
+	for _, deviceID := range rec.Authorized {
+		r.authorized[deviceID] = true
+	}
+	return r
+}
+
+// record returns the persisted form of the room.
+func (r *Room) record() RoomRecord {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	authorized := make([]string, 0, len(r.authorized))
+	for deviceID := range r.authorized {
+		authorized = append(authorized, deviceID)
+	}
+	sort.Strings(authorized)
+
+	return RoomRecord{
+		ID:         r.id,
+		MacID:      r.macID,
+		Authorized: authorized,
+		CreatedAt:  r.createdAt,
+		UpdatedAt:  time.Now(),
 	}
 }
+
+// authorize records deviceID as a paired watch that may join the room.
+func (r *Room) authorize(deviceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authorized[deviceID] = true
+}
+
+func (r *Room) isAuthorized(deviceID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.authorized[deviceID]
+}
+
+// hasPairings reports whether any watch has been paired with the room.
+func (r *Room) hasPairings() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.authorized) > 0
+}
+
 func (r *Room) addClient(c *Client) {
 	if c == nil {
 		return
@@ -39,8 +131,10 @@ func (r *Room) addClient(c *Client) {
 	// Replace any existing connection for the same device ID.
 	// This prevents stale disconnect handlers from deleting the new connection.
 	r.clients[c.deviceID] = c
+	delete(r.remote, c.deviceID)
 	c.mu.Lock()
 	c.room = r
+	c.lastRoom = r
 	c.mu.Unlock()
 	r.mu.Unlock()
 
@@ -48,14 +142,23 @@ func (r *Room) addClient(c *Client) {
 		prior.closeConn()
 	}
 
+	queued := r.takeOutbox(c.deviceID)
+
+	r.cluster.announce(r.id, c.deviceID, c.deviceType)
+
 	// Notify other clients about the new peer
 	r.broadcastExcept(c.deviceID, Event{
 		Type:      EventPeerConnected,
 		RoomID:    r.id,
 		DeviceID:  c.deviceID,
 		Timestamp: time.Now(),
-		Payload:   []byte(fmt.Sprintf(`{"device_type":"%s"}`, c.deviceType)),
+		Payload:   protocol.EncodePayload(protocol.PeerEvent{DeviceType: c.deviceType}),
 	})
+
+	// Replay what the device missed while it was away
+	for _, ev := range queued {
+		c.send(ev)
+	}
 }
 
 func (r *Room) removeClient(c *Client) {
@@ -64,12 +167,12 @@ func (r *Room) removeClient(c *Client) {
 	}
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
 	// Only remove if this is still the active connection for this device.
 	// A stale connection (e.g., after a quick reconnect) must not delete the new one.
 	existing, exists := r.clients[c.deviceID]
 	if !exists || existing != c {
+		r.mu.Unlock()
 		return
 	}
 
@@ -91,88 +194,76 @@ func (r *Room) removeClient(c *Client) {
 	// Otherwise, we'll let them timeout naturally
 	if isMac {
 		// Mac disconnected - clean up all pending requests
-		for reqID, ch := range r.pending {
+		for reqID, req := range r.pending {
 			select {
-			case <-ch:
+			case <-req.ch:
 				// Channel already closed or received
 			default:
-				close(ch)
+				close(req.ch)
 			}
 			delete(r.pending, reqID)
 		}
-	}
 
-	// Notify remaining clients about the disconnection
-	remainingClients := make([]*Client, 0, len(r.clients))
-	for _, client := range r.clients {
-		if client != nil {
-			remainingClients = append(remainingClients, client)
-		}
+		// If mac leaves, deactivate room
+		r.isActive = false
 	}
+	r.mu.Unlock()
+
+	r.openOutbox(deviceID, deviceType)
+
+	r.cluster.withdraw(r.id, deviceID, deviceType)
+
+	// Notify remaining clients, on this and other instances, about the disconnection
+	r.broadcastExcept(deviceID, Event{
+		Type:      EventPeerDisconnected,
+		RoomID:    r.id,
+		DeviceID:  deviceID,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.PeerEvent{DeviceType: deviceType}),
+	})
 
-	// If mac leaves, deactivate room and notify all watches
 	if isMac {
-		r.isActive = false
-		statusPayload, _ := json.Marshal(map[string]any{"in_room": false, "mac_disconnected": true})
-		statusEvent := Event{
+		r.broadcastExcept(deviceID, Event{
 			Type:      EventStatusUpdate,
 			RoomID:    r.id,
 			Timestamp: time.Now(),
-			Payload:   statusPayload,
-		}
+			Payload:   protocol.EncodePayload(protocol.StatusUpdate{MacDisconnected: true}),
+		})
+		return
+	}
 
-		// Notify all remaining clients (watches)
-		for _, client := range remainingClients {
-			if client != nil {
-				client.send(Event{
-					Type:      EventPeerDisconnected,
-					RoomID:    r.id,
-					DeviceID:  deviceID,
-					Timestamp: time.Now(),
-					Payload:   []byte(fmt.Sprintf(`{"device_type":"%s"}`, deviceType)),
-				})
-				client.send(statusEvent)
-			}
-		}
-	} else {
-		// Watch disconnected - notify remaining clients
-		disconnectEvent := Event{
-			Type:      EventPeerDisconnected,
-			RoomID:    r.id,
-			DeviceID:  deviceID,
-			Timestamp: time.Now(),
-			Payload:   []byte(fmt.Sprintf(`{"device_type":"%s"}`, deviceType)),
-		}
+	// Notify Mac about watch disconnection
+	r.sendToPeer(DeviceTypeMac, Event{
+		Type:      EventStatusUpdate,
+		RoomID:    r.id,
+		Timestamp: time.Now(),
+		Payload: protocol.EncodePayload(protocol.StatusUpdate{
+			InRoom:         true,
+			WatchConnected: r.hasPeer(DeviceTypeWatch),
+		}),
+	})
+}
 
-		for _, client := range remainingClients {
-			if client != nil {
-				client.send(disconnectEvent)
-			}
-		}
+// evict drops a local connection that has been superseded by a connection
+// of the same device on another instance. No disconnect is announced since
+// the device is still in the room.
+func (r *Room) evict(deviceID string) {
+	r.mu.Lock()
+	c, exists := r.clients[deviceID]
+	if exists {
+		delete(r.clients, deviceID)
+	}
+	r.mu.Unlock()
 
-		// Notify Mac about watch disconnection
-		if mac := r.getPeer(DeviceTypeMac); mac != nil {
-			watchConnected := false
-			for _, client := range remainingClients {
-				if client != nil && client.deviceType == DeviceTypeWatch {
-					watchConnected = true
-					break
-				}
-			}
-			statusPayload, _ := json.Marshal(map[string]any{
-				"in_room":         true,
-				"watch_connected": watchConnected,
-			})
-			mac.send(Event{
-				Type:      EventStatusUpdate,
-				RoomID:    r.id,
-				Timestamp: time.Now(),
-				Payload:   statusPayload,
-			})
-		}
+	if exists {
+		c.mu.Lock()
+		c.room = nil
+		c.mu.Unlock()
+		c.closeConn()
 	}
 }
 
+// getPeer returns a local client of the given device type.
 func (r *Room) getPeer(deviceType string) *Client {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -185,43 +276,163 @@ func (r *Room) getPeer(deviceType string) *Client {
 	return nil
 }
 
-func (r *Room) broadcastExcept(excludeDeviceID string, ev Event) {
+func (r *Room) localClient(deviceID string) *Client {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	return r.clients[deviceID]
+}
+
+// remotePeerID returns the ID of a device of the given type connected to
+// another instance.
+func (r *Room) remotePeerID(deviceType string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for deviceID, p := range r.remote {
+		if p.deviceType == deviceType && p.fresh() {
+			return deviceID, true
+		}
+	}
+	return "", false
+}
+
+// hasPeer reports whether a device of the given type is in the room on any instance.
+func (r *Room) hasPeer(deviceType string) bool {
+	if r.getPeer(deviceType) != nil {
+		return true
+	}
+	_, ok := r.remotePeerID(deviceType)
+	return ok
+}
+
+// sendToPeer delivers ev to a device of the given type, forwarding it over
+// the backplane when that device is connected to another instance and
+// holding it when that device has briefly disconnected. It reports whether
+// the event was delivered or held.
+func (r *Room) sendToPeer(deviceType string, ev Event) bool {
+	if peer := r.getPeer(deviceType); peer != nil {
+		peer.send(ev)
+		return true
+	}
+
+	deviceID, ok := r.remotePeerID(deviceType)
+	if !ok {
+		return r.enqueueForType(deviceType, ev)
+	}
+	r.cluster.publish(clusterMessage{
+		Kind:     clusterMsgDirect,
+		RoomID:   r.id,
+		DeviceID: deviceID,
+		Event:    &ev,
+	})
+	return true
+}
+
+// active reports whether the owner Mac is connected to this or another instance.
+func (r *Room) active() bool {
+	r.mu.RLock()
+	isActive := r.isActive
+	r.mu.RUnlock()
+	if isActive {
+		return true
+	}
+	_, ok := r.remotePeerID(DeviceTypeMac)
+	return ok
+}
+
+// updateRemote applies a presence change announced by another instance.
+func (r *Room) updateRemote(deviceID, deviceType, node string, present bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !present {
+		if p, ok := r.remote[deviceID]; ok && p.node == node {
+			delete(r.remote, deviceID)
+		}
+		return
+	}
+	r.remote[deviceID] = remotePeer{node: node, deviceType: deviceType, seenAt: time.Now()}
+}
+
+func (r *Room) broadcastExcept(excludeDeviceID string, ev Event) {
+	r.mu.RLock()
 	r.broadcastExceptLocked(excludeDeviceID, ev)
+	r.mu.RUnlock()
+
+	r.cluster.publish(clusterMessage{
+		Kind:    clusterMsgBroadcast,
+		RoomID:  r.id,
+		Exclude: excludeDeviceID,
+		Event:   &ev,
+	})
 }
 
+// broadcastExceptLocked delivers ev to local clients only, holding it for
+// devices that recently left this instance.
 func (r *Room) broadcastExceptLocked(excludeDeviceID string, ev Event) {
 	for deviceID, client := range r.clients {
 		if deviceID != excludeDeviceID && client != nil {
 			client.send(ev)
 		}
 	}
+	r.enqueueAbsentLocked(excludeDeviceID, ev)
+}
+
+// cacheEvent stores the payload of a data sync event so late joiners
+// receive the latest value, and stamps ev with its cache version. Events
+// from other instances keep the version assigned where they originated.
+// It returns the value it replaced, if any.
+func (r *Room) cacheEvent(ev *Event) (json.RawMessage, bool) {
+	spec, ok := cachedEvents[ev.Type]
+	if !ok {
+		return nil, false
+	}
+	prev, ok := r.cache.Get(spec.key)
+	ev.Version = r.cache.SetVersion(spec.key, ev.Payload, spec.ttl, ev.Version)
+	return prev, ok
 }
 
-func (r *Room) waitForResponse(requestID string) <-chan Event {
+func (r *Room) waitForResponse(requestID, eventType string) <-chan Event {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	ch := make(chan Event, 1)
-	r.pending[requestID] = ch
+	r.pending[requestID] = &pendingRequest{ch: ch, eventType: eventType, started: time.Now()}
 	return ch
 }
 
+// fulfillResponse completes a pending request. Responses to requests made
+// through another instance are forwarded over the backplane.
 func (r *Room) fulfillResponse(ev Event) bool {
 	if ev.RequestID == "" {
 		return false
 	}
 
+	if r.fulfillLocal(ev) {
+		return true
+	}
+	r.cluster.publish(clusterMessage{
+		Kind:   clusterMsgResponse,
+		RoomID: r.id,
+		Event:  &ev,
+	})
+	return false
+}
+
+func (r *Room) fulfillLocal(ev Event) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	ch, exists := r.pending[ev.RequestID]
+	req, exists := r.pending[ev.RequestID]
 	if !exists {
 		return false
 	}
 
 	delete(r.pending, ev.RequestID)
+	elapsed := time.Since(req.started)
+	requestLatency.WithLabelValues(req.eventType).Observe(elapsed.Seconds())
+	slog.Debug("Request fulfilled", "room_id", r.id, "request_id", ev.RequestID, "event_type", req.eventType, "response_type", ev.Type, "latency", elapsed)
+	ch := req.ch
 
 	// Try to send response, but don't block
 	select {
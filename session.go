@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"echo/protocol"
+)
+
+// Session numbers the events sent to a device and keeps the unacknowledged
+// ones so that a reconnecting client can resume where it left off. A
+// session outlives its connection by resumeWindow.
+type Session struct {
+	token    string
+	deviceID string
+
+	mu         sync.Mutex
+	owner      *Client // connection currently sending on this session
+	lastSeq    uint64
+	buffer     []Event // unacknowledged events in sequence order
+	detachedAt time.Time
+}
+
+// next assigns the next sequence number to ev on behalf of c and keeps it
+// for replay. It reports false if the session has moved to another
+// connection.
+func (s *Session) next(c *Client, ev Event) (Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.owner != c {
+		return ev, false
+	}
+	s.lastSeq++
+	ev.Seq = s.lastSeq
+	if len(s.buffer) >= replayWindowSize {
+		s.buffer = s.buffer[1:]
+	}
+	s.buffer = append(s.buffer, ev)
+	return ev, true
+}
+
+// ack drops buffered events up to and including seq.
+func (s *Session) ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := 0
+	for i < len(s.buffer) && s.buffer[i].Seq <= seq {
+		i++
+	}
+	s.buffer = s.buffer[i:]
+}
+
+// since returns the events after lastSeen. ok is false when some of them
+// have already left the replay window and the client needs a full resync.
+func (s *Session) since(lastSeen uint64) (events []Event, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lastSeen >= s.lastSeq {
+		return nil, true
+	}
+	if len(s.buffer) == 0 || s.buffer[0].Seq > lastSeen+1 {
+		return nil, false
+	}
+	for _, ev := range s.buffer {
+		if ev.Seq > lastSeen {
+			events = append(events, ev)
+		}
+	}
+	return events, true
+}
+
+// takeOver moves the session to c and returns the connection that owned it.
+func (s *Session) takeOver(c *Client) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.owner
+	s.owner = c
+	s.detachedAt = time.Time{}
+	return prev
+}
+
+// release starts the resume window once c, the owning connection, is gone.
+func (s *Session) release(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.owner == c {
+		s.detachedAt = time.Now()
+	}
+}
+
+func (s *Session) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.detachedAt.IsZero() && now.Sub(s.detachedAt) > resumeWindow
+}
+
+// SessionStore holds the sessions of connected and recently disconnected
+// clients on this instance, keyed by resume token.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// create starts a session for the new connection c.
+func (ss *SessionStore) create(c *Client) (*Session, error) {
+	token, err := randomHex(24)
+	if err != nil {
+		return nil, fmt.Errorf("generate resume token: %w", err)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	now := time.Now()
+	for t, s := range ss.sessions {
+		if s.expired(now) {
+			delete(ss.sessions, t)
+		}
+	}
+
+	s := &Session{token: token, deviceID: c.deviceID, owner: c}
+	ss.sessions[token] = s
+	return s, nil
+}
+
+// lookup returns the live session for token if it belongs to deviceID.
+func (ss *SessionStore) lookup(token, deviceID string) (*Session, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	s, ok := ss.sessions[token]
+	if !ok || s.deviceID != deviceID {
+		return nil, false
+	}
+	if s.expired(time.Now()) {
+		delete(ss.sessions, token)
+		return nil, false
+	}
+	return s, true
+}
+
+// connected returns the live connections of deviceID.
+func (ss *SessionStore) connected(deviceID string) []*Client {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var clients []*Client
+	for _, s := range ss.sessions {
+		if s.deviceID != deviceID {
+			continue
+		}
+		s.mu.Lock()
+		if s.owner != nil && s.detachedAt.IsZero() {
+			clients = append(clients, s.owner)
+		}
+		s.mu.Unlock()
+	}
+	return clients
+}
+
+// all returns the live connections on this instance.
+func (ss *SessionStore) all() []*Client {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var clients []*Client
+	for _, s := range ss.sessions {
+		s.mu.Lock()
+		if s.owner != nil && s.detachedAt.IsZero() {
+			clients = append(clients, s.owner)
+		}
+		s.mu.Unlock()
+	}
+	return clients
+}
+
+func (ss *SessionStore) remove(token string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.sessions, token)
+}
+
+func (m *Manager) handleAck(ev Event, c *Client) error {
+	var payload protocol.Ack
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	c.currentSession().ack(payload.Seq)
+	return nil
+}
+
+// handleResume moves a previous session onto this connection, replays the
+// events the client has not seen and rejoins the room of the old connection
+// through Room.addClient, which also closes that connection if it is still
+// open. Sessions are local to an instance; a client that lands elsewhere
+// gets resume_failed and falls back to a regular join.
+func (m *Manager) handleResume(ev Event, c *Client) error {
+	var payload protocol.Resume
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	prev, ok := m.sessions.lookup(payload.ResumeToken, c.deviceID)
+	if !ok || prev == c.currentSession() {
+		return newRouteError(ErrCodeResumeFailed, "unknown or expired resume token")
+	}
+
+	fresh := c.currentSession()
+	old, missed, complete := c.adoptSession(prev, payload.LastSeq)
+	m.sessions.remove(fresh.token)
+
+	var lastRoom, room *Room
+	if old != nil {
+		old.mu.RLock()
+		lastRoom = old.lastRoom
+		old.mu.RUnlock()
+	}
+	if lastRoom != nil {
+		room = m.resumableRoom(lastRoom.id, c)
+	}
+
+	c.logger().Info("Device resumed session", "replayed", len(missed), "complete", complete)
+
+	roomID := ""
+	if room != nil {
+		roomID = room.id
+	}
+	c.send(Event{
+		Type:      EventResumed,
+		RoomID:    roomID,
+		RequestID: ev.RequestID,
+		Timestamp: time.Now(),
+		Payload:   protocol.EncodePayload(protocol.Resumed{Replayed: len(missed), FullResync: !complete}),
+	})
+
+	if room != nil {
+		room.addClient(c)
+	}
+	if old != nil {
+		old.closeConn()
+	}
+	if !complete && room != nil {
+		m.sendCachedData(c, room)
+	}
+	return nil
+}
+
+// resumableRoom returns the room a resuming client should rejoin, applying
+// the same rules as create_room and join_room: the owner Mac reactivates its
+// room, a watch needs an active room it is paired with.
+func (m *Manager) resumableRoom(roomID string, c *Client) *Room {
+	room, exists := m.lookupRoom(roomID)
+	if !exists {
+		return nil
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	switch {
+	case room.macID == c.deviceID:
+		room.isActive = true
+	case c.deviceType != DeviceTypeWatch || !room.isActive || !room.authorized[c.deviceID]:
+		return nil
+	}
+	return room
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrRoomNotFound = errors.New("room not found")
+
+// RoomRecord is the persisted state of a room: its owner Mac and the watches
+// paired with it. Connections and cached data are never persisted.
+type RoomRecord struct {
+	ID         string    `json:"id"`
+	MacID      string    `json:"mac_id"`
+	Authorized []string  `json:"authorized,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// RoomStore persists rooms so pairings survive a server restart.
+type RoomStore interface {
+	LoadRooms() ([]RoomRecord, error)
+	LoadRoom(id string) (RoomRecord, error)
+	SaveRoom(rec RoomRecord) error
+	DeleteRoom(id string) error
+	Close() error
+}
+
+// openRoomStore returns a file-backed store when path is set. Otherwise rooms
+// are kept on the backplane when it is shared between instances, and in
+// memory when it is not.
+func openRoomStore(path string, bp Backplane) (RoomStore, error) {
+	if path != "" {
+		return NewFileRoomStore(path)
+	}
+	if _, ok := bp.(*RedisBackplane); ok {
+		return NewBackplaneRoomStore(bp), nil
+	}
+	return NewMemoryRoomStore(), nil
+}
+
+// MemoryRoomStore keeps rooms in memory only. Pairings are lost on restart.
+type MemoryRoomStore struct {
+	mu    sync.RWMutex
+	rooms map[string]RoomRecord
+}
+
+func NewMemoryRoomStore() *MemoryRoomStore {
+	return &MemoryRoomStore{
+		rooms: make(map[string]RoomRecord),
+	}
+}
+
+func (s *MemoryRoomStore) LoadRooms() ([]RoomRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedRecords(s.rooms), nil
+}
+
+func (s *MemoryRoomStore) LoadRoom(id string) (RoomRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.rooms[id]
+	if !ok {
+		return RoomRecord{}, ErrRoomNotFound
+	}
+	return rec, nil
+}
+
+func (s *MemoryRoomStore) SaveRoom(rec RoomRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[rec.ID] = rec
+	return nil
+}
+
+func (s *MemoryRoomStore) DeleteRoom(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms, id)
+	return nil
+}
+
+func (s *MemoryRoomStore) Close() error {
+	return nil
+}
+
+// FileRoomStore keeps rooms in a single JSON file. Every write rewrites the
+// file atomically, which is fine for the small number of rooms we host.
+type FileRoomStore struct {
+	mu    sync.RWMutex
+	path  string
+	rooms map[string]RoomRecord
+}
+
+func NewFileRoomStore(path string) (*FileRoomStore, error) {
+	s := &FileRoomStore{
+		path:  path,
+		rooms: make(map[string]RoomRecord),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create store directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read room store: %w", err)
+	}
+
+	var records []RoomRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("decode room store %s: %w", path, err)
+	}
+	for _, rec := range records {
+		s.rooms[rec.ID] = rec
+	}
+	return s, nil
+}
+
+func (s *FileRoomStore) LoadRooms() ([]RoomRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedRecords(s.rooms), nil
+}
+
+func (s *FileRoomStore) LoadRoom(id string) (RoomRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.rooms[id]
+	if !ok {
+		return RoomRecord{}, ErrRoomNotFound
+	}
+	return rec, nil
+}
+
+func (s *FileRoomStore) SaveRoom(rec RoomRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.rooms[rec.ID]
+	s.rooms[rec.ID] = rec
+	if err := s.flushLocked(); err != nil {
+		if existed {
+			s.rooms[rec.ID] = prev
+		} else {
+			delete(s.rooms, rec.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileRoomStore) DeleteRoom(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.rooms[id]
+	if !existed {
+		return nil
+	}
+	delete(s.rooms, id)
+	if err := s.flushLocked(); err != nil {
+		s.rooms[id] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *FileRoomStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+// flushLocked writes all rooms to a temp file and renames it over the store
+// so a crash mid-write never leaves a truncated file behind.
+func (s *FileRoomStore) flushLocked() error {
+	data, err := json.MarshalIndent(sortedRecords(s.rooms), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode room store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp store file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write room store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync room store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close room store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("replace room store: %w", err)
+	}
+	return nil
+}
+
+// BackplaneRoomStore keeps rooms in a backplane hash so every instance sees
+// the same owner and pairings for a room.
+type BackplaneRoomStore struct {
+	bp Backplane
+}
+
+const roomsKey = "echo:rooms"
+
+func NewBackplaneRoomStore(bp Backplane) *BackplaneRoomStore {
+	return &BackplaneRoomStore{bp: bp}
+}
+
+func (s *BackplaneRoomStore) LoadRooms() ([]RoomRecord, error) {
+	all, err := s.bp.HGetAll(roomsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make(map[string]RoomRecord, len(all))
+	for id, raw := range all {
+		var rec RoomRecord
+		if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+			return nil, fmt.Errorf("decode room %s: %w", id, err)
+		}
+		rooms[id] = rec
+	}
+	return sortedRecords(rooms), nil
+}
+
+func (s *BackplaneRoomStore) LoadRoom(id string) (RoomRecord, error) {
+	raw, ok, err := s.bp.HGet(roomsKey, id)
+	if err != nil {
+		return RoomRecord{}, err
+	}
+	if !ok {
+		return RoomRecord{}, ErrRoomNotFound
+	}
+
+	var rec RoomRecord
+	if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+		return RoomRecord{}, fmt.Errorf("decode room %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+func (s *BackplaneRoomStore) SaveRoom(rec RoomRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.bp.HSet(roomsKey, rec.ID, string(data))
+}
+
+func (s *BackplaneRoomStore) DeleteRoom(id string) error {
+	_, err := s.bp.HDel(roomsKey, id)
+	return err
+}
+
+// Close is a no-op; the backplane is closed by its owner.
+func (s *BackplaneRoomStore) Close() error {
+	return nil
+}
+
+func sortedRecords(rooms map[string]RoomRecord) []RoomRecord {
+	records := make([]RoomRecord, 0, len(rooms))
+	for _, rec := range rooms {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].CreatedAt.Equal(records[j].CreatedAt) {
+			return records[i].CreatedAt.Before(records[j].CreatedAt)
+		}
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
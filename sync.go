@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"echo/protocol"
+)
+
+// handleSync answers "sync since version N" for the room's cache keys. The
+// payload maps cache keys to the version the client holds, e.g.
+// {"since": {"downloads": 12, "battery": 40}}.
+func (m *Manager) handleSync(ev Event, c *Client) error {
+	var payload protocol.Sync
+	if err := json.Unmarshal(ev.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	m.sendSync(c, c.room, payload.Since, ev.RequestID)
+	return nil
+}
+
+// sendSync sends a sync_result with a JSON Patch or a snapshot for every
+// cache key that changed since the versions in since. Keys missing from
+// since are sent as snapshots; keys already up to date are left out.
+func (m *Manager) sendSync(c *Client, room *Room, since map[string]uint64, requestID string) {
+	entries := make(map[string]CacheDelta)
+	for _, spec := range cachedEvents {
+		if delta, ok := room.cache.Since(spec.key, since[spec.key]); ok {
+			entries[spec.key] = delta
+		}
+	}
+
+	b, err := json.Marshal(protocol.SyncResult{Entries: entries})
+	if err != nil {
+		c.sendError(requestID, ErrCodeRouting, "failed to encode sync result")
+		return
+	}
+	c.send(Event{
+		Type:      EventSyncResult,
+		RoomID:    room.id,
+		RequestID: requestID,
+		Timestamp: time.Now(),
+		Payload:   b,
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// telemetryIntervals is the minimum time between two broadcasts of each
+// high-frequency telemetry type. Updates arriving in between replace each
+// other and only the latest is sent once the interval has passed.
+var telemetryIntervals = map[string]time.Duration{
+	EventBatteryUpdate:   batteryMinInterval,
+	EventStorageUpdate:   storageMinInterval,
+	EventDownloadsUpdate: downloadsMinInterval,
+}
+
+// telemetryState throttles one telemetry type in a room.
+type telemetryState struct {
+	lastSent time.Time
+	pending  *Event      // latest update waiting for the interval to pass
+	timer    *time.Timer // fires flushTelemetry while pending is set
+}
+
+// publishTelemetry broadcasts a telemetry update from the Mac, holding it
+// back if the type was broadcast less than its minimum interval ago.
+func (r *Room) publishTelemetry(ev Event) {
+	interval, ok := telemetryIntervals[ev.Type]
+	if !ok {
+		r.broadcastTelemetry(ev)
+		return
+	}
+
+	r.telemetryMu.Lock()
+	state := r.telemetry[ev.Type]
+	if state == nil {
+		state = &telemetryState{}
+		r.telemetry[ev.Type] = state
+	}
+	wait := interval - time.Since(state.lastSent)
+	if wait > 0 || state.pending != nil {
+		state.pending = &ev
+		if state.timer == nil {
+			eventType := ev.Type
+			state.timer = time.AfterFunc(wait, func() { r.flushTelemetry(eventType) })
+		}
+		r.telemetryMu.Unlock()
+		return
+	}
+	state.lastSent = time.Now()
+	r.telemetryMu.Unlock()
+
+	r.broadcastTelemetry(ev)
+}
+
+// flushTelemetry broadcasts the update held back for eventType.
+func (r *Room) flushTelemetry(eventType string) {
+	r.telemetryMu.Lock()
+	state := r.telemetry[eventType]
+	if state == nil || state.pending == nil {
+		r.telemetryMu.Unlock()
+		return
+	}
+	ev := *state.pending
+	state.pending = nil
+	state.timer = nil
+	state.lastSent = time.Now()
+	r.telemetryMu.Unlock()
+
+	ev.Timestamp = time.Now()
+	r.broadcastTelemetry(ev)
+}
+
+// broadcastTelemetry caches ev and sends it to every other member of the
+// room, locally and on other instances.
+func (r *Room) broadcastTelemetry(ev Event) {
+	base, hasBase := r.cacheEvent(&ev)
+
+	r.mu.RLock()
+	r.broadcastTelemetryLocked(ev.DeviceID, ev, base, hasBase)
+	r.mu.RUnlock()
+
+	r.cluster.publish(clusterMessage{
+		Kind:    clusterMsgBroadcast,
+		RoomID:  r.id,
+		Exclude: ev.DeviceID,
+		Event:   &ev,
+	})
+}
+
+// broadcastTelemetryLocked delivers a telemetry update to local clients.
+// Clients that opted into deltas receive a merge patch against base, the
+// previously cached value, when it is smaller than the full payload.
+// Callers must hold r.mu.
+func (r *Room) broadcastTelemetryLocked(excludeDeviceID string, ev Event, base json.RawMessage, hasBase bool) {
+	var delta *Event
+	if hasBase {
+		patch, err := createMergePatch(base, ev.Payload)
+		if err == nil && len(patch) < len(ev.Payload) {
+			d := ev
+			d.Payload = patch
+			d.Delta = true
+			delta = &d
+		}
+	}
+
+	for deviceID, client := range r.clients {
+		if deviceID == excludeDeviceID || client == nil {
+			continue
+		}
+		if delta != nil && client.hasFeature(FeatureTelemetryDeltas) {
+			if string(delta.Payload) != "{}" {
+				client.send(*delta)
+			}
+			continue
+		}
+		client.send(ev)
+	}
+	r.enqueueAbsentLocked(excludeDeviceID, ev)
+}
+
+// stopTelemetry drops held-back updates when the room goes away.
+func (r *Room) stopTelemetry() {
+	r.telemetryMu.Lock()
+	defer r.telemetryMu.Unlock()
+
+	for _, state := range r.telemetry {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+	}
+	r.telemetry = make(map[string]*telemetryState)
+}
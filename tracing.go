@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "echo"
+
+var tracer = otel.Tracer(tracerName)
+
+// propagator carries W3C trace context in Event.Trace.
+var propagator = propagation.TraceContext{}
+
+// setupTracing exports spans over OTLP/HTTP when an OTLP endpoint is
+// configured through the standard OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables, e.g. a collector on
+// http://localhost:4318. Without one, spans are not recorded. The returned
+// function flushes pending spans on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := sdkresource.Merge(sdkresource.Default(), sdkresource.NewSchemaless(
+		semconv.ServiceName(tracerName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	// The sampler follows OTEL_TRACES_SAMPLER, honouring client decisions
+	// by default.
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// traced reports whether spans are recorded for an inbound event: requests
+// and responses, identified by a request ID, and events that already carry
+// a trace. Telemetry and other fire-and-forget events are left out.
+func traced(ev Event) bool {
+	return ev.RequestID != "" || len(ev.Trace) > 0
+}
+
+// traceContext returns ctx extended with the trace context carried by ev.
+func traceContext(ctx context.Context, ev Event) context.Context {
+	if len(ev.Trace) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(ev.Trace))
+}
+
+// withTrace returns ev carrying the span context of ctx, replacing any it
+// had, so the receiving device can continue the trace.
+func withTrace(ctx context.Context, ev Event) Event {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ev
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	ev.Trace = carrier
+	return ev
+}
+
+// startEventSpan starts a span for ev as a child of the trace it carries.
+func startEventSpan(ctx context.Context, name string, ev Event, c *Client, kind trace.SpanKind) (context.Context, trace.Span) {
+	return tracer.Start(traceContext(ctx, ev), name+" "+ev.Type,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(eventSpanAttrs(ev, c)...),
+	)
+}
+
+func eventSpanAttrs(ev Event, c *Client) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("echo.event_type", ev.Type),
+		attribute.String("echo.device_id", c.deviceID),
+		attribute.String("echo.device_type", c.deviceType),
+	}
+	if ev.RequestID != "" {
+		attrs = append(attrs, attribute.String("echo.request_id", ev.RequestID))
+	}
+	if ev.RoomID != "" {
+		attrs = append(attrs, attribute.String("echo.room_id", ev.RoomID))
+	}
+	return attrs
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+var (
+	errPeerDisconnected = errors.New("peer disconnected")
+	errRequestTimeout   = errors.New("request timed out")
+)
+
+// forwardToPeer sends ev to the peer of deviceType under a forward span in
+// the trace of ctx. The peer receives the span's context in ev.Trace.
+func (r *Room) forwardToPeer(ctx context.Context, c *Client, deviceType string, ev Event) bool {
+	ctx, span := startEventSpan(ctx, "forward", ev, c, trace.SpanKindProducer)
+	sent := r.sendToPeer(deviceType, withTrace(ctx, ev))
+	if !sent {
+		endSpan(span, errPeerDisconnected)
+		return false
+	}
+	span.End()
+	return true
+}
+
+// startDeliverSpan starts the span delivering a peer's response to the
+// requesting client. It continues the request's trace in ctx and links to
+// the trace the response arrived with, if the peer sent one.
+func startDeliverSpan(ctx context.Context, resp Event, c *Client) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(eventSpanAttrs(resp, c)...),
+	}
+	if link := trace.LinkFromContext(traceContext(context.Background(), resp)); link.SpanContext.IsValid() {
+		opts = append(opts, trace.WithLinks(link))
+	}
+	return tracer.Start(ctx, "deliver "+resp.Type, opts...)
+}